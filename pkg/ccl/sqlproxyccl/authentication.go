@@ -13,6 +13,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/ccl/sqlproxyccl/interceptor"
 	"github.com/cockroachdb/cockroach/pkg/ccl/sqlproxyccl/throttler"
+	"github.com/cockroachdb/errors"
 	pgproto3 "github.com/jackc/pgproto3/v2"
 )
 
@@ -75,6 +76,12 @@ var authenticate = func(clientConn, crdbConn net.Conn, throttleHook func(throttl
 			if err != nil {
 				return newErrorf(codeClientReadFailed, "unable to receive message from client: %v", err)
 			}
+			if err = checkChannelBinding(fntMsg); err != nil {
+				if sendErr := feSend(toPgError(err)); sendErr != nil {
+					return sendErr
+				}
+				return err
+			}
 			err = be.Send(fntMsg)
 			if err != nil {
 				return newErrorf(
@@ -135,6 +142,37 @@ var authenticate = func(clientConn, crdbConn net.Conn, throttleHook func(throttl
 	return newErrorf(codeBackendDisconnected, "authentication took more than %d iterations", i)
 }
 
+// scramChannelBindingMechanism is the SASL mechanism used by clients which
+// bind the SCRAM exchange to the underlying TLS connection.
+const scramChannelBindingMechanism = "SCRAM-SHA-256-PLUS"
+
+// checkChannelBinding returns an error if the client attempts to authenticate
+// using SCRAM with channel binding (SCRAM-SHA-256-PLUS), which cannot succeed
+// through the proxy.
+//
+// With the tls-server-end-point channel binding type, the client proves that
+// it sees the same TLS certificate as the server. Since the proxy terminates
+// the client's TLS connection and originates a new one to the backend, the
+// certificate hash computed by the client is the proxy's, and the backend
+// rejects the proof. Transparently downgrading to SCRAM-SHA-256 isn't possible
+// either: hiding SCRAM-SHA-256-PLUS from the client causes clients which
+// support channel binding to send the "y" GS2 flag, which a backend that
+// supports channel binding rejects as a downgrade attack, and the flag is
+// covered by the client's proof, so the proxy cannot rewrite it. Rather than
+// relaying an exchange that is bound to fail with an opaque authentication
+// error, the proxy fails it early with an explicit error.
+func checkChannelBinding(msg pgproto3.FrontendMessage) error {
+	initial, ok := msg.(*pgproto3.SASLInitialResponse)
+	if !ok || initial.AuthMechanism != scramChannelBindingMechanism {
+		return nil
+	}
+	return errors.WithHint(
+		newErrorf(codeUnsupportedChannelBinding,
+			"SCRAM channel binding is not supported through the proxy"),
+		"Disable channel binding in the client, e.g. with channel_binding=disable.",
+	)
+}
+
 // readTokenAuthResult reads the result for the token-based authentication, and
 // assumes that the connection credentials have already been transmitted to the
 // server (as part of the startup message). If authentication fails, this will
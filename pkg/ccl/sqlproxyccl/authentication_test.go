@@ -203,6 +203,46 @@ func TestAuthenticateUnexpectedMessage(t *testing.T) {
 	require.Equal(t, codeBackendDisconnected, codeErr.code)
 }
 
+func TestAuthenticateChannelBinding(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	cli, srv := net.Pipe()
+	be := pgproto3.NewBackend(pgproto3.NewChunkReader(srv), srv)
+	fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(cli), cli)
+
+	sasl := &pgproto3.AuthenticationSASL{
+		AuthMechanisms: []string{"SCRAM-SHA-256", scramChannelBindingMechanism},
+	}
+	go func() {
+		err := be.Send(sasl)
+		require.NoError(t, err)
+		beMsg, err := fe.Receive()
+		require.NoError(t, err)
+		require.Equal(t, beMsg, sasl)
+
+		err = fe.Send(&pgproto3.SASLInitialResponse{
+			AuthMechanism: scramChannelBindingMechanism,
+			Data:          []byte("p=tls-server-end-point,,n=,r=nonce"),
+		})
+		require.NoError(t, err)
+		beMsg, err = fe.Receive()
+		require.NoError(t, err)
+		errMsg, ok := beMsg.(*pgproto3.ErrorResponse)
+		require.True(t, ok)
+		require.Contains(t, errMsg.Message, "channel binding is not supported")
+		require.NotEmpty(t, errMsg.Hint)
+	}()
+
+	err := authenticate(srv, cli, nilThrottleHook)
+
+	srv.Close()
+
+	require.Error(t, err)
+	codeErr := (*codeError)(nil)
+	require.True(t, errors.As(err, &codeErr))
+	require.Equal(t, codeUnsupportedChannelBinding, codeErr.code)
+}
+
 func TestReadTokenAuthResult(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -0,0 +1,116 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/cockroachdb/errors"
+)
+
+// BackendAddressFilter restricts the IP addresses which the dialer connects
+// to, e.g. to prevent a compromised address resolver from directing dials at
+// internal endpoints such as cloud metadata services. An address is allowed if
+// it doesn't belong to any of the denied ranges and, if allowed ranges were
+// specified, if it belongs to one of them.
+type BackendAddressFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewBackendAddressFilter returns a BackendAddressFilter which allows the
+// addresses in the allow ranges (or all addresses if allow is empty), except
+// for those in the deny ranges. Ranges are in CIDR notation (e.g.
+// "169.254.0.0/16", "127.0.0.0/8", "10.0.0.0/8" or "fe80::/10").
+func NewBackendAddressFilter(allow, deny []string) (*BackendAddressFilter, error) {
+	f := &BackendAddressFilter{}
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseCIDRs parses the given ranges in CIDR notation.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid address range %q", cidr)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// DialAddressFilter, if set, is checked against the IP address of every
+// connection established by the dialer (including by a BackendPool, and by
+// BackendCancel to forward CancelRequests), right before connecting, i.e. once
+// the backend address was resolved. Since the check is performed on the
+// address actually being dialed, it can't be bypassed by DNS rebinding.
+// Dialing a forbidden address fails with a codeBackendAddressForbidden error,
+// which is not retried. Backends reached over a Unix domain socket are not
+// subject to the filter. When dialing through HTTPConnectProxy, the address of
+// the HTTP proxy is checked, and the proxy must enforce its own policy on the
+// backends it connects to.
+var DialAddressFilter *BackendAddressFilter
+
+// Allowed returns whether the filter allows ip.
+func (f *BackendAddressFilter) Allowed(ip net.IP) bool {
+	for _, ipNet := range f.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range f.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// control returns a net.Dialer Control function which checks the address
+// being dialed against the filter before calling next, if set.
+func (f *BackendAddressFilter) control(
+	next func(network, address string, c syscall.RawConn) error,
+) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		// Unix domain sockets are not subject to the filter.
+		if network == "unix" {
+			if next != nil {
+				return next(network, address, c)
+			}
+			return nil
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		// The address is always an IP address by the time it is dialed.
+		ip := net.ParseIP(host)
+		if ip == nil || !f.Allowed(ip) {
+			return newErrorf(
+				codeBackendAddressForbidden, "dialing backend address %s is forbidden", address,
+			)
+		}
+		if next != nil {
+			return next(network, address, c)
+		}
+		return nil
+	}
+}
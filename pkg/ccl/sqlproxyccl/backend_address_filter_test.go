@@ -0,0 +1,155 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendAddressFilter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	f, err := NewBackendAddressFilter(
+		[]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.0.0.0/24"},
+	)
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"2001:db8::1", true},
+		{"10.0.0.1", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+	} {
+		require.Equal(t, tc.allowed, f.Allowed(net.ParseIP(tc.ip)), tc.ip)
+	}
+
+	f, err = NewBackendAddressFilter(nil, []string{"169.254.0.0/16"})
+	require.NoError(t, err)
+	require.True(t, f.Allowed(net.ParseIP("127.0.0.1")))
+	require.False(t, f.Allowed(net.ParseIP("169.254.169.254")))
+
+	_, err = NewBackendAddressFilter([]string{"10.0.0.0"}, nil)
+	require.EqualError(t, err, `invalid address range "10.0.0.0": invalid CIDR address: 10.0.0.0`)
+}
+
+func TestBackendDialAddressFilter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var accepted int32
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		atomic.AddInt32(&accepted, 1)
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stop()
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	setFilter := func(t *testing.T, allow, deny []string) func() {
+		f, err := NewBackendAddressFilter(allow, deny)
+		require.NoError(t, err)
+		return testutils.TestingHook(&DialAddressFilter, f)
+	}
+
+	t.Run("denied", func(t *testing.T) {
+		defer setFilter(t, nil, []string{"127.0.0.0/8"})()
+		_, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+		require.Equal(t, codeBackendAddressForbidden, getErrorCode(err))
+		code, retryable := ClassifyDialError(err)
+		require.Equal(t, CodeBackendAddressForbidden, code)
+		require.False(t, retryable)
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		defer setFilter(t, []string{"10.0.0.0/8"}, nil)()
+		_, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+		require.Equal(t, codeBackendAddressForbidden, getErrorCode(err))
+	})
+
+	t.Run("resolved address", func(t *testing.T) {
+		// The hostname is checked once resolved, even if the resolver
+		// rewrites the address.
+		defer setFilter(t, nil, []string{"127.0.0.0/8"})()
+		defer testutils.TestingHook(&AddressResolver, func(
+			context.Context, string,
+		) (string, error) {
+			return net.JoinHostPort("localhost", port), nil
+		})()
+		_, err := BackendDialContext(
+			ctx, testStartupMessage(), "backend.example.com:"+port, nil, /* tlsConfig */
+			DialNetwork("tcp4"),
+		)
+		require.Equal(t, codeBackendAddressForbidden, getErrorCode(err))
+	})
+
+	t.Run("pool", func(t *testing.T) {
+		defer setFilter(t, nil, []string{"127.0.0.0/8"})()
+		pool := NewBackendPool(addr, 1)
+		defer pool.Close()
+		_, err := pool.dial(ctx)
+		require.Equal(t, codeBackendAddressForbidden, getErrorCode(err))
+	})
+
+	t.Run("cancel request", func(t *testing.T) {
+		defer setFilter(t, nil, []string{"127.0.0.0/8"})()
+		registry := NewCancelRegistry()
+		registry.Register(addr, &pgproto3.BackendKeyData{ProcessID: 42, SecretKey: 1234})
+		err := BackendCancel(
+			ctx, registry, &pgproto3.CancelRequest{ProcessID: 42, SecretKey: 1234}, nil, /* tlsConfig */
+		)
+		require.Equal(t, codeBackendAddressForbidden, getErrorCode(err))
+	})
+
+	require.Equal(t, int32(0), atomic.LoadInt32(&accepted))
+
+	t.Run("unix socket", func(t *testing.T) {
+		defer setFilter(t, []string{"10.0.0.0/8"}, []string{"169.254.0.0/16"})()
+		socketPath := filepath.Join(t.TempDir(), ".s.PGSQL.26257")
+		_, stop := startTestBackendOn(t, "unix", socketPath, func(conn net.Conn) {
+			_, _ = receiveStartupMessage(conn)
+		})
+		defer stop()
+		conn, err := BackendDialContext(ctx, testStartupMessage(), socketPath, nil /* tlsConfig */)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		defer setFilter(t, []string{"127.0.0.0/8"}, nil)()
+		// The Control function of the dialer, if any, still applies.
+		var controlled int32
+		dialer := &net.Dialer{Control: func(string, string, syscall.RawConn) error {
+			atomic.AddInt32(&controlled, 1)
+			return nil
+		}}
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil /* tlsConfig */, NetDialer(dialer),
+		)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+		require.Equal(t, int32(1), atomic.LoadInt32(&controlled))
+	})
+}
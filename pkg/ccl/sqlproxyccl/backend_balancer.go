@@ -0,0 +1,142 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// BackendChooser picks the backend to dial among a set of candidates, e.g. the
+// healthy backends of a tenant. Implementations must be safe for concurrent
+// use.
+type BackendChooser interface {
+	// Choose returns the candidate to dial. candidates is never empty, and
+	// must not be modified or retained. The returned address should be one
+	// of the candidates.
+	Choose(candidates []string) (string, error)
+}
+
+// errNoCandidates is returned by the choosers of this package if they are
+// given no candidates.
+var errNoCandidates = errors.New("no backend SQL server candidates")
+
+// NewRoundRobinChooser returns a BackendChooser which cycles through the
+// candidates, regardless of the outcome of the dials.
+func NewRoundRobinChooser() BackendChooser {
+	return &roundRobinChooser{}
+}
+
+type roundRobinChooser struct {
+	// next is the index of the candidate to choose next, modulo the number
+	// of candidates. Accessed atomically.
+	next uint64
+}
+
+// Choose implements the BackendChooser interface.
+func (c *roundRobinChooser) Choose(candidates []string) (string, error) {
+	if len(candidates) == 0 {
+		return "", errNoCandidates
+	}
+	next := atomic.AddUint64(&c.next, 1) - 1
+	return candidates[next%uint64(len(candidates))], nil
+}
+
+// NewRandomChooser returns a BackendChooser which picks a candidate uniformly
+// at random.
+func NewRandomChooser() BackendChooser {
+	return randomChooser{}
+}
+
+type randomChooser struct{}
+
+// Choose implements the BackendChooser interface.
+func (randomChooser) Choose(candidates []string) (string, error) {
+	if len(candidates) == 0 {
+		return "", errNoCandidates
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
+
+// DialBalanced is like BackendDial, but dials the backend picked by chooser
+// among candidates. See DialBalancedContext for more details.
+func DialBalanced(
+	msg *pgproto3.StartupMessage, candidates []string, chooser BackendChooser, tlsConfig *tls.Config,
+) (net.Conn, string, error) {
+	return DialBalancedContext(context.Background(), msg, candidates, chooser, tlsConfig)
+}
+
+// DialBalancedContext is the context-aware version of DialBalanced. The
+// candidate picked by chooser is dialed through BackendDialContext with the
+// supplied options. It returns the connection along with the address it was
+// established with.
+//
+// If the dial fails with a retryable error (see ClassifyDialError), e.g. a
+// codeBackendDown error, the failed candidate is removed from the set of
+// candidates, and chooser picks another one among the remaining candidates.
+// Other errors, such as codeBackendRefusedTLS, are returned as is, as are the
+// errors returned by chooser. Dialing stops early if ctx is done. If all the
+// candidates fail, the returned codeBackendDown error lists the failure of each
+// of them.
+func DialBalancedContext(
+	ctx context.Context,
+	msg *pgproto3.StartupMessage,
+	candidates []string,
+	chooser BackendChooser,
+	tlsConfig *tls.Config,
+	opts ...DialOption,
+) (net.Conn, string, error) {
+	if len(candidates) == 0 {
+		return nil, "", newErrorf(codeBackendDown, "no backend SQL server addresses to dial")
+	}
+	// The candidates of the caller must not be modified.
+	remaining := append([]string(nil), candidates...)
+	failures := make([]string, 0, len(candidates))
+	for len(remaining) > 0 {
+		addr, err := chooser.Choose(remaining)
+		if err != nil {
+			return nil, "", err
+		}
+		conn, err := BackendDialContext(ctx, msg, addr, tlsConfig, opts...)
+		if err == nil {
+			return conn, addr, nil
+		}
+		if _, retryable := ClassifyDialError(err); !retryable || ctx.Err() != nil {
+			return nil, "", err
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", addr, err))
+		remaining = removeCandidate(remaining, addr)
+	}
+	return nil, "", newErrorf(
+		codeBackendDown, "unable to dial any backend SQL server (%d attempted): %s",
+		len(failures), strings.Join(failures, "; "),
+	)
+}
+
+// removeCandidate removes addr from candidates, in place. If addr isn't one
+// of the candidates, the first candidate is removed instead, so that dialing
+// terminates even if the chooser misbehaves.
+func removeCandidate(candidates []string, addr string) []string {
+	idx := 0
+	for i, candidate := range candidates {
+		if candidate == addr {
+			idx = i
+			break
+		}
+	}
+	return append(candidates[:idx], candidates[idx+1:]...)
+}
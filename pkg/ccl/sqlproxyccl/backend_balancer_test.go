@@ -0,0 +1,142 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendChoosers(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	candidates := []string{"a", "b", "c"}
+
+	t.Run("round-robin", func(t *testing.T) {
+		c := NewRoundRobinChooser()
+		var chosen []string
+		for i := 0; i < 4; i++ {
+			addr, err := c.Choose(candidates)
+			require.NoError(t, err)
+			chosen = append(chosen, addr)
+		}
+		require.Equal(t, []string{"a", "b", "c", "a"}, chosen)
+		_, err := c.Choose(nil)
+		require.Equal(t, errNoCandidates, err)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		c := NewRandomChooser()
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			addr, err := c.Choose(candidates)
+			require.NoError(t, err)
+			require.Contains(t, candidates, addr)
+			seen[addr] = true
+		}
+		require.Len(t, seen, len(candidates))
+		_, err := c.Choose(nil)
+		require.Equal(t, errNoCandidates, err)
+	})
+}
+
+// recordingChooser is a BackendChooser which picks the first candidate, and
+// records the candidates it was given.
+type recordingChooser struct {
+	calls [][]string
+}
+
+func (c *recordingChooser) Choose(candidates []string) (string, error) {
+	c.calls = append(c.calls, append([]string(nil), candidates...))
+	return candidates[0], nil
+}
+
+func TestDialBalanced(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	deadAddr := unusedTCPAddr(t)
+
+	// The refusing backend has no TLS config, so it refuses SSLRequests.
+	refusing, err := newTestBackend(nil /* serverTLSConfig */)
+	require.NoError(t, err)
+	defer refusing.Close()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	goodAddr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = receiveStartupMessage(tlsConn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	t.Run("failed candidates are removed", func(t *testing.T) {
+		chooser := &recordingChooser{}
+		candidates := []string{deadAddr, goodAddr}
+		conn, addr, err := DialBalancedContext(
+			ctx, testStartupMessage(), candidates, chooser, clientCfg,
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, goodAddr, addr)
+		require.Equal(t, [][]string{{deadAddr, goodAddr}, {goodAddr}}, chooser.calls)
+		// The candidates of the caller are left untouched.
+		require.Equal(t, []string{deadAddr, goodAddr}, candidates)
+	})
+
+	t.Run("non-retryable error", func(t *testing.T) {
+		chooser := &recordingChooser{}
+		_, _, err := DialBalancedContext(
+			ctx, testStartupMessage(), []string{refusing.Addr(), goodAddr}, chooser, clientCfg,
+		)
+		require.Equal(t, codeBackendRefusedTLS, getErrorCode(err))
+		require.Len(t, chooser.calls, 1)
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		_, _, err := DialBalancedContext(
+			ctx, testStartupMessage(), []string{deadAddr, deadAddr}, NewRoundRobinChooser(), clientCfg,
+		)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Regexp(t, "2 attempted", err)
+
+		_, _, err = DialBalanced(testStartupMessage(), nil, NewRandomChooser(), clientCfg)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+	})
+
+	t.Run("chooser error", func(t *testing.T) {
+		chooserErr := errors.New("no healthy backend")
+		_, _, err := DialBalancedContext(
+			ctx, testStartupMessage(), []string{goodAddr}, chooserFunc(
+				func([]string) (string, error) { return "", chooserErr },
+			), clientCfg,
+		)
+		require.Equal(t, chooserErr, err)
+	})
+}
+
+// chooserFunc adapts a function to the BackendChooser interface.
+type chooserFunc func(candidates []string) (string, error)
+
+func (f chooserFunc) Choose(candidates []string) (string, error) {
+	return f(candidates)
+}
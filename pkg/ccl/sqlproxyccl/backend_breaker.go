@@ -0,0 +1,203 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// BreakerState is the state of the circuit breaker of a backend address.
+type BreakerState int
+
+const (
+	// BreakerClosed indicates that dials to the backend are allowed.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen indicates that dials to the backend fail immediately.
+	BreakerOpen
+	// BreakerHalfOpen indicates that the cooldown period has elapsed, and a
+	// single probe dial to the backend is in flight.
+	BreakerHalfOpen
+)
+
+// String implements the fmt.Stringer interface.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BackendBreaker is a set of circuit breakers keyed by backend address, which
+// avoids paying the full dial timeout for every connection attempt to a
+// backend that is persistently down.
+//
+// The breaker of an address trips (opens) after a number of consecutive
+// codeBackendDown failures within a window. While open, dials to the address
+// fail immediately with a codeBackendDown error. Once the cooldown period has
+// elapsed, a single probe dial is allowed through: if it succeeds, the breaker
+// closes, otherwise it opens again for another cooldown period. Other errors,
+// such as codeBackendRefusedTLS, indicate a configuration issue rather than an
+// outage, and count as successes since the backend was reachable. Dials which
+// fail because the caller canceled them, or because of the deadline of the
+// caller, are not counted.
+type BackendBreaker struct {
+	threshold  int
+	window     time.Duration
+	cooldown   time.Duration
+	timeSource timeutil.TimeSource
+
+	mu struct {
+		syncutil.Mutex
+		// breakers only contains the addresses whose last dial failed.
+		breakers map[string]*addressBreaker
+	}
+}
+
+// addressBreaker is the circuit breaker of a single backend address.
+type addressBreaker struct {
+	state BreakerState
+	// failures is the number of consecutive failures since firstFailure.
+	failures     int
+	firstFailure time.Time
+	// openedAt is the time at which the breaker was last opened.
+	openedAt time.Time
+}
+
+// NewBackendBreaker returns a BackendBreaker which trips the breaker of an
+// address after threshold consecutive failures within window, and keeps it
+// open for cooldown. If timeSource is nil, timeutil.DefaultTimeSource is used.
+func NewBackendBreaker(
+	threshold int, window, cooldown time.Duration, timeSource timeutil.TimeSource,
+) *BackendBreaker {
+	if timeSource == nil {
+		timeSource = timeutil.DefaultTimeSource{}
+	}
+	b := &BackendBreaker{
+		threshold:  threshold,
+		window:     window,
+		cooldown:   cooldown,
+		timeSource: timeSource,
+	}
+	b.mu.breakers = make(map[string]*addressBreaker)
+	return b
+}
+
+// DialBreaker, if set, protects every BackendDialContext call. See
+// BackendBreaker for more details.
+var DialBreaker *BackendBreaker
+
+// State returns the state of the breaker of the given backend address.
+func (b *BackendBreaker) State(serverAddress string) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ab, ok := b.mu.breakers[serverAddress]; ok {
+		return ab.state
+	}
+	return BreakerClosed
+}
+
+// OpenCount returns the number of backend addresses whose breaker is not
+// closed, e.g. for use as a gauge.
+func (b *BackendBreaker) OpenCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var count int
+	for _, ab := range b.mu.breakers {
+		if ab.state != BreakerClosed {
+			count++
+		}
+	}
+	return count
+}
+
+// allow returns a codeBackendDown error if dials to serverAddress should fail
+// immediately. If nil is returned, the caller must report the outcome of the
+// dial through record.
+func (b *BackendBreaker) allow(serverAddress string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ab, ok := b.mu.breakers[serverAddress]
+	if !ok {
+		return nil
+	}
+	switch ab.state {
+	case BreakerOpen:
+		if b.timeSource.Since(ab.openedAt) < b.cooldown {
+			break
+		}
+		// Let this dial probe the backend.
+		ab.state = BreakerHalfOpen
+		return nil
+	case BreakerHalfOpen:
+		// A probe is already in flight.
+	default:
+		return nil
+	}
+	return newErrorf(
+		codeBackendDown, "circuit breaker for backend SQL server %s is %s", serverAddress, ab.state,
+	)
+}
+
+// abandon reports that a dial to serverAddress that was allowed by allow was
+// abandoned by the caller before its outcome was known. It doesn't count as a
+// failure, nor as a success. If the dial was the probe of a half-open
+// breaker, the breaker opens again, and the next dial probes the backend.
+func (b *BackendBreaker) abandon(serverAddress string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ab, ok := b.mu.breakers[serverAddress]; ok && ab.state == BreakerHalfOpen {
+		ab.state = BreakerOpen
+	}
+}
+
+// record reports the outcome of a dial to serverAddress that was allowed by
+// allow.
+func (b *BackendBreaker) record(serverAddress string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if getErrorCode(err) != codeBackendDown {
+		delete(b.mu.breakers, serverAddress)
+		return
+	}
+	now := b.timeSource.Now()
+	ab, ok := b.mu.breakers[serverAddress]
+	if !ok {
+		ab = &addressBreaker{}
+		b.mu.breakers[serverAddress] = ab
+	}
+	switch ab.state {
+	case BreakerHalfOpen:
+		// The probe failed.
+		ab.state = BreakerOpen
+		ab.openedAt = now
+		return
+	case BreakerOpen:
+		// The dial was allowed before the breaker tripped.
+		return
+	}
+	if ab.failures == 0 || now.Sub(ab.firstFailure) > b.window {
+		ab.failures = 0
+		ab.firstFailure = now
+	}
+	ab.failures++
+	if ab.failures >= b.threshold {
+		ab.state = BreakerOpen
+		ab.openedAt = now
+		ab.failures = 0
+	}
+}
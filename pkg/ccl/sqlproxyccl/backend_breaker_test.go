@@ -0,0 +1,155 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendBreaker(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const addr = "127.0.0.1:26257"
+	down := newErrorf(codeBackendDown, "down")
+	refused := newErrorf(codeBackendRefusedTLS, "refused")
+
+	clock := timeutil.NewManualTime(timeutil.Unix(0, 0))
+	b := NewBackendBreaker(3 /* threshold */, time.Minute, 10*time.Second, clock)
+
+	fail := func() {
+		require.NoError(t, b.allow(addr))
+		b.record(addr, down)
+	}
+
+	// Failures spread beyond the window do not trip the breaker.
+	fail()
+	fail()
+	clock.Advance(2 * time.Minute)
+	fail()
+	require.Equal(t, BreakerClosed, b.State(addr))
+
+	// Refusals do not count as failures, and reset the count.
+	require.NoError(t, b.allow(addr))
+	b.record(addr, refused)
+	fail()
+	fail()
+	require.Equal(t, BreakerClosed, b.State(addr))
+
+	// The third consecutive failure trips the breaker.
+	fail()
+	require.Equal(t, BreakerOpen, b.State(addr))
+	require.Equal(t, 1, b.OpenCount())
+	err := b.allow(addr)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.Regexp(t, "circuit breaker .* is open", err)
+
+	// Other addresses are not affected.
+	require.NoError(t, b.allow("127.0.0.1:26258"))
+
+	// After the cooldown, a single probe is allowed. It fails, which opens the
+	// breaker again.
+	clock.Advance(10 * time.Second)
+	require.NoError(t, b.allow(addr))
+	require.Equal(t, BreakerHalfOpen, b.State(addr))
+	require.Error(t, b.allow(addr))
+	b.record(addr, down)
+	require.Equal(t, BreakerOpen, b.State(addr))
+	require.Error(t, b.allow(addr))
+
+	// A successful probe closes the breaker.
+	clock.Advance(10 * time.Second)
+	require.NoError(t, b.allow(addr))
+	b.record(addr, nil)
+	require.Equal(t, BreakerClosed, b.State(addr))
+	require.Equal(t, 0, b.OpenCount())
+	require.NoError(t, b.allow(addr))
+}
+
+func TestBackendDialBreaker(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr := unusedTCPAddr(t)
+
+	b := NewBackendBreaker(1 /* threshold */, time.Minute, time.Hour, nil /* timeSource */)
+	defer testutils.TestingHook(&DialBreaker, b)()
+
+	ctx := context.Background()
+	_, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.Regexp(t, "unable to reach backend SQL server", err)
+	require.Equal(t, BreakerOpen, b.State(addr))
+
+	_, err = BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.Regexp(t, "circuit breaker", err)
+}
+
+// startStallingTestBackend starts a TLS test backend which stalls the first
+// connection until the dialer closes it, and otherwise accepts the SSLRequest
+// and the startup message.
+func startStallingTestBackend(t *testing.T) (addr string, stop func()) {
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	var accepted int32
+	return startTestBackend(t, func(conn net.Conn) {
+		if atomic.AddInt32(&accepted, 1) == 1 {
+			_, _ = io.Copy(ioutil.Discard, conn)
+			return
+		}
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = receiveStartupMessage(tlsConn)
+	})
+}
+
+func TestBackendDialBreakerAbandonedDial(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr, stop := startStallingTestBackend(t)
+	defer stop()
+	b := NewBackendBreaker(1 /* threshold */, time.Minute, time.Hour, nil /* timeSource */)
+	defer testutils.TestingHook(&DialBreaker, b)()
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	// The caller gives up on the first dial, which doesn't count as a
+	// failure of the backend.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := BackendDialContext(ctx, testStartupMessage(), addr, clientCfg)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.Equal(t, BreakerClosed, b.State(addr))
+
+	conn, err := BackendDialContext(context.Background(), testStartupMessage(), addr, clientCfg)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	// An abandoned probe lets the next dial probe the backend.
+	clock := timeutil.NewManualTime(timeutil.Unix(0, 0))
+	b = NewBackendBreaker(1 /* threshold */, time.Minute, time.Second, clock)
+	b.record(addr, newErrorf(codeBackendDown, "down"))
+	clock.Advance(time.Second)
+	require.NoError(t, b.allow(addr))
+	require.Equal(t, BreakerHalfOpen, b.State(addr))
+	b.abandon(addr)
+	require.Equal(t, BreakerOpen, b.State(addr))
+	require.NoError(t, b.allow(addr))
+}
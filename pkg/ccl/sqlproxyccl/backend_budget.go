@@ -0,0 +1,134 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// DialBudget describes how the time remaining until the deadline of a dial is
+// split across its phases. See SplitDialBudget.
+type DialBudget struct {
+	// Dial is the share of the budget allocated to establishing the
+	// connection to the backend, including the PROXY protocol header.
+	Dial float64
+	// TLS is the share of the budget allocated to negotiating TLS (or GSSAPI
+	// encryption) with the backend.
+	TLS float64
+	// Relay is the share of the budget allocated to relaying the startup
+	// message, and to reading the first message of the backend if
+	// PeekFirstMessage is used.
+	Relay float64
+	// Jitter is the fraction, between 0 and 1, by which the time allocated to
+	// each phase is randomly lengthened or shortened, so that dials started
+	// together don't time out together. The jittered time is clamped to the
+	// time remaining until the deadline of the dial.
+	Jitter float64
+}
+
+// DefaultDialBudget allocates 50% of the budget of a dial to establishing the
+// connection, 30% to the TLS handshake, and 20% to relaying the startup
+// message, each with a jitter of +/-10%.
+var DefaultDialBudget = DialBudget{Dial: 0.5, TLS: 0.3, Relay: 0.2, Jitter: 0.1}
+
+// dialBudgetJitter returns a random number in [0, 1) which determines the
+// jitter applied to a phase of the dial. It is defined as a variable so that
+// tests can make the jitter deterministic.
+var dialBudgetJitter = rand.Float64
+
+// SplitDialBudget configures the dialer to bound each phase of the dial by a
+// share of the time remaining until the deadline of the dial (i.e. the
+// deadline of the context, or the default 5 second timeout), so that a slow
+// connection establishment can't leave no time for the TLS handshake. The
+// share of a phase is computed when the phase starts, out of the remaining
+// time, such that time left unused by a phase is passed on to the next ones:
+// with DefaultDialBudget, the TLS handshake is allocated 3/5 of the time
+// remaining once the connection is established, and the startup relay is
+// allocated all the time remaining after that (give or take the jitter, see
+// DialBudget.Jitter). Shares are relative to each other, so they don't need to
+// add up to 1.
+//
+// A phase which exceeds its share fails the dial with a codeBackendDown error
+// which names the phase. Resolving the backend address (see AddressResolver)
+// and waiting for DialLimiter happen before the budget is split. For
+// FinishStartupContext, which doesn't establish the connection, the budget is
+// split between the TLS and relay phases.
+func SplitDialBudget(budget DialBudget) DialOption {
+	return func(opts *dialOptions) {
+		opts.budget = &budget
+	}
+}
+
+// share returns the share of the budget allocated to phase, which is one
+// of the phases from DialPhaseConnecting to DialPhaseRelayingStartup.
+func (b *DialBudget) share(phase DialPhase) float64 {
+	switch phase {
+	case DialPhaseConnecting:
+		return b.Dial
+	case DialPhaseTLSHandshake:
+		return b.TLS
+	default:
+		return b.Relay
+	}
+}
+
+// startDialPhase enters phase (see enterDialPhase), and returns the context
+// bounding phase, and a function which must be called once the phase is over,
+// with the error which failed the phase, if any. The function returns the
+// error to report, which names the phase if it exceeded its share of the
+// budget. If no budget was configured through SplitDialBudget, or ctx has no
+// deadline, the phase is bounded by ctx.
+func startDialPhase(
+	ctx context.Context, options *dialOptions, phase DialPhase,
+) (context.Context, func(err error) error) {
+	enterDialPhase(options, phase)
+	deadline, ok := ctx.Deadline()
+	if options.budget == nil || !ok {
+		return ctx, func(err error) error { return err }
+	}
+	var total float64
+	for p := phase; p <= DialPhaseRelayingStartup; p++ {
+		total += options.budget.share(p)
+	}
+	remaining := deadline.Sub(timeSource.Now())
+	slice := remaining
+	if total > 0 {
+		slice = time.Duration(float64(slice) * options.budget.share(phase) / total)
+	}
+	if jitter := options.budget.Jitter; jitter > 0 {
+		slice = time.Duration(float64(slice) * (1 + jitter*(2*dialBudgetJitter()-1)))
+		if slice > remaining {
+			slice = remaining
+		}
+		if slice < 0 {
+			slice = 0
+		}
+	}
+	phaseDeadline := timeSource.Now().Add(slice)
+	phaseCtx, cancel := withClockTimeout(ctx, slice)
+	return phaseCtx, func(err error) error {
+		defer cancel()
+		// I/O bounded by phaseCtx may time out through a connection deadline
+		// slightly before phaseCtx is done.
+		if err == nil || timeSource.Now().Before(phaseDeadline) {
+			return err
+		}
+		var codeErr *codeError
+		if errors.As(err, &codeErr) {
+			err = codeErr.err
+		}
+		return wrapErrorf(
+			codeBackendDown, err, "%s phase exceeded its budget of %s", phase, slice,
+		)
+	}
+}
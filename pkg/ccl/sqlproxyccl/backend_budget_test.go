@@ -0,0 +1,154 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendDialSplitBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+	const budget = time.Second
+
+	// hang blocks until the client closes the connection.
+	hang := func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	}
+	// dial dials addr within budget, and returns the time it took for the
+	// dial to fail, and the error.
+	dial := func(t *testing.T, addr string, opts ...DialOption) (time.Duration, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), budget)
+		defer cancel()
+		start := timeutil.Now()
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg,
+			append(opts, SplitDialBudget(DefaultDialBudget))...,
+		)
+		require.Nil(t, conn)
+		return timeutil.Since(start), err
+	}
+
+	t.Run("dial", func(t *testing.T) {
+		// The proxy never responds to the CONNECT request.
+		proxyAddr, stop := startTestBackend(t, hang)
+		defer stop()
+		elapsed, err := dial(
+			t, "127.0.0.1:26257", HTTPConnectProxy(&url.URL{Scheme: "http", Host: proxyAddr}, nil /* header */),
+		)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Regexp(t, "dial phase exceeded its budget of", err)
+		// The slow phase must not use up the budget of the next phases.
+		require.Less(t, int64(elapsed), int64(budget*3/4))
+	})
+
+	t.Run("TLS handshake", func(t *testing.T) {
+		addr, stop := startTestBackend(t, func(conn net.Conn) {
+			if _, err := io.ReadFull(conn, make([]byte, 8)); err != nil {
+				return
+			}
+			if _, err := conn.Write([]byte{pgAcceptSSLRequest}); err != nil {
+				return
+			}
+			hang(conn)
+		})
+		defer stop()
+		elapsed, err := dial(t, addr)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Regexp(t, "TLS handshake phase exceeded its budget of", err)
+		require.Less(t, int64(elapsed), int64(budget*9/10))
+	})
+
+	t.Run("startup relay", func(t *testing.T) {
+		addr, stop := startTestBackend(t, func(conn net.Conn) {
+			tlsConn, err := acceptSSLRequest(conn, serverCfg)
+			if err != nil {
+				return
+			}
+			hang(tlsConn)
+		})
+		defer stop()
+		// The last phase is allocated the remaining budget.
+		_, err := dial(t, addr, PeekFirstMessage(func(pgproto3.BackendMessage) {}))
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Regexp(t, "startup relay phase exceeded its budget of", err)
+	})
+
+	t.Run("within budget", func(t *testing.T) {
+		msgCh := make(chan *pgproto3.StartupMessage, 1)
+		addr, stop := startTestBackend(t, func(conn net.Conn) {
+			tlsConn, err := acceptSSLRequest(conn, serverCfg)
+			if err != nil {
+				return
+			}
+			if msg, err := receiveStartupMessage(tlsConn); err == nil {
+				msgCh <- msg
+			}
+		})
+		defer stop()
+		ctx, cancel := context.WithTimeout(context.Background(), budget)
+		defer cancel()
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, SplitDialBudget(DefaultDialBudget),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, testStartupMessage(), <-msgCh)
+	})
+}
+
+func TestDialBudgetJitter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	clock := timeutil.NewManualTime(timeutil.Now())
+	defer testutils.TestingHook(&timeSource, timeutil.TimeSource(clock))()
+	const budget = 10 * time.Second
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(budget))
+	defer cancel()
+
+	// phaseBudget returns the time allocated to phase, given the random
+	// number r drawn for the jitter.
+	phaseBudget := func(
+		t *testing.T, b DialBudget, phase DialPhase, r float64,
+	) time.Duration {
+		defer testutils.TestingHook(&dialBudgetJitter, func() float64 { return r })()
+		phaseCtx, end := startDialPhase(ctx, &dialOptions{budget: &b}, phase)
+		defer func() { require.NoError(t, end(nil)) }()
+		deadline, ok := phaseCtx.Deadline()
+		require.True(t, ok)
+		return deadline.Sub(clock.Now())
+	}
+
+	b := DialBudget{Dial: 1, TLS: 1, Jitter: 0.2}
+	require.Equal(t, 4*time.Second, phaseBudget(t, b, DialPhaseConnecting, 0))
+	require.Equal(t, 5*time.Second, phaseBudget(t, b, DialPhaseConnecting, 0.5))
+	require.Equal(t, 5500*time.Millisecond, phaseBudget(t, b, DialPhaseConnecting, 0.75))
+	// The jittered time is clamped to the time remaining until the deadline.
+	require.Equal(t, budget, phaseBudget(t, b, DialPhaseTLSHandshake, 0.75))
+	require.Equal(t, 8*time.Second, phaseBudget(t, b, DialPhaseTLSHandshake, 0))
+
+	// Without jitter, the random number is ignored.
+	b.Jitter = 0
+	require.Equal(t, 5*time.Second, phaseBudget(t, b, DialPhaseConnecting, 0.75))
+}
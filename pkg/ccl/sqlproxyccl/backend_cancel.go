@@ -0,0 +1,228 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// cancelKey identifies a backend session for the purposes of query
+// cancellation. It corresponds to the BackendKeyData sent by the backend
+// during connection startup.
+type cancelKey struct {
+	processID uint32
+	secretKey uint32
+}
+
+// CancelRegistry keeps track of the backend that issued each BackendKeyData
+// message, so that a CancelRequest sent by a client on a brand-new connection
+// can be routed to the backend which owns the session.
+//
+// The BackendKeyData is sent by the backend to the client after
+// authentication, and before the first ReadyForQuery message. Whoever forwards
+// that message to the client should call Register with the address of the
+// backend, and call Unregister once the backend connection is closed, since
+// the key is only meaningful for the lifetime of that connection.
+type CancelRegistry struct {
+	mu struct {
+		syncutil.Mutex
+		keys map[cancelKey]string
+	}
+}
+
+// NewCancelRegistry returns a new, empty, CancelRegistry.
+func NewCancelRegistry() *CancelRegistry {
+	r := &CancelRegistry{}
+	r.mu.keys = make(map[cancelKey]string)
+	return r
+}
+
+// Register records that the session identified by data lives on the backend
+// at serverAddress.
+func (r *CancelRegistry) Register(serverAddress string, data *pgproto3.BackendKeyData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mu.keys[cancelKey{processID: data.ProcessID, secretKey: data.SecretKey}] = serverAddress
+}
+
+// Unregister removes the session identified by data from the registry.
+func (r *CancelRegistry) Unregister(data *pgproto3.BackendKeyData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.mu.keys, cancelKey{processID: data.ProcessID, secretKey: data.SecretKey})
+}
+
+// lookup returns the address of the backend which owns the session that req
+// refers to.
+func (r *CancelRegistry) lookup(req *pgproto3.CancelRequest) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addr, ok := r.mu.keys[cancelKey{processID: req.ProcessID, secretKey: req.SecretKey}]
+	return addr, ok
+}
+
+// BackendCancel forwards the given CancelRequest to the backend that owns the
+// session identified by the request's process ID and secret key. Just like a
+// PostgreSQL client would, it opens a new connection to the backend (upgraded
+// to TLS if tlsConfig is specified), sends the CancelRequest, and closes the
+// connection without waiting for a response.
+//
+// The deadline for reaching the backend is derived from ctx, and defaults to 5
+// seconds, just like BackendDialContext.
+func BackendCancel(
+	ctx context.Context, registry *CancelRegistry, req *pgproto3.CancelRequest, tlsConfig *tls.Config,
+) error {
+	serverAddress, ok := registry.lookup(req)
+	if !ok {
+		return newErrorf(
+			codeParamsRoutingFailed, "no backend found for cancel request",
+		)
+	}
+
+	ctx, cancel := withDefaultDialTimeout(ctx)
+	defer cancel()
+	// The connection is subject to DialAddressFilter, like the connections
+	// established by BackendDialContext.
+	conn, err := dialTCPConn(ctx, "tcp", serverAddress, &dialOptions{})
+	if getErrorCode(err) == codeBackendAddressForbidden {
+		return err
+	}
+	if err != nil {
+		return newConnectError(err)
+	}
+	defer conn.Close()
+
+	sslConn, err := sslOverlay(ctx, conn, serverAddress, tlsConfig, &dialOptions{})
+	if err != nil {
+		return err
+	}
+	stop := watchConnContext(ctx, sslConn)
+	defer stop()
+	if err := relayCancelRequest(sslConn, req); err != nil {
+		return newErrorf(
+			codeBackendDown, "relaying CancelRequest to target server %v: %v",
+			serverAddress, err)
+	}
+	return nil
+}
+
+// relayCancelRequest forwards the cancel request on the backend connection.
+func relayCancelRequest(conn net.Conn, req *pgproto3.CancelRequest) (err error) {
+	_, err = conn.Write(req.Encode(nil))
+	return
+}
+
+// ObserveBackendKeyData configures the dialer to invoke fn with the process ID
+// and secret key of the BackendKeyData message sent by the backend during
+// connection startup, along with the address of the backend, e.g. to Register
+// the session with a CancelRegistry. Since the backend only sends the message
+// once the client authenticated, the messages read from the returned
+// connection are inspected, rather than read ahead by the dialer, so that
+// authentication exchanges which require a response from the client aren't
+// blocked; no bytes are consumed. fn is invoked by the Read call which reads
+// the end of the BackendKeyData message, at most once.
+//
+// Inspection stops at the first BackendKeyData, ReadyForQuery or ErrorResponse
+// message. If the backend doesn't send a BackendKeyData message (e.g. because
+// authentication failed), fn is never invoked.
+func ObserveBackendKeyData(fn func(pid, secret uint32, backendAddr string)) DialOption {
+	return func(opts *dialOptions) {
+		opts.observeKeyData = fn
+	}
+}
+
+// keyDataConn is the net.Conn wrapper which implements ObserveBackendKeyData.
+// It parses the framing of the messages read from the backend, like
+// drainConn, until the BackendKeyData message was read.
+type keyDataConn struct {
+	net.Conn
+	serverAddress string
+	fn            func(pid, secret uint32, backendAddr string)
+
+	// The fields below are only accessed by Read, which must not be called
+	// concurrently.
+	//
+	// done is true once inspection stopped.
+	done bool
+	// header accumulates the type and length of the current message.
+	header  [5]byte
+	headerN int
+	// remaining is the number of body bytes of the current message which
+	// have not been read yet.
+	remaining int
+	// body accumulates the body of the current message, if it is a
+	// BackendKeyData message.
+	body  [8]byte
+	bodyN int
+}
+
+var _ net.Conn = &keyDataConn{}
+
+// Read implements the net.Conn interface.
+func (c *keyDataConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.done {
+		c.scan(b[:n])
+	}
+	return n, err
+}
+
+// scan advances the framing state over b, and invokes fn once the
+// BackendKeyData message was read.
+func (c *keyDataConn) scan(b []byte) {
+	for i := 0; i < len(b) && !c.done; {
+		if c.headerN < len(c.header) {
+			k := copy(c.header[c.headerN:], b[i:])
+			c.headerN += k
+			i += k
+			if c.headerN < len(c.header) {
+				break
+			}
+			// The length includes itself, but not the type.
+			c.remaining = int(binary.BigEndian.Uint32(c.header[1:])) - 4
+			c.bodyN = 0
+			if c.remaining < 0 {
+				// The stream is corrupt.
+				c.done = true
+				return
+			}
+		}
+		k := len(b) - i
+		if k > c.remaining {
+			k = c.remaining
+		}
+		if c.header[0] == 'K' {
+			c.bodyN += copy(c.body[c.bodyN:], b[i:i+k])
+		}
+		c.remaining -= k
+		i += k
+		if c.remaining > 0 {
+			break
+		}
+		switch c.header[0] {
+		case 'K':
+			c.done = true
+			if int(binary.BigEndian.Uint32(c.header[1:]))-4 == len(c.body) {
+				c.fn(
+					binary.BigEndian.Uint32(c.body[:4]), binary.BigEndian.Uint32(c.body[4:]),
+					c.serverAddress,
+				)
+			}
+		case 'Z', 'E':
+			c.done = true
+		}
+		c.headerN = 0
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendCancel(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	reqCh := make(chan *pgproto3.CancelRequest, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+		msg, err := be.ReceiveStartupMessage()
+		if err != nil {
+			return
+		}
+		if req, ok := msg.(*pgproto3.CancelRequest); ok {
+			reqCh <- req
+		}
+	})
+	defer stop()
+
+	registry := NewCancelRegistry()
+	keyData := &pgproto3.BackendKeyData{ProcessID: 42, SecretKey: 1234}
+	req := &pgproto3.CancelRequest{ProcessID: 42, SecretKey: 1234}
+
+	// Unknown key.
+	err := BackendCancel(ctx, registry, req, nil /* tlsConfig */)
+	require.Regexp(t, "no backend found for cancel request", err)
+
+	// Known key is forwarded to the backend.
+	registry.Register(addr, keyData)
+	require.NoError(t, BackendCancel(ctx, registry, req, nil /* tlsConfig */))
+	require.Equal(t, req, <-reqCh)
+
+	// The secret key must match as well.
+	err = BackendCancel(ctx, registry, &pgproto3.CancelRequest{ProcessID: 42}, nil /* tlsConfig */)
+	require.Regexp(t, "no backend found for cancel request", err)
+
+	// Unregistered keys are no longer routed.
+	registry.Unregister(keyData)
+	err = BackendCancel(ctx, registry, req, nil /* tlsConfig */)
+	require.Regexp(t, "no backend found for cancel request", err)
+}
+
+func TestObserveBackendKeyData(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// encode concatenates the encoding of msgs.
+	encode := func(msgs ...pgproto3.BackendMessage) []byte {
+		var buf []byte
+		for _, msg := range msgs {
+			buf = msg.Encode(buf)
+		}
+		return buf
+	}
+	responseCh := make(chan []byte, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		if _, err := receiveStartupMessage(conn); err != nil {
+			return
+		}
+		_, _ = conn.Write(<-responseCh)
+	})
+	defer stop()
+
+	type keyData struct {
+		pid, secret uint32
+		addr        string
+	}
+	for _, tc := range []struct {
+		name     string
+		response []byte
+		peek     bool
+		expected []keyData
+	}{
+		{
+			name: "startup",
+			response: encode(
+				&pgproto3.AuthenticationOk{},
+				&pgproto3.ParameterStatus{Name: "server_version", Value: "13.0.0"},
+				&pgproto3.BackendKeyData{ProcessID: 42, SecretKey: 1234},
+				&pgproto3.BackendKeyData{ProcessID: 43, SecretKey: 5678},
+				&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			),
+			expected: []keyData{{pid: 42, secret: 1234, addr: addr}},
+		},
+		{
+			name: "first message peeked",
+			response: encode(
+				&pgproto3.BackendKeyData{ProcessID: 42, SecretKey: 1234},
+				&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			),
+			peek:     true,
+			expected: []keyData{{pid: 42, secret: 1234, addr: addr}},
+		},
+		{
+			name: "authentication failed",
+			response: encode(
+				&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28P01", Message: "bad password"},
+				&pgproto3.BackendKeyData{ProcessID: 42, SecretKey: 1234},
+			),
+		},
+		{
+			name: "no key data",
+			response: encode(
+				&pgproto3.AuthenticationOk{},
+				&pgproto3.ReadyForQuery{TxStatus: 'I'},
+				&pgproto3.BackendKeyData{ProcessID: 42, SecretKey: 1234},
+			),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var observed []keyData
+			observe := func(pid, secret uint32, backendAddr string) {
+				observed = append(observed, keyData{pid: pid, secret: secret, addr: backendAddr})
+			}
+			opts := []DialOption{ObserveBackendKeyData(observe)}
+			if tc.peek {
+				opts = append(opts, PeekFirstMessage(func(pgproto3.BackendMessage) {}))
+			}
+			responseCh <- tc.response
+			conn, err := BackendDialContext(
+				ctx, testStartupMessage(), addr, nil /* tlsConfig */, opts...,
+			)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			// The stream is split across reads, and left untouched.
+			var got []byte
+			buf := make([]byte, 3)
+			for len(got) < len(tc.response) {
+				n, err := conn.Read(buf)
+				require.NoError(t, err)
+				got = append(got, buf[:n]...)
+			}
+			require.Equal(t, tc.response, got)
+			require.Equal(t, tc.expected, observed)
+		})
+	}
+}
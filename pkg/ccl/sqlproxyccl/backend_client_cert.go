@@ -0,0 +1,78 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"crypto/tls"
+	"strings"
+)
+
+// ClientCertificate configures the dialer to present cert to backends which
+// request a client certificate during the TLS handshake, i.e. for mutual TLS.
+// It takes precedence over the Certificates and GetClientCertificate fields
+// of the tls.Config, which is not modified. Use GetClientCertificate instead
+// if the certificate is rotated.
+//
+// If the backend rejects the certificate, the dial fails with a
+// codeBackendRefusedTLS error. Note that with TLS 1.3, the backend verifies
+// the client certificate after the client considers the handshake complete,
+// so the rejection is only observed once data is read from the backend: the
+// dial fails as described above if PeekFirstMessage is used, and the first
+// read of the returned connection fails otherwise.
+func ClientCertificate(cert tls.Certificate) DialOption {
+	return GetClientCertificate(func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &cert, nil
+	})
+}
+
+// GetClientCertificate is like ClientCertificate, but fn is invoked during
+// every TLS handshake in which the backend requests a client certificate, so
+// that rotated certificates are picked up by subsequent dials. fn has the
+// semantics of tls.Config.GetClientCertificate; an error returned by fn fails
+// the dial with a codeBackendTLSHandshakeFailed error.
+func GetClientCertificate(
+	fn func(info *tls.CertificateRequestInfo) (*tls.Certificate, error),
+) DialOption {
+	return func(opts *dialOptions) {
+		opts.getClientCert = fn
+	}
+}
+
+// clientCertRejectionAlerts are the descriptions of the TLS alerts that a
+// backend sends when it rejects the client certificate (or the lack thereof).
+var clientCertRejectionAlerts = []string{
+	"bad certificate",
+	"unsupported certificate",
+	"revoked certificate",
+	"expired certificate",
+	"unknown certificate", // Also matches "unknown certificate authority".
+	"certificate required",
+}
+
+// isClientCertRejection returns whether err was caused by a TLS alert sent by
+// the backend to reject the client certificate. The alert type isn't exported
+// by crypto/tls, so the error message is inspected instead.
+func isClientCertRejection(err error) bool {
+	if err == nil {
+		return false
+	}
+	const remoteAlertPrefix = "remote error: tls: "
+	msg := err.Error()
+	idx := strings.Index(msg, remoteAlertPrefix)
+	if idx < 0 {
+		return false
+	}
+	desc := msg[idx+len(remoteAlertPrefix):]
+	for _, alert := range clientCertRejectionAlerts {
+		if strings.HasPrefix(desc, alert) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendDialClientCertificate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	clientCert, err := tls.LoadX509KeyPair(
+		filepath.Join("testdata", "testserver.crt"), filepath.Join("testdata", "testserver.key"),
+	)
+	require.NoError(t, err)
+
+	// startBackend starts a backend which requires a client certificate
+	// signed by one of clientCAs, and which reports the certificates which
+	// it verified.
+	startBackend := func(
+		t *testing.T, clientCAs *x509.CertPool, maxVersion uint16,
+	) (addr string, certs <-chan []*x509.Certificate, stop func()) {
+		serverCfg, err := tlsConfig()
+		require.NoError(t, err)
+		serverCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		serverCfg.ClientCAs = clientCAs
+		serverCfg.MaxVersion = maxVersion
+		certCh := make(chan []*x509.Certificate, 1)
+		addr, stop = startTestBackend(t, func(conn net.Conn) {
+			tlsConn, err := acceptSSLRequest(conn, serverCfg)
+			if err != nil {
+				return
+			}
+			if _, err := receiveStartupMessage(tlsConn); err != nil {
+				return
+			}
+			certCh <- tlsConn.ConnectionState().PeerCertificates
+			be := pgproto3.NewBackend(pgproto3.NewChunkReader(tlsConn), tlsConn)
+			_ = be.Send(&pgproto3.AuthenticationOk{})
+		})
+		return addr, certCh, stop
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	t.Run("certificate", func(t *testing.T) {
+		addr, certs, stop := startBackend(t, testRootCAs(t), tls.VersionTLS13)
+		defer stop()
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, ClientCertificate(clientCert),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		peerCerts := <-certs
+		require.Len(t, peerCerts, 1)
+		require.Equal(t, clientCert.Certificate[0], peerCerts[0].Raw)
+		// The caller's config must not be mutated.
+		require.Nil(t, clientCfg.GetClientCertificate)
+	})
+
+	t.Run("callback", func(t *testing.T) {
+		addr, certs, stop := startBackend(t, testRootCAs(t), tls.VersionTLS13)
+		defer stop()
+		calls := 0
+		getCert := GetClientCertificate(
+			func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				calls++
+				return &clientCert, nil
+			})
+		for i := 1; i <= 2; i++ {
+			conn, err := BackendDialContext(ctx, testStartupMessage(), addr, clientCfg, getCert)
+			require.NoError(t, err)
+			require.Len(t, <-certs, 1)
+			require.NoError(t, conn.Close())
+			require.Equal(t, i, calls)
+		}
+	})
+
+	t.Run("callback error", func(t *testing.T) {
+		addr, _, stop := startBackend(t, testRootCAs(t), tls.VersionTLS13)
+		defer stop()
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, GetClientCertificate(
+				func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return nil, errors.New("certificate unavailable")
+				}),
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendTLSHandshakeFailed, getErrorCode(err))
+		require.Regexp(t, "certificate unavailable", err)
+	})
+
+	// The backend doesn't trust any client certificate.
+	for _, tc := range []struct {
+		name       string
+		maxVersion uint16
+	}{
+		{name: "rejected TLS 1.2", maxVersion: tls.VersionTLS12},
+		{name: "rejected TLS 1.3", maxVersion: tls.VersionTLS13},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, _, stop := startBackend(t, x509.NewCertPool(), tc.maxVersion)
+			defer stop()
+			conn, err := BackendDialContext(
+				ctx, testStartupMessage(), addr, clientCfg, ClientCertificate(clientCert),
+				// With TLS 1.3, the rejection is only observed when reading.
+				PeekFirstMessage(func(pgproto3.BackendMessage) {}),
+			)
+			require.Nil(t, conn)
+			require.Equal(t, codeBackendRefusedTLS, getErrorCode(err))
+			require.Regexp(t, "target server rejected client certificate", err)
+		})
+	}
+
+	t.Run("missing certificate", func(t *testing.T) {
+		// With TLS 1.2, a missing certificate results in a generic handshake
+		// failure alert, whereas TLS 1.3 has a dedicated alert.
+		addr, _, stop := startBackend(t, testRootCAs(t), tls.VersionTLS13)
+		defer stop()
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, PeekFirstMessage(func(pgproto3.BackendMessage) {}),
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendRefusedTLS, getErrorCode(err))
+	})
+}
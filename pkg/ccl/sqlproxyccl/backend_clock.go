@@ -0,0 +1,105 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// timeSource is the clock which drives the timeouts of the dialer: the default
+// dial timeout, and the phases of SplitDialBudget. It is defined as a variable
+// so that tests can use a timeutil.ManualTime to assert timeout behavior
+// without sleeping. Since the deadlines of the dial contexts are also enforced
+// by net.Dialer on the wall clock, testing clocks should start at the current
+// time.
+var timeSource timeutil.TimeSource = timeutil.DefaultTimeSource{}
+
+// RemainingBudget returns the time left until the deadline of ctx, as
+// measured by the clock of the dialer, or 0 if the deadline has passed. Once a
+// dial with ctx returns, this is the budget left for the operations which
+// follow it, such as authentication and the first query, without callers
+// having to measure the time consumed by the dial. If ctx has no deadline,
+// the budget is unbounded, and the maximum duration is returned; the default
+// timeout applied by the dialer in that case doesn't consume any budget.
+func RemainingBudget(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return math.MaxInt64
+	}
+	if remaining := deadline.Sub(timeSource.Now()); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// usingRealClock returns whether timeSource is the wall clock. Otherwise, the
+// deadlines of the contexts returned by withClockTimeout are expressed in the
+// time of timeSource, and can't be used as connection deadlines.
+func usingRealClock() bool {
+	_, ok := timeSource.(timeutil.DefaultTimeSource)
+	return ok
+}
+
+// withClockTimeout is like context.WithTimeout, but the timeout is measured by
+// timeSource.
+func withClockTimeout(
+	ctx context.Context, timeout time.Duration,
+) (context.Context, context.CancelFunc) {
+	if usingRealClock() {
+		return context.WithTimeout(ctx, timeout)
+	}
+	cancelCtx, cancel := context.WithCancel(ctx)
+	c := &clockTimeoutContext{
+		Context:  cancelCtx,
+		deadline: timeSource.Now().Add(timeout),
+	}
+	timer := timeSource.NewTimer()
+	timer.Reset(timeout)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.Ch():
+			timer.MarkRead()
+			atomic.StoreInt32(&c.timedOut, 1)
+			cancel()
+		case <-cancelCtx.Done():
+		}
+	}()
+	return c, cancel
+}
+
+// clockTimeoutContext is the context returned by withClockTimeout when
+// timeSource is not the wall clock.
+type clockTimeoutContext struct {
+	context.Context
+	deadline time.Time
+	// timedOut is set to 1 before the context is canceled if the timeout
+	// expired. Accessed atomically.
+	timedOut int32
+}
+
+var _ context.Context = &clockTimeoutContext{}
+
+// Deadline implements the context.Context interface.
+func (c *clockTimeoutContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+// Err implements the context.Context interface.
+func (c *clockTimeoutContext) Err() error {
+	if atomic.LoadInt32(&c.timedOut) == 1 {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
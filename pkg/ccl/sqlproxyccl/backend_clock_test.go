@@ -0,0 +1,107 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendDialManualClock(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The clock starts at the current time, since the deadline of the dial
+	// is also enforced by net.Dialer for the TCP connection.
+	clock := timeutil.NewManualTime(timeutil.Now())
+	defer testutils.TestingHook(&timeSource, timeutil.TimeSource(clock))()
+
+	// The backend never responds to the SSLRequest.
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	defer stop()
+
+	// awaitTimers waits for n timers to be registered with the clock.
+	awaitTimers := func(t *testing.T, n int) {
+		testutils.SucceedsSoon(t, func() error {
+			if timers := clock.Timers(); len(timers) != n {
+				return errors.Newf("expected %d timers, found %d", n, len(timers))
+			}
+			return nil
+		})
+	}
+	dial := func(opts ...DialOption) <-chan error {
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := BackendDialContext(
+				context.Background(), testStartupMessage(), addr, &tls.Config{}, opts...,
+			)
+			errCh <- err
+		}()
+		return errCh
+	}
+
+	t.Run("default timeout", func(t *testing.T) {
+		errCh := dial()
+		awaitTimers(t, 1)
+		clock.Advance(defaultBackendDialTimeout - 1)
+		select {
+		case err := <-errCh:
+			t.Fatalf("dial completed before the timeout: %v", err)
+		default:
+		}
+		clock.Advance(1)
+		err := <-errCh
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Regexp(t, "reading response to SSLRequest", err)
+		awaitTimers(t, 0)
+	})
+
+	t.Run("split budget", func(t *testing.T) {
+		// A random number of 0.5 cancels out the jitter of the phases.
+		defer testutils.TestingHook(&dialBudgetJitter, func() float64 { return 0.5 })()
+		errCh := dial(SplitDialBudget(DefaultDialBudget))
+		// The default timeout, and the TLS phase, which is allocated 3/5 of
+		// the timeout since the dial phase completed instantly.
+		awaitTimers(t, 2)
+		clock.Advance(defaultBackendDialTimeout * 3 / 5)
+		err := <-errCh
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Regexp(t, "TLS handshake phase exceeded its budget of 3s", err)
+		awaitTimers(t, 0)
+	})
+}
+
+func TestRemainingBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	clock := timeutil.NewManualTime(timeutil.Now())
+	defer testutils.TestingHook(&timeSource, timeutil.TimeSource(clock))()
+
+	require.Equal(t, time.Duration(math.MaxInt64), RemainingBudget(context.Background()))
+
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(time.Second))
+	defer cancel()
+	require.Equal(t, time.Second, RemainingBudget(ctx))
+	clock.Advance(300 * time.Millisecond)
+	require.Equal(t, 700*time.Millisecond, RemainingBudget(ctx))
+	clock.Advance(time.Second)
+	require.Equal(t, time.Duration(0), RemainingBudget(ctx))
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// DialConcurrencyLimiter bounds the number of BackendDialContext calls which
+// are in flight at any given time. Unlike DialLimiter, which smooths out the
+// rate at which backends are dialed, it is a guardrail for the proxy process
+// itself: during a reconnection spike, every in-flight dial holds a goroutine
+// and a file descriptor for up to the dial timeout.
+type DialConcurrencyLimiter struct {
+	// inFlight is the number of dials holding a slot. Accessed atomically.
+	inFlight int64
+	// waiting is the number of dials waiting for a slot. Accessed atomically.
+	waiting int64
+
+	limit int
+	slots chan struct{}
+}
+
+// NewDialConcurrencyLimiter returns a DialConcurrencyLimiter which allows up to
+// limit dials to be in flight at any given time. limit must be positive.
+func NewDialConcurrencyLimiter(limit int) *DialConcurrencyLimiter {
+	return &DialConcurrencyLimiter{limit: limit, slots: make(chan struct{}, limit)}
+}
+
+// DialConcurrency, if set, bounds the number of BackendDialContext calls (and
+// therefore BackendDial calls) which are in flight. Dials beyond the limit wait
+// for an in-flight dial to complete; if the dial deadline is exceeded (or ctx
+// is canceled) first, dialing fails with a codeProxyRefusedConnection error
+// without contacting the backend. The wait counts towards the dial timeout.
+// Dials issued by a BackendPool to refill it, and FinishStartupContext calls,
+// are not limited.
+var DialConcurrency *DialConcurrencyLimiter
+
+// InFlight returns the number of dials which are in flight, i.e. which hold a
+// slot of the limiter, e.g. to be exported as a metric.
+func (l *DialConcurrencyLimiter) InFlight() int {
+	return int(atomic.LoadInt64(&l.inFlight))
+}
+
+// Waiting returns the number of dials which are waiting for a slot of the
+// limiter.
+func (l *DialConcurrencyLimiter) Waiting() int {
+	return int(atomic.LoadInt64(&l.waiting))
+}
+
+// acquire waits for a slot to be available. If ctx is done first, a
+// codeProxyRefusedConnection error is returned. Otherwise, release must be
+// called once the dial completes.
+func (l *DialConcurrencyLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&l.waiting, 1)
+		defer atomic.AddInt64(&l.waiting, -1)
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return wrapErrorf(
+				codeProxyRefusedConnection, ctx.Err(),
+				"too many concurrent dials to backend SQL servers (limit %d)", l.limit,
+			)
+		}
+	}
+	atomic.AddInt64(&l.inFlight, 1)
+	return nil
+}
+
+// release releases a slot acquired by acquire.
+func (l *DialConcurrencyLimiter) release() {
+	atomic.AddInt64(&l.inFlight, -1)
+	<-l.slots
+}
+
+// BackendConnLimiter caps the number of connections which the proxy keeps
+// open to each backend, so that backends with a hard max_connections setting
+// are not overwhelmed, which would result in rejections during the
+// authentication phase. Unlike DialConcurrencyLimiter, a slot is held for the
+// lifetime of the connection, rather than for the duration of the dial.
+type BackendConnLimiter struct {
+	// limit returns the maximum number of connections to the given backend
+	// address, or 0 if connections to the backend are not limited.
+	limit func(serverAddress string) int
+
+	mu struct {
+		syncutil.Mutex
+		// backends contains the slots of the backends which have
+		// connections in flight, or dials waiting for a slot.
+		backends map[string]*backendSlots
+	}
+}
+
+// backendSlots are the slots of a backend in a BackendConnLimiter.
+type backendSlots struct {
+	slots chan struct{}
+	// refs is the number of connections holding a slot, and of dials waiting
+	// for one. Protected by the mutex of the limiter.
+	refs int
+}
+
+// NewBackendConnLimiter returns a BackendConnLimiter which allows up to
+// limit(serverAddress) connections to each backend, where serverAddress is the
+// backend address once resolved (see AddressResolver). A limit which is not
+// positive means that connections to the backend are not limited. The limit of
+// a backend is looked up when a connection to it is dialed while it has no
+// connections in flight, so that a change of limit only applies to a backend
+// once all its connections were closed.
+func NewBackendConnLimiter(limit func(serverAddress string) int) *BackendConnLimiter {
+	l := &BackendConnLimiter{limit: limit}
+	l.mu.backends = make(map[string]*backendSlots)
+	return l
+}
+
+// BackendConnLimits, if set, caps the number of connections established by
+// BackendDialContext (and therefore BackendDial) to each backend. A slot is
+// acquired before connecting to the backend, and released once the returned
+// connection is closed, or once the dial failed. Dials beyond the limit of a
+// backend wait for one of its connections to be closed; if the dial deadline
+// is exceeded (or ctx is canceled) first, dialing fails with a
+// codeProxyRefusedConnection error without contacting the backend. The wait
+// counts towards the dial timeout. Connections dialed by a BackendPool, and
+// connections passed to FinishStartupContext, are not counted.
+var BackendConnLimits *BackendConnLimiter
+
+// InFlight returns the number of connections to serverAddress which hold a
+// slot of the limiter, e.g. to be exported as a metric.
+func (l *BackendConnLimiter) InFlight(serverAddress string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.mu.backends[serverAddress]; ok {
+		return len(s.slots)
+	}
+	return 0
+}
+
+// acquire waits for a slot of serverAddress to be available. If ctx is done
+// first, a codeProxyRefusedConnection error is returned. Otherwise, the
+// returned function must be called to release the slot once the connection
+// is closed.
+func (l *BackendConnLimiter) acquire(ctx context.Context, serverAddress string) (func(), error) {
+	l.mu.Lock()
+	s, ok := l.mu.backends[serverAddress]
+	if !ok {
+		limit := l.limit(serverAddress)
+		if limit <= 0 {
+			l.mu.Unlock()
+			return func() {}, nil
+		}
+		s = &backendSlots{slots: make(chan struct{}, limit)}
+		l.mu.backends[serverAddress] = s
+	}
+	s.refs++
+	l.mu.Unlock()
+
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		l.unref(serverAddress, s)
+		return nil, wrapErrorf(
+			codeProxyRefusedConnection, ctx.Err(),
+			"too many connections to backend SQL server %v (limit %d)", serverAddress, cap(s.slots),
+		)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-s.slots
+			l.unref(serverAddress, s)
+		})
+	}, nil
+}
+
+// unref drops a reference to s, the slots of serverAddress, which are
+// forgotten once they are unreferenced.
+func (l *BackendConnLimiter) unref(serverAddress string, s *backendSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s.refs--
+	if s.refs == 0 {
+		delete(l.mu.backends, serverAddress)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendDialConcurrency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The backend doesn't respond to the startup message until unblocked, so
+	// that dials which peek at the response remain in flight.
+	unblock := make(chan struct{})
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		if _, err := receiveStartupMessage(conn); err != nil {
+			return
+		}
+		<-unblock
+		be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+		_ = be.Send(&pgproto3.AuthenticationOk{})
+	})
+	defer stop()
+
+	limiter := NewDialConcurrencyLimiter(1)
+	defer testutils.TestingHook(&DialConcurrency, limiter)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	peek := PeekFirstMessage(func(pgproto3.BackendMessage) {})
+	errCh := make(chan error, 2)
+	dial := func(ctx context.Context) {
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil /* tlsConfig */, peek,
+		)
+		if err == nil {
+			err = conn.Close()
+		}
+		errCh <- err
+	}
+	waitFor := func(inFlight, waiting int) {
+		testutils.SucceedsSoon(t, func() error {
+			if limiter.InFlight() != inFlight || limiter.Waiting() != waiting {
+				return errors.Newf("expected %d in flight and %d waiting, found %d and %d",
+					inFlight, waiting, limiter.InFlight(), limiter.Waiting())
+			}
+			return nil
+		})
+	}
+
+	// The first dial holds the only slot, and the second one waits for it.
+	go dial(ctx)
+	waitFor(1, 0)
+	go dial(ctx)
+	waitFor(1, 1)
+
+	// A dial whose deadline is exceeded while waiting is refused.
+	shortCtx, shortCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer shortCancel()
+	conn, err := BackendDialContext(shortCtx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.Nil(t, conn)
+	require.Equal(t, codeProxyRefusedConnection, getErrorCode(err))
+	require.Regexp(t, `too many concurrent dials to backend SQL servers \(limit 1\)`, err)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// Once the backend responds, the waiting dial proceeds.
+	close(unblock)
+	require.NoError(t, <-errCh)
+	require.NoError(t, <-errCh)
+	waitFor(0, 0)
+}
+
+func TestBackendConnLimits(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stop()
+	otherAddr, stopOther := startTestBackend(t, func(conn net.Conn) {
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stopOther()
+
+	limiter := NewBackendConnLimiter(func(serverAddress string) int {
+		if serverAddress == addr {
+			return 1
+		}
+		return 0
+	})
+	defer testutils.TestingHook(&BackendConnLimits, limiter)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The only slot of the backend is held until the connection is closed.
+	conn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.NoError(t, err)
+	require.Equal(t, 1, limiter.InFlight(addr))
+
+	// A dial whose deadline is exceeded while waiting is refused.
+	shortCtx, shortCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer shortCancel()
+	_, err = BackendDialContext(shortCtx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.Equal(t, codeProxyRefusedConnection, getErrorCode(err))
+	require.Regexp(t, `too many connections to backend SQL server .* \(limit 1\)`, err)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// Backends without a limit are not affected.
+	other, err := BackendDialContext(ctx, testStartupMessage(), otherAddr, nil /* tlsConfig */)
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+	require.Equal(t, 0, limiter.InFlight(otherAddr))
+
+	// A waiting dial proceeds once the connection is closed.
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+		if err == nil {
+			err = conn.Close()
+		}
+		errCh <- err
+	}()
+	testutils.SucceedsSoon(t, func() error {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		if refs := limiter.mu.backends[addr].refs; refs != 2 {
+			return errors.Newf("expected 2 references, found %d", refs)
+		}
+		return nil
+	})
+	require.NoError(t, conn.Close())
+	require.NoError(t, conn.Close())
+	require.NoError(t, <-errCh)
+	require.Equal(t, 0, limiter.InFlight(addr))
+
+	// Failed dials release their slot: the backend doesn't answer SSLRequests.
+	_, err = BackendDialContext(ctx, testStartupMessage(), addr, &tls.Config{})
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.Equal(t, 0, limiter.InFlight(addr))
+	limiter.mu.Lock()
+	require.Empty(t, limiter.mu.backends)
+	limiter.mu.Unlock()
+}
@@ -0,0 +1,398 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// backendConn is the net.Conn returned by BackendDial. It wraps the connection
+// to the backend (which may have been upgraded to TLS), and keeps track of
+// metadata about the connection.
+//
+// Close is idempotent and safe for concurrent use: only the first call closes
+// the underlying connection, and all calls return its error, rather than a
+// "use of closed network connection" error.
+type backendConn struct {
+	net.Conn
+
+	// wire wraps the raw connection to the backend, below the TLS layer.
+	wire *countingConn
+	// tlsConn is the TLS connection that was layered over wire, or nil if the
+	// connection was not upgraded to TLS.
+	tlsConn *tls.Conn
+	// tcpConn is the raw TCP connection to the backend, or nil if the backend
+	// was not reached over TCP (e.g. over a Unix domain socket).
+	tcpConn *net.TCPConn
+	// connID is the correlation ID supplied through ConnectionID, if any.
+	connID string
+	// onClose, if set, is called once the connection is closed, e.g. to
+	// release its slot of BackendConnLimits.
+	onClose func()
+
+	closeOnce sync.Once
+	// closeErr is the error returned by the first Close call.
+	closeErr error
+}
+
+var _ net.Conn = &backendConn{}
+
+// Close implements the net.Conn interface.
+func (c *backendConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return c.closeErr
+}
+
+// BackendConn is the connection returned by DialBackend. It carries the
+// metadata of the connection which is known once the dial completes, so that
+// new metadata can be exposed without changing the signature of the dialer.
+// The accessors of the connections returned by BackendDial (e.g.
+// BackendConnBytes) also accept a *BackendConn.
+type BackendConn struct {
+	net.Conn
+
+	// TLSState is the TLS connection state negotiated with the backend, or nil
+	// if the connection was not upgraded to TLS. See BackendTLSState.
+	TLSState *tls.ConnectionState
+	// DialedAddr is the remote address of the underlying connection. See
+	// BackendRemoteAddr.
+	DialedAddr net.Addr
+	// ConnectionID is the correlation ID supplied through ConnectionID, if
+	// any.
+	ConnectionID string
+	// DialDuration is the time spent dialing, negotiating TLS, and relaying
+	// the startup message, as measured by the clock of the dialer. See also
+	// RemainingBudget.
+	DialDuration time.Duration
+}
+
+// DialBackend is like BackendDialContext, but returns a *BackendConn which
+// carries the metadata of the connection.
+func DialBackend(
+	ctx context.Context,
+	msg *pgproto3.StartupMessage,
+	serverAddress string,
+	tlsConfig *tls.Config,
+	opts ...DialOption,
+) (*BackendConn, error) {
+	start := timeSource.Now()
+	conn, err := BackendDialContext(ctx, msg, serverAddress, tlsConfig, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c := &BackendConn{Conn: conn, DialDuration: timeSource.Since(start)}
+	c.TLSState, _ = BackendTLSState(conn)
+	c.DialedAddr, _ = BackendRemoteAddr(conn)
+	c.ConnectionID, _ = BackendConnectionID(conn)
+	return c, nil
+}
+
+// BytesIn returns the cumulative number of bytes read from the wire. See
+// BackendConnBytes.
+func (c *BackendConn) BytesIn() int64 {
+	bytesIn, _, _ := BackendConnBytes(c.Conn)
+	return bytesIn
+}
+
+// BytesOut returns the cumulative number of bytes written to the wire. See
+// BackendConnBytes.
+func (c *BackendConn) BytesOut() int64 {
+	_, bytesOut, _ := BackendConnBytes(c.Conn)
+	return bytesOut
+}
+
+// asBackendConn returns the backendConn that conn refers to, if conn was
+// returned by BackendDial or DialBackend, possibly wrapped by the connector or
+// a DrainController.
+func asBackendConn(conn net.Conn) (*backendConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *backendConn:
+			return c, true
+		case *onConnectionClose:
+			conn = c.Conn
+		case *drainConn:
+			conn = c.Conn
+		case *BackendConn:
+			conn = c.Conn
+		default:
+			return nil, false
+		}
+	}
+}
+
+// BackendConnBytes returns the cumulative number of bytes read from, and
+// written to, the wire of a connection returned by BackendDial. For TLS
+// connections, the encrypted bytes are counted, including the bytes exchanged
+// during connection establishment. ok is false if conn was not returned by
+// BackendDial.
+func BackendConnBytes(conn net.Conn) (bytesIn, bytesOut int64, ok bool) {
+	c, ok := asBackendConn(conn)
+	if !ok {
+		return 0, 0, false
+	}
+	return c.wire.BytesIn(), c.wire.BytesOut(), true
+}
+
+// BackendTCPConn returns the raw TCP connection underlying a connection
+// returned by BackendDial, below the TLS layer, e.g. so that SO_LINGER can be
+// set through SetLinger before force-closing a misbehaving connection. The
+// returned connection must only be used to configure socket options, or to
+// close the connection without sending a TLS close_notify alert: reading from
+// or writing to it directly would corrupt the layered streams. ok is false
+// if conn was not returned by BackendDial, or the backend was not reached over
+// TCP.
+func BackendTCPConn(conn net.Conn) (_ *net.TCPConn, ok bool) {
+	c, ok := asBackendConn(conn)
+	if !ok || c.tcpConn == nil {
+		return nil, false
+	}
+	return c.tcpConn, true
+}
+
+// BackendRemoteAddr returns the remote address of the connection underlying a
+// connection returned by BackendDial, i.e. the concrete address that was
+// dialed. This is useful to find out which address family (IPv4 or IPv6) was
+// used, which is not predictable when a hostname resolves to addresses of both
+// families (see newBackendDialer). The address is the same whether or not the
+// connection was upgraded to TLS. If the backend was reached through an HTTP
+// proxy (see HTTPConnectProxy), the address of the proxy is returned. ok is
+// false if conn was not returned by BackendDial.
+func BackendRemoteAddr(conn net.Conn) (_ net.Addr, ok bool) {
+	c, ok := asBackendConn(conn)
+	if !ok {
+		return nil, false
+	}
+	return c.wire.RemoteAddr(), true
+}
+
+// ConnectionID configures the dialer to label the backend connection with id,
+// a correlation ID (e.g. the ID of the client connection), so that the log
+// lines about the dial, the client connection and the backend connection can
+// be joined. The ID is included in the messages of the errors returned by the
+// dial, is added as a "backend-conn" log tag to the events logged during the
+// dial, and as a tag of its tracing span. It can be retrieved from the
+// returned connection through BackendConnectionID.
+func ConnectionID(id string) DialOption {
+	return func(opts *dialOptions) {
+		opts.connID = id
+	}
+}
+
+// BackendConnectionID returns the correlation ID of a connection returned by
+// BackendDial, which was supplied through ConnectionID. ok is false if conn
+// was not returned by BackendDial, or no ID was supplied.
+func BackendConnectionID(conn net.Conn) (_ string, ok bool) {
+	c, ok := asBackendConn(conn)
+	if !ok || c.connID == "" {
+		return "", false
+	}
+	return c.connID, true
+}
+
+// labelDialError includes the correlation ID id, if set, in the message of
+// err, an error returned by the dialer. The error code attached to err, if
+// any, is preserved.
+func labelDialError(err error, id string) error {
+	if err == nil || id == "" {
+		return err
+	}
+	var codeErr *codeError
+	if errors.As(err, &codeErr) {
+		return &codeError{
+			code: codeErr.code,
+			err:  errors.Wrapf(codeErr.err, "backend connection %s", id),
+		}
+	}
+	return errors.Wrapf(err, "backend connection %s", id)
+}
+
+// countingConn is a net.Conn wrapper which counts the number of bytes read
+// and written.
+type countingConn struct {
+	// Accessed atomically. These are kept first in the struct to guarantee
+	// 64-bit alignment.
+	bytesIn  int64
+	bytesOut int64
+
+	net.Conn
+	// pending, if set, is written ahead of the bytes of the next write, in
+	// the same write to the underlying connection, e.g. to coalesce the PROXY
+	// protocol header with the first message sent to the backend. Writes must
+	// not be called concurrently while it is set.
+	pending []byte
+}
+
+var _ net.Conn = &countingConn{}
+
+// Read implements the net.Conn interface.
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.bytesIn, int64(n))
+	return n, err
+}
+
+// Write implements the net.Conn interface.
+func (c *countingConn) Write(b []byte) (int, error) {
+	if c.pending != nil {
+		return c.writePending(b)
+	}
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.bytesOut, int64(n))
+	return n, err
+}
+
+// writePending writes the pending bytes followed by b in a single write, and
+// returns the number of bytes of b which were written.
+func (c *countingConn) writePending(b []byte) (int, error) {
+	pending := c.pending
+	c.pending = nil
+	buf := make([]byte, 0, len(pending)+len(b))
+	buf = append(append(buf, pending...), b...)
+	n, err := c.Conn.Write(buf)
+	atomic.AddInt64(&c.bytesOut, int64(n))
+	if n -= len(pending); n < 0 {
+		n = 0
+	}
+	if err == nil && n < len(b) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// BytesIn returns the number of bytes read from the connection.
+func (c *countingConn) BytesIn() int64 {
+	return atomic.LoadInt64(&c.bytesIn)
+}
+
+// BytesOut returns the number of bytes written to the connection.
+func (c *countingConn) BytesOut() int64 {
+	return atomic.LoadInt64(&c.bytesOut)
+}
+
+// idleTimeoutError is returned by the I/O operations of an idleTimeoutConn
+// once it was closed because of inactivity.
+type idleTimeoutError struct{}
+
+var _ net.Error = idleTimeoutError{}
+
+// Error implements the error interface.
+func (idleTimeoutError) Error() string { return "backend connection exceeded idle timeout" }
+
+// Timeout implements the net.Error interface.
+func (idleTimeoutError) Timeout() bool { return true }
+
+// Temporary implements the net.Error interface.
+func (idleTimeoutError) Temporary() bool { return false }
+
+// idleTimeoutConn is a net.Conn wrapper which closes the connection once no
+// bytes were read or written for the configured timeout. Reads and writes that
+// fail because of this return an idleTimeoutError.
+//
+// Inactivity is detected with a timer rather than with I/O deadlines, so that
+// callers remain free to set deadlines on the connection (see the forwarder).
+type idleTimeoutConn struct {
+	// Accessed atomically. These are kept first in the struct to guarantee
+	// 64-bit alignment.
+	lastActivity int64 // unix nanoseconds
+	timedOut     int32
+
+	net.Conn
+	timeout time.Duration
+
+	mu struct {
+		syncutil.Mutex
+		timer  *time.Timer
+		closed bool
+	}
+}
+
+var _ net.Conn = &idleTimeoutConn{}
+
+// newIdleTimeoutConn wraps conn into an idleTimeoutConn with the given
+// timeout, which must be positive.
+func newIdleTimeoutConn(conn net.Conn, timeout time.Duration) *idleTimeoutConn {
+	c := &idleTimeoutConn{Conn: conn, timeout: timeout}
+	c.markActive()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mu.timer = time.AfterFunc(timeout, c.checkIdle)
+	return c
+}
+
+// Read implements the net.Conn interface.
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	return n, c.afterIO(n, err)
+}
+
+// Write implements the net.Conn interface.
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	return n, c.afterIO(n, err)
+}
+
+// Close implements the net.Conn interface.
+func (c *idleTimeoutConn) Close() error {
+	c.mu.Lock()
+	c.mu.closed = true
+	c.mu.timer.Stop()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// afterIO records activity if n bytes were transferred, and translates err
+// into an idleTimeoutError if the connection was closed because of
+// inactivity.
+func (c *idleTimeoutConn) afterIO(n int, err error) error {
+	if n > 0 {
+		c.markActive()
+	}
+	if err != nil && atomic.LoadInt32(&c.timedOut) == 1 {
+		return idleTimeoutError{}
+	}
+	return err
+}
+
+func (c *idleTimeoutConn) markActive() {
+	atomic.StoreInt64(&c.lastActivity, timeutil.Now().UnixNano())
+}
+
+// checkIdle is invoked by the timer. It closes the connection if it has been
+// idle for the timeout, or re-arms the timer for the remaining time otherwise.
+func (c *idleTimeoutConn) checkIdle() {
+	idle := timeutil.Since(timeutil.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mu.closed {
+		return
+	}
+	if idle < c.timeout {
+		c.mu.timer.Reset(c.timeout - idle)
+		return
+	}
+	atomic.StoreInt32(&c.timedOut, 1)
+	_ = c.Conn.Close()
+}
@@ -0,0 +1,344 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendConnBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+
+	// The backend echoes whatever it receives after the startup message. The
+	// startup message is read without buffering, so that no bytes of the
+	// payload are consumed.
+	startupLen := int64(len(testStartupMessage().Encode(nil)))
+	echo := func(conn net.Conn) {
+		if _, err := io.ReadFull(conn, make([]byte, startupLen)); err != nil {
+			return
+		}
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+	plainAddr, stopPlain := startTestBackend(t, echo)
+	defer stopPlain()
+	tlsAddr, stopTLS := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		echo(tlsConn)
+	})
+	defer stopTLS()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	payload := []byte("hello world")
+
+	for _, tc := range []struct {
+		name      string
+		addr      string
+		tlsConfig *tls.Config
+	}{
+		{"plaintext", plainAddr, nil},
+		{"tls", tlsAddr, &tls.Config{InsecureSkipVerify: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := BackendDialContext(ctx, testStartupMessage(), tc.addr, tc.tlsConfig)
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, conn.SetDeadline(timeutil.Now().Add(10*time.Second)))
+
+			_, err = conn.Write(payload)
+			require.NoError(t, err)
+			buf := make([]byte, len(payload))
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			require.Equal(t, payload, buf)
+
+			bytesIn, bytesOut, ok := BackendConnBytes(conn)
+			require.True(t, ok)
+			if tc.tlsConfig == nil {
+				require.Equal(t, int64(len(payload)), bytesIn)
+				require.Equal(t, startupLen+int64(len(payload)), bytesOut)
+			} else {
+				// Encrypted bytes on the wire include the handshake and
+				// record overhead.
+				require.Greater(t, bytesIn, int64(len(payload)))
+				require.Greater(t, bytesOut, startupLen+int64(len(payload)))
+			}
+		})
+	}
+
+	// Connections which were not returned by BackendDial have no counters.
+	_, _, ok := BackendConnBytes(&net.TCPConn{})
+	require.False(t, ok)
+}
+
+func TestBackendDialIdleTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The backend echoes every byte it receives after the startup message.
+	startupLen := len(testStartupMessage().Encode(nil))
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		if _, err := io.ReadFull(conn, make([]byte, startupLen)); err != nil {
+			return
+		}
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	const idleTimeout = 200 * time.Millisecond
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), addr, nil /* tlsConfig */, IdleTimeout(idleTimeout),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Activity keeps the connection open beyond the idle timeout.
+	buf := make([]byte, 1)
+	start := timeutil.Now()
+	for timeutil.Since(start) < 2*idleTimeout {
+		_, err = conn.Write(buf)
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		time.Sleep(idleTimeout / 10)
+	}
+
+	// A blocked read fails once the connection is idle.
+	_, err = conn.Read(buf)
+	require.Error(t, err)
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr))
+	require.True(t, netErr.Timeout())
+	_, err = conn.Write(buf)
+	require.Error(t, err)
+}
+
+func TestBackendTCPConn(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	readErrCh := make(chan error, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			readErrCh <- err
+			return
+		}
+		if _, err := receiveStartupMessage(tlsConn); err != nil {
+			readErrCh <- err
+			return
+		}
+		if _, err := tlsConn.Write([]byte("ping")); err != nil {
+			readErrCh <- err
+			return
+		}
+		_, err = io.Copy(io.Discard, tlsConn)
+		readErrCh <- err
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), addr, &tls.Config{InsecureSkipVerify: true},
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	tcpConn, ok := BackendTCPConn(conn)
+	require.True(t, ok)
+	require.NoError(t, tcpConn.SetLinger(0))
+
+	// The remote address is not hidden by TLS.
+	remoteAddr, ok := BackendRemoteAddr(conn)
+	require.True(t, ok)
+	require.Equal(t, addr, remoteAddr.String())
+	require.Equal(t, tcpConn.RemoteAddr(), remoteAddr)
+
+	// Reads through the layered connection are not affected.
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+
+	// With a zero linger, closing the connection resets it rather than
+	// shutting it down gracefully. The raw connection is closed so that no
+	// TLS close_notify alert is sent first.
+	require.NoError(t, tcpConn.Close())
+	require.True(t, errors.Is(<-readErrCh, syscall.ECONNRESET))
+
+	_, ok = BackendTCPConn(&net.TCPConn{})
+	require.False(t, ok)
+}
+
+// closeErrorConn is a net.Conn whose Close fails, and counts its calls.
+type closeErrorConn struct {
+	net.Conn
+	closes int32
+}
+
+func (c *closeErrorConn) Close() error {
+	atomic.AddInt32(&c.closes, 1)
+	_ = c.Conn.Close()
+	return errors.New("close failed")
+}
+
+func TestBackendConnClose(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	t.Run("concurrent", func(t *testing.T) {
+		addr, stop := startTestBackend(t, func(conn net.Conn) {
+			_, _ = io.Copy(io.Discard, conn)
+		})
+		defer stop()
+
+		conn, err := BackendDial(testStartupMessage(), addr, nil /* tlsConfig */)
+		require.NoError(t, err)
+		errCh := make(chan error, 10)
+		for i := 0; i < cap(errCh); i++ {
+			go func() { errCh <- conn.Close() }()
+		}
+		for i := 0; i < cap(errCh); i++ {
+			require.NoError(t, <-errCh)
+		}
+		require.NoError(t, conn.Close())
+		_, err = conn.Write([]byte("x"))
+		require.True(t, errors.Is(err, net.ErrClosed))
+	})
+
+	t.Run("first error is returned", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+		underlying := &closeErrorConn{Conn: client}
+		conn := &backendConn{Conn: underlying, wire: &countingConn{Conn: client}}
+		require.EqualError(t, conn.Close(), "close failed")
+		require.EqualError(t, conn.Close(), "close failed")
+		require.Equal(t, int32(1), atomic.LoadInt32(&underlying.closes))
+	})
+}
+
+func TestBackendConnectionID(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), addr, nil /* tlsConfig */, ConnectionID("42"),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	id, ok := BackendConnectionID(conn)
+	require.True(t, ok)
+	require.Equal(t, "42", id)
+
+	conn, err = BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, ok = BackendConnectionID(conn)
+	require.False(t, ok)
+
+	// The ID is included in errors, whose code is preserved.
+	_, err = BackendDialContext(
+		ctx, testStartupMessage(), addr, nil /* tlsConfig */, ConnectionID("43"),
+		MaxStartupMessageSize(1),
+	)
+	require.Equal(t, codeClientStartupTooLarge, getErrorCode(err))
+	require.EqualError(t, err, "codeClientStartupTooLarge: backend connection 43: "+
+		"startup message of 38 bytes exceeds the maximum of 1 bytes")
+}
+
+func TestDialBackend(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		if _, err := receiveStartupMessage(tlsConn); err != nil {
+			return
+		}
+		_, _ = tlsConn.Write([]byte("ok"))
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := DialBackend(
+		ctx, testStartupMessage(), addr, &tls.Config{InsecureSkipVerify: true}, ConnectionID("42"),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NotNil(t, conn.TLSState)
+	require.Equal(t, addr, conn.DialedAddr.String())
+	require.Equal(t, "42", conn.ConnectionID)
+	require.Greater(t, conn.DialDuration, time.Duration(0))
+	require.Less(t, RemainingBudget(ctx), 10*time.Second-conn.DialDuration)
+	bytesOut := conn.BytesOut()
+	require.Greater(t, bytesOut, int64(0))
+
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	require.NoError(t, err)
+	require.Greater(t, conn.BytesIn(), int64(0))
+	require.Equal(t, bytesOut, conn.BytesOut())
+
+	// The accessors accept a *BackendConn.
+	state, ok := BackendTLSState(conn)
+	require.True(t, ok)
+	require.Equal(t, conn.TLSState.Version, state.Version)
+
+	_, err = DialBackend(ctx, testStartupMessage(), addr, nil /* tlsConfig */, MaxStartupMessageSize(1))
+	require.Equal(t, codeClientStartupTooLarge, getErrorCode(err))
+}
@@ -9,63 +9,1205 @@
 package sqlproxyccl
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"io"
 	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/netutil/addr"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/logtags"
 	"github.com/jackc/pgproto3/v2"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// defaultBackendDialTimeout is the timeout used by BackendDialContext when the
+// supplied context has no deadline.
+const defaultBackendDialTimeout = 5 * time.Second
+
+// defaultBackendKeepAlivePeriod is the default interval between TCP keepalive
+// probes on backend connections.
+const defaultBackendKeepAlivePeriod = 30 * time.Second
+
+// DefaultMaxStartupMessageSize is the default maximum size of the encoded
+// startup message relayed to backends. See MaxStartupMessageSize.
+const DefaultMaxStartupMessageSize = 10 << 10 // 10 KiB
+
+// dialOptions controls the behavior of BackendDialContext.
+type dialOptions struct {
+	// preferTLS, if true, falls back to a plaintext connection if the backend
+	// refuses to upgrade the connection to TLS.
+	preferTLS bool
+	// retryOpts, if set, controls how failed TCP connection attempts to the
+	// backend are retried.
+	retryOpts *retry.Options
+	// unixSocketTLS, if true, upgrades connections to backends listening on a
+	// Unix domain socket to TLS if a tls.Config is specified. By default, TLS
+	// is skipped for such connections.
+	unixSocketTLS bool
+	// deriveServerName, if true, sets the ServerName of the TLS configuration
+	// to the host of the backend address if it was left empty.
+	deriveServerName bool
+	// proxyProtocol, if set, contains the client addresses sent to the backend
+	// in a PROXY protocol v2 header.
+	proxyProtocol *proxyProtocolAddrs
+	// keepAlivePeriod is the interval between TCP keepalive probes. If
+	// negative, keepalives are disabled.
+	keepAlivePeriod time.Duration
+	// nextProtos, if set, is the list of ALPN protocols advertised to the
+	// backend during the TLS handshake.
+	nextProtos []string
+	// requireALPN, if true, fails the dial if the backend did not select one
+	// of nextProtos.
+	requireALPN bool
+	// gssEncryption, if set, is used to establish GSSAPI encryption with the
+	// backend instead of TLS.
+	gssEncryption GSSEncryptionFunc
+	// idleTimeout, if positive, is the duration of inactivity after which
+	// the backend connection is closed.
+	idleTimeout time.Duration
+	// paramAllowlist, if set, restricts the startup parameters which are
+	// relayed to the backend.
+	paramAllowlist *startupParamAllowlist
+	// netDialer, if set, is used to establish connections to the backend in
+	// place of the default dialer.
+	netDialer *net.Dialer
+	// maxStartupMsgSize, if positive, is the maximum size of the encoded
+	// startup message relayed to the backend.
+	maxStartupMsgSize int
+	// protocolVersions, if set, is the list of protocol versions of the
+	// startup messages which are relayed to the backend. By default, only
+	// version 3.0 is accepted.
+	protocolVersions []uint32
+	// peekFirstMessage, if set, is invoked with the first message sent by the
+	// backend in response to the startup message.
+	peekFirstMessage func(msg pgproto3.BackendMessage)
+	// httpProxy, if set, is the HTTP proxy through which TCP backends are
+	// reached.
+	httpProxy *httpProxy
+	// budget, if set, describes how the time remaining until the deadline of
+	// the dial is split across its phases.
+	budget *DialBudget
+	// router, if set, derives the backend address from the parameters of the
+	// startup message.
+	router StartupParamRouter
+	// minTLSVersion, if set, is the minimum TLS version negotiated with the
+	// backend if the tls.Config doesn't specify one.
+	minTLSVersion uint16
+	// connID, if set, is the correlation ID of the backend connection.
+	connID string
+	// getClientCert, if set, returns the client certificate presented to
+	// backends which request one during the TLS handshake.
+	getClientCert func(info *tls.CertificateRequestInfo) (*tls.Certificate, error)
+	// network, if set, is the network ("tcp", "tcp4" or "tcp6") used to dial
+	// TCP backends.
+	network string
+	// authTimeout, if positive, bounds the time waiting for the first message
+	// sent by the backend in response to the startup message.
+	authTimeout time.Duration
+	// connectTimeout, if positive, bounds each attempt to establish the
+	// connection to the backend.
+	connectTimeout time.Duration
+	// wireTracer, if set, is invoked with the bytes exchanged with the
+	// backend during the dial.
+	wireTracer func(dir Direction, b []byte)
+	// tlsFallback, if set, is the tls.Config used to re-dial the backend if
+	// the TLS negotiation fails.
+	tlsFallback *tls.Config
+	// clientAddrParam, if set, is the startup parameter which carries the
+	// address of the client to the backend.
+	clientAddrParam *startupParam
+	// tlsConfigFunc, if set, returns the tls.Config used to negotiate TLS
+	// with the backend, based on the startup parameters.
+	tlsConfigFunc func(params map[string]string) (*tls.Config, error)
+	// compressionPolicy controls how the startup parameters which negotiate
+	// wire compression are relayed.
+	compressionPolicy CompressionPolicy
+	// phaseObserver, if set, is notified of the phases of the dial.
+	phaseObserver DialPhaseObserver
+	// socksProxy, if set, is the URL of the SOCKS5 proxy through which TCP
+	// backends are reached.
+	socksProxy *url.URL
+	// wireTraceSink, if set, receives the trace of the dial, unless
+	// wireTracer is set.
+	wireTraceSink *WireTraceSink
+	// observeKeyData, if set, is invoked with the BackendKeyData sent by the
+	// backend.
+	observeKeyData func(pid, secret uint32, backendAddr string)
+	// defaultPort, if set, is the port of the TCP backends whose address
+	// lacks one.
+	defaultPort string
+	// nagle, if set, enables Nagle's algorithm on TCP backend connections.
+	nagle bool
+	// strictStartupOrdering, if set, fails dials to backends which send data
+	// out of turn while the connection is established.
+	strictStartupOrdering bool
+	// slowDialThreshold and onSlowDial are configured through
+	// SlowDialThreshold.
+	slowDialThreshold time.Duration
+	onSlowDial        func(serverAddress string, elapsed time.Duration)
+	// callerErr returns the error of the context passed to
+	// BackendDialContext, which tells the dials abandoned by the caller apart
+	// from those which failed because of the backend. It is set by
+	// BackendDialContext rather than by an option.
+	callerErr func() error
+}
+
+// newDialOptions returns the dialOptions that result from applying opts to the
+// defaults.
+func newDialOptions(opts []DialOption) *dialOptions {
+	options := &dialOptions{
+		keepAlivePeriod:   defaultBackendKeepAlivePeriod,
+		maxStartupMsgSize: DefaultMaxStartupMessageSize,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// DialOption defines an option that can be passed to BackendDialContext in
+// order to control its behavior.
+type DialOption func(opts *dialOptions)
+
+// PreferTLS configures the dialer to behave like the "prefer" sslmode in
+// PostgreSQL: if a tls.Config was specified but the backend refuses the
+// SSLRequest, the dialer transparently continues with a plaintext connection
+// instead of returning a codeBackendRefusedTLS error.
+func PreferTLS() DialOption {
+	return func(opts *dialOptions) {
+		opts.preferTLS = true
+	}
+}
+
+// DialRetry configures the dialer to retry transient failures to establish
+// the TCP connection to the backend (i.e. connection refused and timeouts)
+// with exponential backoff and jitter, as described by retryOpts. Retries are
+// bounded by the deadline of the context passed to BackendDialContext, and
+// by retryOpts.MaxRetries if set. Failures after the TCP connection has been
+// established, such as a codeBackendRefusedTLS error, are never retried.
+func DialRetry(retryOpts retry.Options) DialOption {
+	return func(opts *dialOptions) {
+		opts.retryOpts = &retryOpts
+	}
+}
+
+// KeepAlivePeriod configures the interval between TCP keepalive probes sent
+// on backend connections, which defaults to 30 seconds. Keepalives detect
+// backend connections whose flow was silently dropped (e.g. by a NAT) while
+// idle. A negative period disables keepalives.
+func KeepAlivePeriod(period time.Duration) DialOption {
+	return func(opts *dialOptions) {
+		opts.keepAlivePeriod = period
+	}
+}
+
+// SlowDialThreshold configures the dialer to invoke fn once a dial completes,
+// whether it succeeded or not, if it took longer than threshold, e.g. to alert
+// when dial latency exceeds an SLO without maintaining histograms. For
+// BackendDialContext, the elapsed time covers the whole dial, from the
+// resolution of serverAddress to the relay of the startup message; for
+// FinishStartupContext, it covers the TLS negotiation and the relay of the
+// startup message. fn is invoked synchronously, before the dial returns, so it
+// must not block.
+func SlowDialThreshold(
+	threshold time.Duration, fn func(serverAddress string, elapsed time.Duration),
+) DialOption {
+	return func(opts *dialOptions) {
+		opts.slowDialThreshold = threshold
+		opts.onSlowDial = fn
+	}
+}
+
+// reportSlowDial invokes the callback configured through SlowDialThreshold if
+// the dial to serverAddress, which started at start, exceeded the threshold.
+func reportSlowDial(serverAddress string, start time.Time, options *dialOptions) {
+	if options.onSlowDial == nil {
+		return
+	}
+	if elapsed := timeutil.Since(start); elapsed > options.slowDialThreshold {
+		options.onSlowDial(serverAddress, elapsed)
+	}
+}
+
+// EnableNagle configures the dialer to enable Nagle's algorithm on the TCP
+// connections to backends, which is the default of the operating system, but
+// not of the dialer. By default, TCP_NODELAY is set on backend connections,
+// so that the small messages of the PostgreSQL protocol are sent right away,
+// rather than being delayed until the previous ones are acknowledged, which
+// can add up to 40ms to interactive round-trips when combined with delayed
+// acknowledgments (see BenchmarkBackendConnRoundTrip). Nagle's algorithm
+// reduces the number of packets sent, which may benefit bulk transfers.
+func EnableNagle() DialOption {
+	return func(opts *dialOptions) {
+		opts.nagle = true
+	}
+}
+
+// IdleTimeout configures the dialer to return a connection which is closed
+// once no bytes were read from or written to it for the given duration. Once
+// that happens, pending and subsequent reads and writes fail with a net.Error
+// whose Timeout method returns true. A zero duration, which is the default,
+// disables the idle timeout.
+func IdleTimeout(timeout time.Duration) DialOption {
+	return func(opts *dialOptions) {
+		opts.idleTimeout = timeout
+	}
+}
+
+// MaxStartupMessageSize configures the maximum size, in bytes, of the encoded
+// startup message relayed to the backend, after StartupParamRewriter and
+// StartupParamAllowlist were applied. Since the startup message is usually
+// received from an untrusted client, this bounds the memory used to relay it,
+// and protects backends from oversized messages. Dials with a larger startup
+// message fail with a codeClientStartupTooLarge error before anything is
+// relayed. A size which is not positive disables the limit. The default is
+// DefaultMaxStartupMessageSize.
+func MaxStartupMessageSize(size int) DialOption {
+	return func(opts *dialOptions) {
+		opts.maxStartupMsgSize = size
+	}
+}
+
+// AcceptedProtocolVersions configures the protocol versions of the startup
+// messages which are relayed to the backend, in place of the default, which
+// only accepts version 3.0 (pgproto3.ProtocolVersionNumber). Dials with a
+// startup message using another version fail with a
+// codeUnsupportedProtocolVersion error before anything is relayed, rather than
+// with an opaque error from the backend. Versions are encoded as in the
+// startup message: the major version in the 16 most significant bits, and the
+// minor version in the 16 least significant bits.
+func AcceptedProtocolVersions(versions ...uint32) DialOption {
+	return func(opts *dialOptions) {
+		opts.protocolVersions = append([]uint32{}, versions...)
+	}
+}
+
+// DialNetwork configures the network used to dial backends reached over TCP,
+// which is one of "tcp" (the default), "tcp4" or "tcp6", e.g. to force IPv4 in
+// environments with broken IPv6 connectivity, as a simpler alternative to the
+// Happy Eyeballs behavior of the default dialer. The network also applies to
+// the connection to the proxy configured through HTTPConnectProxy, and
+// DialDNSCache is bypassed unless the network is "tcp". Backends reached over a
+// Unix domain socket are not affected. Dials with any other network fail
+// before the backend is contacted.
+func DialNetwork(network string) DialOption {
+	return func(opts *dialOptions) {
+		opts.network = network
+	}
+}
+
+// DefaultSQLPort is the default port of CockroachDB SQL servers, for use with
+// DefaultBackendPort.
+const DefaultSQLPort = "26257"
+
+// DefaultBackendPort configures the dialer to connect to port (e.g.
+// DefaultSQLPort) on TCP backends whose address, once resolved through
+// AddressResolver, consists of a host without port, such as "localhost" or
+// "::1". Without it, dialing such an address fails with a
+// codeInvalidBackendAddress error, before the backend is contacted.
+func DefaultBackendPort(port string) DialOption {
+	return func(opts *dialOptions) {
+		opts.defaultPort = port
+	}
+}
+
+// checkBackendAddress returns the address of the TCP backend to dial, i.e.
+// address itself, or address with the port configured through
+// DefaultBackendPort if it has none. It returns a codeInvalidBackendAddress
+// error if address is malformed, rather than letting the dial fail with a
+// codeBackendDown error, which would look like an outage.
+func checkBackendAddress(address string, options *dialOptions) (string, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil && options.defaultPort != "" {
+		var addrErr *net.AddrError
+		if net.ParseIP(address) != nil ||
+			(errors.As(err, &addrErr) && addrErr.Err == "missing port in address") {
+			address = net.JoinHostPort(address, options.defaultPort)
+			_, port, err = net.SplitHostPort(address)
+		}
+	}
+	if err == nil && port == "" {
+		err = errors.New("missing port")
+	}
+	if err != nil {
+		return "", wrapErrorf(
+			codeInvalidBackendAddress, err, "invalid backend SQL server address %q", address,
+		)
+	}
+	return address, nil
+}
+
+// validateDialNetwork returns an error if the network configured through
+// DialNetwork is not supported.
+func validateDialNetwork(options *dialOptions) error {
+	switch options.network {
+	case "", "tcp", "tcp4", "tcp6":
+		return nil
+	}
+	return errors.Newf(
+		"invalid dial network %q: must be one of \"tcp\", \"tcp4\" or \"tcp6\"", options.network,
+	)
+}
+
+// ConnectTimeout bounds each attempt to establish the connection to the
+// backend (i.e. the TCP connect, retried according to DialRetry) by timeout,
+// in addition to the deadline of the context passed to BackendDialContext,
+// whichever is earlier. This allows callers to keep a generous deadline for the
+// whole dial while failing over quickly between candidate backends (see
+// BackendDialAnyContext). An attempt which exceeds the timeout fails with a
+// codeBackendDown error, which is retryable. The TLS negotiation and the relay
+// of the startup message are not affected.
+func ConnectTimeout(timeout time.Duration) DialOption {
+	return func(opts *dialOptions) {
+		opts.connectTimeout = timeout
+	}
+}
+
+// NetDialer configures the dialer to establish the connection to the backend
+// through dialer, e.g. to bind a source address through LocalAddr, to set
+// socket options through Control, or to use a custom Resolver. The connection
+// attempt remains bounded by the deadline of the context passed to
+// BackendDialContext, or the default 5 second timeout, in addition to the
+// Timeout of dialer. dialer must not be modified once passed in.
+func NetDialer(dialer *net.Dialer) DialOption {
+	return func(opts *dialOptions) {
+		opts.netDialer = dialer
+	}
+}
+
+// NextProtos configures the list of application protocols advertised to the
+// backend through ALPN during the TLS handshake, overriding the NextProtos of
+// the tls.Config. This allows load balancers in front of the backends to route
+// by ALPN. The negotiated protocol can be retrieved through BackendTLSState.
+// If required is true and the backend does not select any protocol, the dial
+// fails with a codeBackendTLSHandshakeFailed error.
+func NextProtos(protos []string, required bool) DialOption {
+	return func(opts *dialOptions) {
+		opts.nextProtos = protos
+		opts.requireALPN = required
+	}
+}
+
+// MinTLSVersion configures the minimum TLS version (e.g. tls.VersionTLS12)
+// negotiated with the backend when the MinVersion of the tls.Config was left
+// unset, so that connections are never downgraded below a compliance floor.
+// A MinVersion set by the caller is respected, even if it is lower. If the
+// backend doesn't support the minimum version, the dial fails with a
+// codeBackendTLSHandshakeFailed error.
+func MinTLSVersion(version uint16) DialOption {
+	return func(opts *dialOptions) {
+		opts.minTLSVersion = version
+	}
+}
+
 // BackendDial is an example backend dialer that does a TCP/IP connection
 // to a backend, SSL and forwards the start message. It is defined as a variable
 // so it can be redirected for testing.
 //
 // BackendDial uses a dial timeout of 5 seconds to mitigate network black
-// holes.
+// holes. Use BackendDialContext to control the timeout through a context.
 //
 // TODO(jaylim-crl): Move dialer into connector in the future. When moving this
 // into the connector, we should be careful as this is also used by CC's
 // codebase.
 var BackendDial = func(
 	msg *pgproto3.StartupMessage, serverAddress string, tlsConfig *tls.Config,
+) (net.Conn, error) {
+	return BackendDialContext(context.Background(), msg, serverAddress, tlsConfig)
+}
+
+// RequireTLS, if true, makes BackendDialContext (and therefore BackendDial)
+// and FinishStartupContext refuse to establish a plaintext connection when the
+// tls.Config is nil, failing with a codeProxyRefusedConnection error before
+// the backend is contacted, rather than silently skipping the SSLRequest. This
+// guards against misconfigurations in deployments which must not send
+// traffic to backends in clear. Dials which use GSSEncryption are not
+// affected, nor are dials over Unix domain sockets for which a tls.Config is
+// specified but ignored (see UnixSocketTLS).
+var RequireTLS = false
+
+// checkRequireTLS returns an error if RequireTLS is set and the dial would
+// result in a plaintext connection, since tlsConfig is nil.
+func checkRequireTLS(serverAddress string, tlsConfig *tls.Config, options *dialOptions) error {
+	if !RequireTLS || tlsConfig != nil || options.gssEncryption != nil {
+		return nil
+	}
+	return newErrorf(
+		codeProxyRefusedConnection,
+		"refusing plaintext connection to backend SQL server %v: TLS is required", serverAddress,
+	)
+}
+
+// BackendDialContext is the context-aware version of BackendDial. The deadline
+// for dialing and negotiating SSL with the backend is derived from ctx; if ctx
+// has no deadline, a timeout of 5 seconds is used instead. If ctx is canceled
+// or its deadline is exceeded before the backend responds, a codeBackendDown
+// error is returned. Callers with a deadline spanning the dial and the
+// operations which follow, such as authentication and the first query, should
+// pass it through ctx, and size the next phases with RemainingBudget once the
+// dial returns.
+//
+// If ctx carries a tracing span, the dial is traced in a child span, which is
+// tagged with the server address and the outcome of the dial: whether TLS
+// was negotiated and the remote address on success, and the error code on
+// failure. The establishment of the connection, the TLS negotiation, and the
+// relay of the startup message are recorded as events of the span. The phases
+// of the dial can also be observed through ObserveDialPhases.
+//
+// serverAddress is usually a host:port pair, but may also refer to a Unix
+// domain socket, either through a "unix://" prefix or an absolute path (e.g.
+// "unix:///tmp/.s.PGSQL.26257" or "/tmp/.s.PGSQL.26257").
+//
+// If TrackDials is true, the returned connection is registered so that it can
+// be drained through DrainAll. The lifecycle of the connection can be observed
+// through LifecycleEvents.
+func BackendDialContext(
+	ctx context.Context,
+	msg *pgproto3.StartupMessage,
+	serverAddress string,
+	tlsConfig *tls.Config,
+	opts ...DialOption,
+) (net.Conn, error) {
+	options := newDialOptions(opts)
+	options.callerErr = ctx.Err
+
+	ctx, sp := tracing.ChildSpan(ctx, backendDialSpanName)
+	defer sp.Finish()
+	sp.SetTag("server_address", attribute.StringValue(serverAddress))
+	if options.connID != "" {
+		ctx = logtags.AddTag(ctx, "backend-conn", options.connID)
+		sp.SetTag("connection_id", attribute.StringValue(options.connID))
+	}
+	defer startWireTraceFile(ctx, serverAddress, options)()
+
+	start := timeutil.Now()
+	var eventStart time.Time
+	if LifecycleEvents != nil {
+		eventStart = timeSource.Now()
+		emitDialEvent(DialEvent{
+			Type:          DialStarted,
+			ServerAddress: serverAddress,
+			ConnectionID:  options.connID,
+			Time:          eventStart,
+		})
+	}
+	tlsConfig, err := resolveTLSConfig(msg, tlsConfig, options)
+	var conn net.Conn
+	if err == nil {
+		conn, err = dialWithTLSFallback(ctx, msg, serverAddress, tlsConfig, options)
+	}
+	enterDialPhase(options, DialPhaseDone)
+	err = labelDialError(err, options.connID)
+	emitDialOutcome(serverAddress, options, eventStart, conn, err)
+	if err == nil {
+		conn = trackDial(conn)
+	}
+	recordDialOutcome(sp, conn, err)
+	reportSlowDial(serverAddress, start, options)
+	if DialObserver != nil {
+		DialObserver(serverAddress, timeutil.Since(start), err)
+	}
+	return conn, err
+}
+
+// backendDialSpanName is the operation name of the tracing span which covers a
+// BackendDialContext call.
+const backendDialSpanName = "sqlproxy.backend-dial"
+
+// recordDialOutcome tags sp, the span of a BackendDialContext call, with the
+// outcome of the dial. sp may be nil.
+func recordDialOutcome(sp *tracing.Span, conn net.Conn, err error) {
+	if sp == nil {
+		return
+	}
+	if err != nil {
+		sp.SetTag("outcome", attribute.StringValue("error"))
+		sp.SetTag("error_code", attribute.StringValue(DialErrorCode(err)))
+		sp.Recordf("dial failed: %v", err)
+		return
+	}
+	_, isTLS := BackendTLSState(conn)
+	sp.SetTag("outcome", attribute.StringValue("ok"))
+	sp.SetTag("tls", attribute.BoolValue(isTLS))
+	if remoteAddr, ok := BackendRemoteAddr(conn); ok {
+		sp.SetTag("remote_addr", attribute.StringValue(remoteAddr.String()))
+	}
+}
+
+// UnixSocketTLS configures the dialer to negotiate TLS with backends which
+// are reached over a Unix domain socket, if a tls.Config is specified. By
+// default, the tls.Config is ignored for such backends since traffic does not
+// leave the host.
+func UnixSocketTLS() DialOption {
+	return func(opts *dialOptions) {
+		opts.unixSocketTLS = true
+	}
+}
+
+// DeriveServerName configures the dialer to set the ServerName of the
+// tls.Config to the host portion of the backend address when the caller left
+// it empty, so that the backend certificate is verified against the address
+// that was dialed (i.e. verify-full semantics). A verification failure results
+// in a codeBackendTLSHandshakeFailed error. Callers which set
+// InsecureSkipVerify are not affected by the derived ServerName.
+func DeriveServerName() DialOption {
+	return func(opts *dialOptions) {
+		opts.deriveServerName = true
+	}
+}
+
+// BackendDialWithRetry is like BackendDialContext, but retries transient TCP
+// connection failures according to retryOpts. See DialRetry for more details.
+func BackendDialWithRetry(
+	ctx context.Context,
+	msg *pgproto3.StartupMessage,
+	serverAddress string,
+	tlsConfig *tls.Config,
+	retryOpts retry.Options,
+	opts ...DialOption,
+) (net.Conn, error) {
+	return BackendDialContext(
+		ctx, msg, serverAddress, tlsConfig, append(opts, DialRetry(retryOpts))...,
+	)
+}
+
+// DialObserver, if set, is invoked exactly once at the end of every
+// BackendDialContext call (and therefore every BackendDial call) with the
+// total time spent dialing, negotiating TLS, and relaying the startup message,
+// and the final error, if any. DialErrorCode can be used to extract the error
+// code from the error, e.g. for use as a metric label.
+var DialObserver func(serverAddress string, d time.Duration, err error)
+
+// DefaultTLSSessionCacheSize is the number of TLS sessions held by the
+// default BackendTLSSessionCache.
+const DefaultTLSSessionCacheSize = 1024
+
+// BackendTLSSessionCache is the cache of TLS sessions shared by all the
+// backend connections, so that repeated dials to the same backend resume a
+// previous session instead of performing a full handshake. It is only used
+// when the tls.Config supplied to BackendDialContext does not specify a
+// ClientSessionCache of its own. It can be replaced, e.g. with a cache created
+// by tls.NewLRUClientSessionCache with a different size, or set to nil to
+// disable session resumption.
+//
+// Sessions are keyed by the ServerName of the tls.Config (or the address of
+// the backend if it is empty), so sessions established with a ServerName are
+// never resumed with a different one.
+var BackendTLSSessionCache tls.ClientSessionCache = tls.NewLRUClientSessionCache(
+	DefaultTLSSessionCacheSize,
+)
+
+// InsecureSkipVerifyPolicy, if set, decides for every TLS handshake with a
+// backend whether the certificate of the backend is verified, overriding the
+// InsecureSkipVerify setting of the tls.Config supplied to the dialer, e.g. to
+// keep the exceptions for legacy backends with self-signed certificates in a
+// single, auditable place rather than in the construction of the tls.Config
+// of each dial. It is invoked with the address of the backend, after
+// AddressResolver was applied. The tls.Config supplied to the dialer is never
+// modified.
+var InsecureSkipVerifyPolicy func(serverAddress string) (skipVerify bool)
+
+// TLSRefusalEvent describes a backend which refused to upgrade a connection to
+// TLS. See TLSRefusalObserver.
+type TLSRefusalEvent struct {
+	// ServerAddress is the address of the backend, after AddressResolver was
+	// applied.
+	ServerAddress string
+	// ServerNameSet is true if the identity of the backend was going to be
+	// verified against a ServerName, either set in the tls.Config or derived
+	// through DeriveServerName.
+	ServerNameSet bool
+	// Response is the byte received in response to the SSLRequest.
+	Response byte
+	// FellBack is true if the dialer fell back to a plaintext connection (see
+	// PreferTLS).
+	FellBack bool
+}
+
+// PlaintextOnly returns whether the backend refused TLS as PostgreSQL servers
+// configured without TLS do, by responding 'N' to the SSLRequest. Any other
+// response indicates that the dialer didn't reach a PostgreSQL server (e.g.
+// because of a misrouted connection or an interception attempt).
+func (e TLSRefusalEvent) PlaintextOnly() bool {
+	return e.Response == pgRejectSSLRequest
+}
+
+// TLSRefusalObserver, if set, is invoked whenever a backend refuses to upgrade
+// a connection to TLS, which results in a codeBackendRefusedTLS error unless
+// PreferTLS is specified, e.g. to log a structured event for operators. ctx is
+// the context of the dial, which carries its log tags. The observer must not
+// block.
+var TLSRefusalObserver func(ctx context.Context, event TLSRefusalEvent)
+
+// AddressResolver, if set, is invoked at the start of every
+// BackendDialContext call to translate serverAddress into the concrete address
+// that is dialed, e.g. to map a logical tenant address to the current address
+// of one of its pods. The resolved address is used for the TCP connection, and
+// to derive the TLS ServerName when DeriveServerName is specified. If the
+// resolver returns an error, dialing fails with a codeBackendDown error which
+// wraps it. The supplied context carries the dial deadline. Several resolvers
+// can be tried in order through ChainResolvers.
+var AddressResolver func(ctx context.Context, serverAddress string) (string, error)
+
+// DialRateLimiter limits the rate at which connections to backends are
+// established. It is satisfied by *rate.Limiter.
+type DialRateLimiter interface {
+	// Wait blocks until the next dial is allowed to proceed, or returns an
+	// error if ctx is done first (or would be, before the dial is allowed).
+	Wait(ctx context.Context) error
+}
+
+// DialLimiter, if set, is waited on by every BackendDialContext call before
+// the connection to the backend is initiated. It can be used to smooth out
+// reconnection storms, e.g. during failovers, which would otherwise overload
+// the backends with TCP and TLS handshakes. If the wait fails, e.g. because
+// the dial deadline would be exceeded, dialing fails with a codeBackendDown
+// error.
+var DialLimiter DialRateLimiter
+
+// DialErrorCode returns the name of the error code attached to an error
+// returned by BackendDial (e.g. "codeBackendDown"). It returns an empty string
+// if err is nil or has no error code attached.
+func DialErrorCode(err error) string {
+	if code := getErrorCode(err); code != 0 {
+		return code.String()
+	}
+	return ""
+}
+
+// ClassifyDialError returns the error code attached to an error returned by
+// BackendDial, and whether the dial may succeed if retried. Only
+// codeBackendDown errors, which indicate that the backend could not be reached
+// (e.g. the connection was refused or timed out), and
+// codeBackendClosedDuringStartup errors are retryable. Errors which
+// indicate a configuration issue, such as codeBackendRefusedTLS and
+// codeBackendTLSHandshakeFailed, are not. For errors without a code attached,
+// code is 0, and retryable is true if err is a connection refusal or timeout.
+func ClassifyDialError(err error) (code ErrorCode, retryable bool) {
+	if err == nil {
+		return 0, false
+	}
+	code = getErrorCode(err)
+	if code == 0 {
+		return 0, isRetriableDialError(err)
+	}
+	return code, code == codeBackendDown || code == codeBackendClosedDuringStartup
+}
+
+// abandonedByCaller returns whether err, the error of a dial, was caused by
+// the caller canceling the dial or by its deadline, rather than by the
+// backend. Such failures say nothing about the health of the backend, so they
+// are not reported to DialBreaker and DialFailures. Timeouts enforced by the
+// dialer itself, such as the default dial timeout or ConnectTimeout, are
+// reported.
+func abandonedByCaller(options *dialOptions, err error) bool {
+	return err != nil && options.callerErr != nil && options.callerErr() != nil
+}
+
+// backendDial implements BackendDialContext.
+func backendDial(
+	ctx context.Context,
+	msg *pgproto3.StartupMessage,
+	serverAddress string,
+	tlsConfig *tls.Config,
+	options *dialOptions,
 ) (_ net.Conn, retErr error) {
+	enterDialPhase(options, DialPhaseResolving)
+	if err := checkRequireTLS(serverAddress, tlsConfig, options); err != nil {
+		return nil, err
+	}
+	if err := validateDialNetwork(options); err != nil {
+		return nil, err
+	}
 	// TODO(JeffSwenson): This behavior may need to change once multi-region
 	// multi-tenant clusters are supported. The fixed timeout may need to be
 	// replaced by an adaptive timeout or the timeout could be replaced by
 	// speculative retries.
-	conn, err := net.DialTimeout("tcp", serverAddress, time.Second*5)
+	ctx, cancel := withDefaultDialTimeout(ctx)
+	defer cancel()
+	if limiter := DialConcurrency; limiter != nil {
+		if err := limiter.acquire(ctx); err != nil {
+			return nil, err
+		}
+		defer limiter.release()
+	}
+	if options.router != nil {
+		routed, err := routeStartupMsg(options.router, msg)
+		if err != nil {
+			return nil, err
+		}
+		serverAddress = routed
+	}
+	if AddressResolver != nil {
+		resolved, err := AddressResolver(ctx, serverAddress)
+		if err != nil {
+			return nil, wrapErrorf(
+				codeBackendDown, err, "resolving backend address %v", serverAddress,
+			)
+		}
+		serverAddress = resolved
+	}
+	network, address := backendNetworkAddress(serverAddress)
+	if network == "unix" && !options.unixSocketTLS {
+		tlsConfig = nil
+	}
+	if network == "tcp" {
+		checked, err := checkBackendAddress(address, options)
+		if err != nil {
+			return nil, err
+		}
+		serverAddress, address = checked, checked
+	}
+	if cache := DialFailures; cache != nil {
+		if err := cache.check(serverAddress); err != nil {
+			return nil, err
+		}
+	}
+	var releaseSlot func()
+	if limits := BackendConnLimits; limits != nil {
+		release, err := limits.acquire(ctx, serverAddress)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if retErr != nil {
+				release()
+			}
+		}()
+		releaseSlot = release
+	}
+	if DialLimiter != nil {
+		if err := DialLimiter.Wait(ctx); err != nil {
+			return nil, wrapErrorf(
+				codeBackendDown, err, "waiting to dial backend SQL server %v", serverAddress,
+			)
+		}
+	}
+	if breaker := DialBreaker; breaker != nil {
+		if err := breaker.allow(serverAddress); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if abandonedByCaller(options, retErr) {
+				breaker.abandon(serverAddress)
+				return
+			}
+			breaker.record(serverAddress, retErr)
+		}()
+	}
+	if cache := DialFailures; cache != nil {
+		defer func() {
+			if !abandonedByCaller(options, retErr) {
+				cache.record(serverAddress, retErr)
+			}
+		}()
+	}
+	dialCtx, endDial := startDialPhase(ctx, options, DialPhaseConnecting)
+	conn, err := dialBackendConn(dialCtx, network, address, options)
+	if getErrorCode(err) == codeBackendAddressForbidden {
+		return nil, endDial(err)
+	}
 	if err != nil {
-		return nil, newErrorf(
-			codeBackendDown, "unable to reach backend SQL server: %v", err,
-		)
+		return nil, endDial(newConnectError(err))
 	}
+	log.VEventf(ctx, 2, "connected to backend SQL server %s", conn.RemoteAddr())
 	defer func() {
 		if retErr != nil {
 			conn.Close()
 		}
 	}()
-	conn, err = sslOverlay(conn, tlsConfig)
+	// TCP-level options have to be configured before the connection is
+	// wrapped by TLS, which hides the underlying *net.TCPConn.
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := configureTCPConn(tcpConn, options); err != nil {
+			return nil, endDial(newErrorf(
+				codeBackendDown, "configuring connection to target server %v: %v",
+				serverAddress, err))
+		}
+	}
+	// Count bytes below the TLS layer, so that the bytes on the wire are
+	// counted.
+	wire := &countingConn{Conn: conn}
+	// The PROXY protocol header must precede everything else, including the
+	// SSLRequest, since it is consumed by the load balancer in front of the
+	// backend. It is sent along with the first message (the SSLRequest or,
+	// on plaintext connections, the startup message), which saves a syscall,
+	// and a packet on the wire. The response to the SSLRequest must be read
+	// before the startup message is sent, so that writes can't be coalesced
+	// further.
+	if options.proxyProtocol != nil {
+		wire.pending = encodeProxyProtocolHeader(options.proxyProtocol)
+	}
+	_ = endDial(nil)
+	startedConn, err := finishStartup(ctx, wire, serverAddress, msg, tlsConfig, options)
 	if err != nil {
 		return nil, err
 	}
-	err = relayStartupMsg(conn, msg)
+	if releaseSlot != nil {
+		// The slot is held until the connection is closed.
+		startedConn.(*backendConn).onClose = releaseSlot
+	}
+	return startedConn, nil
+}
+
+// FinishStartup is like FinishStartupContext, with a timeout of 5 seconds.
+func FinishStartup(
+	conn net.Conn, msg *pgproto3.StartupMessage, tlsConfig *tls.Config,
+) (net.Conn, error) {
+	return FinishStartupContext(context.Background(), conn, msg, tlsConfig)
+}
+
+// FinishStartupContext negotiates TLS (or GSSAPI encryption, see
+// GSSEncryption) over conn, an already established connection to a backend,
+// and relays msg to the backend. This is the second half of
+// BackendDialContext, which allows connections that were dialed ahead of time
+// (e.g. pre-warmed in a pool) to be used for a new session. The options which
+// apply to establishing the connection itself (e.g. DialRetry,
+// KeepAlivePeriod, NetDialer or ProxyProtocol) are ignored. If DeriveServerName
+// is specified, the ServerName is derived from the remote address of conn.
+//
+// The returned connection must be used in place of conn, since it may be
+// layered over conn (e.g. when the connection was upgraded to TLS). It
+// supports the same accessors as the connections returned by BackendDial
+// (e.g. BackendTLSState). On failure, conn is left open, but its state is
+// undefined, so it must be closed by the caller.
+func FinishStartupContext(
+	ctx context.Context,
+	conn net.Conn,
+	msg *pgproto3.StartupMessage,
+	tlsConfig *tls.Config,
+	opts ...DialOption,
+) (net.Conn, error) {
+	options := newDialOptions(opts)
+	defer enterDialPhase(options, DialPhaseDone)
+	serverAddress := conn.RemoteAddr().String()
+	defer reportSlowDial(serverAddress, timeutil.Now(), options)
+	tlsConfig, err := resolveTLSConfig(msg, tlsConfig, options)
 	if err != nil {
-		return nil, newErrorf(
+		return nil, labelDialError(err, options.connID)
+	}
+	if err := checkRequireTLS(serverAddress, tlsConfig, options); err != nil {
+		return nil, labelDialError(err, options.connID)
+	}
+	ctx, cancel := withDefaultDialTimeout(ctx)
+	defer cancel()
+	if conn.RemoteAddr().Network() == "unix" && !options.unixSocketTLS {
+		tlsConfig = nil
+	}
+	if options.connID != "" {
+		ctx = logtags.AddTag(ctx, "backend-conn", options.connID)
+	}
+	defer startWireTraceFile(ctx, serverAddress, options)()
+	backendConn, err := finishStartup(
+		ctx, &countingConn{Conn: conn}, serverAddress, msg, tlsConfig, options,
+	)
+	return backendConn, labelDialError(err, options.connID)
+}
+
+// finishStartup implements FinishStartupContext over wire, which wraps the
+// connection to the backend. The connection is not closed on failure.
+func finishStartup(
+	ctx context.Context,
+	wire *countingConn,
+	serverAddress string,
+	msg *pgproto3.StartupMessage,
+	tlsConfig *tls.Config,
+	options *dialOptions,
+) (net.Conn, error) {
+	tcpConn, _ := wire.Conn.(*net.TCPConn)
+	var conn net.Conn = wire
+	tlsCtx, endTLS := startDialPhase(ctx, options, DialPhaseTLSHandshake)
+	encConn, gssAccepted, err := gssOverlay(tlsCtx, conn, options)
+	if err != nil {
+		return nil, endTLS(err)
+	}
+	if !gssAccepted {
+		sslConn := conn
+		var traced *wireTraceConn
+		if tracer := wireTracerFor(options); tracer != nil {
+			traced = &wireTraceConn{Conn: conn, tracer: tracer}
+			sslConn = traced
+		}
+		encConn, err = sslOverlay(tlsCtx, sslConn, serverAddress, tlsConfig, options)
+		if traced != nil {
+			traced.stop()
+			if encConn == sslConn {
+				// No TLS was negotiated.
+				encConn = conn
+			}
+		}
+		if err != nil {
+			return nil, endTLS(err)
+		}
+	}
+	_ = endTLS(nil)
+	conn = encConn
+	switch c := conn.(type) {
+	case *tls.Conn:
+		log.VEventf(ctx, 2, "negotiated TLS (version %#x) with backend SQL server",
+			c.ConnectionState().Version)
+	case *countingConn:
+		log.VEventf(ctx, 2, "using a plaintext connection to backend SQL server")
+	default:
+		log.VEventf(ctx, 2, "negotiated GSSAPI encryption with backend SQL server")
+	}
+	if options.paramAllowlist != nil {
+		if msg, err = options.paramAllowlist.enforce(msg); err != nil {
+			return nil, err
+		}
+	}
+	// With TLS, the backend may legitimately send data once the handshake
+	// completed, such as TLS 1.3 session tickets.
+	if _, plaintext := conn.(*countingConn); plaintext && options.strictStartupOrdering {
+		if err := checkNoPrematureData(
+			conn, serverAddress, "before the StartupMessage was relayed",
+		); err != nil {
+			return nil, err
+		}
+	}
+	relayCtx, endRelay := startDialPhase(ctx, options, DialPhaseRelayingStartup)
+	defer func() { _ = endRelay(nil) }()
+	err = relayStartupMsg(relayCtx, conn, msg, options)
+	if getErrorCode(err) != 0 {
+		// The message was rejected before being relayed.
+		return nil, err
+	} else if isConnClosedError(err) {
+		return nil, endRelay(wrapErrorf(
+			codeBackendClosedDuringStartup, err,
+			"target server %v closed the connection while relaying StartupMessage", serverAddress))
+	} else if err != nil {
+		return nil, endRelay(newErrorf(
 			codeBackendDown, "relaying StartupMessage to target server %v: %v",
-			serverAddress, err)
+			serverAddress, err))
+	}
+	log.VEventf(ctx, 2, "relayed StartupMessage to backend SQL server")
+	tlsConn, _ := conn.(*tls.Conn)
+	if options.peekFirstMessage != nil || options.authTimeout > 0 {
+		if conn, err = awaitFirstMessage(relayCtx, conn, options); err != nil {
+			if isClientCertRejection(err) {
+				// With TLS 1.3, the client certificate is only verified by
+				// the backend after the handshake completed on our end.
+				return nil, wrapErrorf(
+					codeBackendRefusedTLS, err, "target server rejected client certificate",
+				)
+			}
+			if getErrorCode(err) == codeBackendAuthTimeout {
+				return nil, err
+			}
+			return nil, endRelay(newErrorf(
+				codeBackendDown, "reading first message from target server %v: %v",
+				serverAddress, err))
+		}
+	}
+	// The BackendKeyData is inspected above TLS, and above the peeked first
+	// message, which it may follow.
+	if options.observeKeyData != nil {
+		conn = &keyDataConn{Conn: conn, serverAddress: serverAddress, fn: options.observeKeyData}
+	}
+	// The idle timeout is layered above TLS, so that it applies to the
+	// decrypted stream.
+	if options.idleTimeout > 0 {
+		conn = newIdleTimeoutConn(conn, options.idleTimeout)
+	}
+	return &backendConn{
+		Conn: conn, wire: wire, tlsConn: tlsConn, tcpConn: tcpConn, connID: options.connID,
+	}, nil
+}
+
+// unixSocketPrefix is the prefix used to indicate that a backend address
+// refers to a Unix domain socket.
+const unixSocketPrefix = "unix://"
+
+// backendNetworkAddress returns the network and address that should be used
+// to dial the given backend address. Addresses with a "unix://" prefix, and
+// absolute paths, refer to Unix domain sockets.
+func backendNetworkAddress(serverAddress string) (network, address string) {
+	if strings.HasPrefix(serverAddress, unixSocketPrefix) {
+		return "unix", strings.TrimPrefix(serverAddress, unixSocketPrefix)
+	}
+	if filepath.IsAbs(serverAddress) {
+		return "unix", serverAddress
+	}
+	return "tcp", serverAddress
+}
+
+// happyEyeballsFallbackDelay is the head start given to connection attempts
+// to the preferred address family before racing attempts to the other address
+// family, as recommended by RFC 8305 ("Connection Attempt Delay").
+const happyEyeballsFallbackDelay = 250 * time.Millisecond
+
+// newBackendDialer returns the net.Dialer used to connect to backends, which
+// is options.netDialer if it was set.
+//
+// For backends with both A and AAAA records, the dialer implements Happy
+// Eyeballs: the host is resolved, and connection attempts to IPv6 and IPv4
+// addresses are raced, with the first address family getting a head start of
+// happyEyeballsFallbackDelay. The first connection to succeed is used, so a
+// dead address of one family does not stall the dial until the timeout fires.
+// If all candidate addresses fail, the error of the first attempt is returned.
+//
+// If DialAddressFilter is set, every address is checked against it right
+// before the dialer connects to it.
+func newBackendDialer(options *dialOptions) *net.Dialer {
+	dialer := options.netDialer
+	if dialer == nil {
+		dialer = &net.Dialer{FallbackDelay: happyEyeballsFallbackDelay}
+	}
+	if filter := DialAddressFilter; filter != nil {
+		// Copy the dialer, which may have been supplied through NetDialer.
+		filtered := *dialer
+		filtered.Control = filter.control(dialer.Control)
+		dialer = &filtered
+	}
+	return dialer
+}
+
+// dialBackendConn establishes a connection to the backend, through the HTTP
+// proxy if one was configured (see HTTPConnectProxy).
+func dialBackendConn(
+	ctx context.Context, network, address string, options *dialOptions,
+) (net.Conn, error) {
+	if options.httpProxy != nil && network == "tcp" {
+		return dialHTTPProxy(ctx, address, options.httpProxy, options)
+	}
+	if options.socksProxy != nil && network == "tcp" {
+		return dialSOCKS5Proxy(ctx, address, options.socksProxy, options)
+	}
+	return dialTCPConn(ctx, network, address, options)
+}
+
+// dialTCPConn establishes a connection to address, retrying transient failures
+// if options.retryOpts is set.
+func dialTCPConn(
+	ctx context.Context, network, address string, options *dialOptions,
+) (net.Conn, error) {
+	if network == "tcp" && options.network != "" {
+		network = options.network
+	}
+	dialer := newBackendDialer(options)
+	dial := dialer.DialContext
+	if cache := DialDNSCache; cache != nil {
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return cache.dialContext(ctx, dialer, network, address)
+		}
+	}
+	if timeout := options.connectTimeout; timeout > 0 {
+		dialAttempt := dial
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			ctx, cancel := withClockTimeout(ctx, timeout)
+			defer cancel()
+			return dialAttempt(ctx, network, address)
+		}
+	}
+	if options.retryOpts == nil {
+		return dial(ctx, network, address)
+	}
+	err := errors.New("no dial attempts were made")
+	for r := retry.StartWithCtx(ctx, *options.retryOpts); r.Next(); {
+		var conn net.Conn
+		conn, err = dial(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		if !isRetriableDialError(err) {
+			break
+		}
+	}
+	return nil, err
+}
+
+// newConnectError returns the error of a failed attempt to connect to the
+// backend: a codeBackendDown error, unless the proxy ran out of file
+// descriptors, which results in a codeProxyResourceExhausted error so that
+// the proxy is not mistaken for a backend outage.
+func newConnectError(err error) error {
+	if errors.IsAny(err, syscall.EMFILE, syscall.ENFILE) {
+		return wrapErrorf(
+			codeProxyResourceExhausted, err,
+			"unable to reach backend SQL server: the proxy ran out of file descriptors; "+
+				"consider raising the limit on open files of the proxy process (e.g. ulimit -n)",
+		)
 	}
-	return conn, nil
+	return newErrorf(codeBackendDown, "unable to reach backend SQL server: %v", err)
+}
+
+// isRetriableDialError returns true if err is a dial error that may succeed
+// if retried, i.e. the connection was refused or timed out.
+func isRetriableDialError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// configureTCPConn applies the TCP-level options to a backend connection.
+func configureTCPConn(conn *net.TCPConn, options *dialOptions) error {
+	// Go already sets TCP_NODELAY on the connections it establishes, but we
+	// don't rely on it, since it is the default which matters most for the
+	// latency of queries.
+	if err := conn.SetNoDelay(!options.nagle); err != nil {
+		return err
+	}
+	if options.keepAlivePeriod < 0 {
+		return conn.SetKeepAlive(false)
+	}
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return conn.SetKeepAlivePeriod(options.keepAlivePeriod)
 }
 
 // sslOverlay attempts to upgrade the PG connection to use SSL if a tls.Config
-// is specified.
-func sslOverlay(conn net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
+// is specified. The SSLRequest exchange is bounded by ctx, so a backend that
+// accepts the TCP connection but never responds cannot block the caller
+// indefinitely.
+//
+// If the backend refuses the SSLRequest, a codeBackendRefusedTLS error is
+// returned, unless opts.preferTLS is set, in which case the original
+// connection is returned as is. The refusal is a single byte which
+// has already been consumed, so the connection can be used to relay the
+// startup message in plaintext. If the backend responds with an ErrorResponse
+// instead, e.g. because it is shutting down, a codeBackendDown error carrying
+// the message and SQLSTATE code of the error is returned, even if
+// opts.preferTLS is set.
+//
+// If opts.deriveServerName is set, and tlsConfig has no ServerName, the
+// ServerName is derived from serverAddress.
+//
+// The TLS handshake is performed before returning, rather than lazily on the
+// first write, so that the negotiated connection state is available to callers
+// (see BackendTLSState) once the dial completes, and so that handshake
+// failures (e.g. certificate verification failures) can be reported as
+// codeBackendTLSHandshakeFailed errors, distinct from refusals.
+func sslOverlay(
+	ctx context.Context,
+	conn net.Conn,
+	serverAddress string,
+	tlsConfig *tls.Config,
+	opts *dialOptions,
+) (net.Conn, error) {
 	if tlsConfig == nil {
 		return conn, nil
 	}
 
+	stop := watchConnContext(ctx, conn)
+	defer stop()
+
 	var err error
 	// Send SSLRequest.
 	if err := binary.Write(conn, binary.BigEndian, pgSSLRequest); err != nil {
@@ -77,21 +1219,342 @@ func sslOverlay(conn net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
 	response := make([]byte, 1)
 	if _, err = io.ReadFull(conn, response); err != nil {
 		return nil,
-			newErrorf(codeBackendDown, "reading response to SSLRequest")
+			newErrorf(codeBackendDown, "reading response to SSLRequest: %v", err)
 	}
 
+	if response[0] == pgErrorResponse {
+		return nil, sslErrorResponse(conn, response[0])
+	}
 	if response[0] != pgAcceptSSLRequest {
+		if observer := TLSRefusalObserver; observer != nil {
+			observer(ctx, TLSRefusalEvent{
+				ServerAddress: serverAddress,
+				ServerNameSet: tlsConfig.ServerName != "" || opts.deriveServerName,
+				Response:      response[0],
+				FellBack:      opts.preferTLS,
+			})
+		}
+		if opts.preferTLS {
+			return conn, nil
+		}
 		return nil, newErrorf(
 			codeBackendRefusedTLS, "target server refused TLS connection",
 		)
 	}
 
+	if opts.strictStartupOrdering {
+		if err := checkNoPrematureData(
+			conn, serverAddress, "after accepting the SSLRequest",
+		); err != nil {
+			return nil, err
+		}
+	}
+	outCfg, err := backendTLSConfig(serverAddress, tlsConfig, opts)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, outCfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		// Timeouts and cancellations indicate that the backend did not
+		// respond in time, rather than a TLS incompatibility.
+		var netErr net.Error
+		if ctx.Err() != nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return nil, wrapErrorf(codeBackendDown, err, "TLS handshake with target server")
+		}
+		if isClientCertRejection(err) {
+			return nil, wrapErrorf(
+				codeBackendRefusedTLS, err, "target server rejected client certificate",
+			)
+		}
+		return nil, wrapErrorf(codeBackendTLSHandshakeFailed, err, "TLS handshake with target server")
+	}
+	if opts.requireALPN && tlsConn.ConnectionState().NegotiatedProtocol == "" {
+		return nil, newErrorf(
+			codeBackendTLSHandshakeFailed, "target server did not negotiate any of protocols %v",
+			outCfg.NextProtos,
+		)
+	}
+	return tlsConn, nil
+}
+
+// backendTLSConfig returns the tls.Config used for the TLS handshake with the
+// backend at serverAddress: a clone of tlsConfig, completed according to opts.
+// tlsConfig itself is never modified.
+func backendTLSConfig(
+	serverAddress string, tlsConfig *tls.Config, opts *dialOptions,
+) (*tls.Config, error) {
 	outCfg := tlsConfig.Clone()
-	return tls.Client(conn, outCfg), nil
+	if opts.deriveServerName && outCfg.ServerName == "" {
+		// serverAddress may omit the port, so we use an empty string as the
+		// default port since we only care about extracting the host.
+		host, _, err := addr.SplitHostPort(serverAddress, "" /* defaultPort */)
+		if err != nil {
+			return nil, newErrorf(
+				codeBackendTLSHandshakeFailed, "deriving TLS server name from %s: %v", serverAddress, err,
+			)
+		}
+		outCfg.ServerName = host
+	}
+	if opts.minTLSVersion != 0 && outCfg.MinVersion == 0 {
+		outCfg.MinVersion = opts.minTLSVersion
+	}
+	if opts.nextProtos != nil {
+		outCfg.NextProtos = opts.nextProtos
+	}
+	if outCfg.ClientSessionCache == nil {
+		outCfg.ClientSessionCache = BackendTLSSessionCache
+	}
+	if opts.getClientCert != nil {
+		outCfg.GetClientCertificate = opts.getClientCert
+	}
+	if policy := InsecureSkipVerifyPolicy; policy != nil {
+		outCfg.InsecureSkipVerify = policy(serverAddress)
+	}
+	// Backends must never be allowed to renegotiate the TLS session. This is
+	// the zero value, and thus already the default of the tls package, but it
+	// is set explicitly to guard against configuration drift. An explicit
+	// setting of the caller is preserved.
+	if outCfg.Renegotiation == 0 {
+		outCfg.Renegotiation = tls.RenegotiateNever
+	}
+	return outCfg, nil
+}
+
+// sslErrorResponse reads the ErrorResponse which the backend sent in response
+// to the SSLRequest, whose type byte was already read, and returns a
+// codeBackendDown error which carries the message and SQLSTATE code of the
+// backend's error.
+func sslErrorResponse(conn net.Conn, typ byte) error {
+	raw, err := readBackendMessage(io.MultiReader(bytes.NewReader([]byte{typ}), conn))
+	if err != nil {
+		return newErrorf(codeBackendDown, "reading error response to SSLRequest: %v", err)
+	}
+	msg, err := decodeBackendMessage(raw)
+	if err != nil {
+		return newErrorf(codeBackendDown, "decoding error response to SSLRequest: %v", err)
+	}
+	errResp, ok := msg.(*pgproto3.ErrorResponse)
+	if !ok {
+		return newErrorf(codeBackendDown, "unexpected response to SSLRequest: %T", msg)
+	}
+	return newErrorf(
+		codeBackendDown, "target server responded to SSLRequest with an error: %s (SQLSTATE %s)",
+		errResp.Message, errResp.Code,
+	)
+}
+
+// BackendTLSState returns the TLS connection state negotiated with the
+// backend, if conn was returned by BackendDial and the connection was upgraded
+// to TLS. This can be used to inspect the negotiated TLS version and cipher
+// suite. The returned state is always populated since the dialer performs the
+// TLS handshake before returning.
+func BackendTLSState(conn net.Conn) (*tls.ConnectionState, bool) {
+	c, ok := asBackendConn(conn)
+	if !ok || c.tlsConn == nil {
+		return nil, false
+	}
+	state := c.tlsConn.ConnectionState()
+	return &state, true
+}
+
+// BackendPeerCertificates returns the certificate chain presented by the
+// backend during the TLS handshake, leaf first, if conn was returned by
+// BackendDial and the connection was upgraded to TLS, e.g. to monitor the
+// expiry and issuer of backend certificates. The dialer completes the
+// handshake before returning the connection, so the chain is always available;
+// it is returned whether or not it was verified (see InsecureSkipVerify). An
+// error is returned if conn was not upgraded to TLS.
+func BackendPeerCertificates(conn net.Conn) ([]*x509.Certificate, error) {
+	c, ok := asBackendConn(conn)
+	if !ok {
+		return nil, errors.Newf("connection of type %T was not returned by BackendDial", conn)
+	}
+	if c.tlsConn == nil {
+		return nil, errors.New("connection to backend is not a TLS connection")
+	}
+	state := c.tlsConn.ConnectionState()
+	if !state.HandshakeComplete {
+		return nil, errors.New("TLS handshake with backend is not complete")
+	}
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.New("backend did not present any certificate")
+	}
+	return state.PeerCertificates, nil
 }
 
-// relayStartupMsg forwards the start message on the backend connection.
-func relayStartupMsg(conn net.Conn, msg *pgproto3.StartupMessage) (err error) {
-	_, err = conn.Write(msg.Encode(nil))
-	return
+// relayStartupMsg forwards the start message on the backend connection, after
+// applying StartupParamRewriter and the compression policy. The write is
+// bounded by ctx, so a backend which stops reading (e.g. because its receive
+// buffer is full) cannot block the caller indefinitely once the connection is
+// established. If the message is rejected by checkStartupMsg, nothing is
+// written, and the returned error has an error code attached. Errors writing
+// the message, including short writes, don't.
+func relayStartupMsg(
+	ctx context.Context, conn net.Conn, msg *pgproto3.StartupMessage, opts *dialOptions,
+) (err error) {
+	msg = rewriteStartupMsg(msg)
+	msg = applyCompressionPolicy(msg, opts.compressionPolicy)
+	msg = injectStartupParam(msg, opts.clientAddrParam)
+	if err := checkStartupMsg(msg, opts); err != nil {
+		return err
+	}
+	stop := watchConnContext(ctx, conn)
+	defer stop()
+	buf := startupMsgBufPool.Get().(*[]byte)
+	defer putStartupMsgBuf(buf)
+	*buf = msg.Encode((*buf)[:0])
+	n, err := conn.Write(*buf)
+	if err == nil && n != len(*buf) {
+		// net.Conn implementations must return an error on short writes,
+		// but wrappers don't always honor that. Relaying a truncated
+		// message would result in a cryptic error from the backend.
+		err = errors.Wrapf(io.ErrShortWrite, "wrote %d of %d bytes", n, len(*buf))
+	}
+	if tracer := wireTracerFor(opts); tracer != nil && n > 0 {
+		tracer(DirectionSent, (*buf)[:n])
+	}
+	return err
+}
+
+// isConnClosedError returns whether err indicates that the peer closed or
+// reset the connection, rather than e.g. a timeout.
+func isConnClosedError(err error) bool {
+	return errors.IsAny(err, io.EOF, io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.EPIPE)
+}
+
+// maxPooledStartupMsgBufSize is the maximum capacity of the buffers which are
+// returned to startupMsgBufPool, so that an unusually large startup message
+// doesn't pin a large buffer.
+const maxPooledStartupMsgBufSize = DefaultMaxStartupMessageSize
+
+// startupMsgBufPool pools the buffers used by relayStartupMsg to encode startup
+// messages, so that relaying a message doesn't allocate at high connection
+// rates. Pointers to slices are pooled, to avoid allocating when putting a
+// slice back.
+var startupMsgBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+// putStartupMsgBuf returns buf to startupMsgBufPool. The encoded message is
+// cleared since the startup parameters may contain sensitive options.
+func putStartupMsgBuf(buf *[]byte) {
+	if cap(*buf) > maxPooledStartupMsgBufSize {
+		return
+	}
+	b := *buf
+	for i := range b {
+		b[i] = 0
+	}
+	*buf = b[:0]
+	startupMsgBufPool.Put(buf)
+}
+
+// ValidateStartupMessage validates msg as the dialer does before relaying it
+// to the backend with the default options, without touching the network. See
+// checkStartupMsg for the errors which may be returned. It is meant to harden
+// the proxy against malformed startup messages independently of the
+// transport, e.g. through fuzzing.
+func ValidateStartupMessage(msg *pgproto3.StartupMessage) error {
+	return checkStartupMsg(msg, newDialOptions(nil))
+}
+
+// checkStartupMsg validates msg before it is relayed to the backend. If the
+// protocol version of msg is not accepted (see AcceptedProtocolVersions), a
+// codeUnsupportedProtocolVersion error is returned. If a parameter can't be
+// encoded faithfully, since its name is empty or it contains null bytes, which
+// would let a client smuggle additional parameters past StartupParamAllowlist,
+// a codeInvalidStartupParams error is returned. If the encoded message is
+// larger than the maximum size (see MaxStartupMessageSize), a
+// codeClientStartupTooLarge error is returned.
+func checkStartupMsg(msg *pgproto3.StartupMessage, opts *dialOptions) error {
+	if msg == nil {
+		return newErrorf(codeUnexpectedStartupMessage, "missing startup message")
+	}
+	versions := opts.protocolVersions
+	if versions == nil {
+		versions = []uint32{pgproto3.ProtocolVersionNumber}
+	}
+	accepted := false
+	for _, v := range versions {
+		accepted = accepted || v == msg.ProtocolVersion
+	}
+	if !accepted {
+		return newErrorf(
+			codeUnsupportedProtocolVersion, "unsupported frontend protocol %d.%d",
+			msg.ProtocolVersion>>16, msg.ProtocolVersion&0xffff,
+		)
+	}
+	for k, v := range msg.Parameters {
+		if k == "" {
+			return newErrorf(codeInvalidStartupParams, "startup parameter with empty name")
+		}
+		if strings.IndexByte(k, 0) >= 0 || strings.IndexByte(v, 0) >= 0 {
+			return newErrorf(
+				codeInvalidStartupParams, "startup parameter %q contains a null byte", k,
+			)
+		}
+	}
+	if size := startupMsgSize(msg); opts.maxStartupMsgSize > 0 && size > opts.maxStartupMsgSize {
+		return newErrorf(
+			codeClientStartupTooLarge, "startup message of %d bytes exceeds the maximum of %d bytes",
+			size, opts.maxStartupMsgSize,
+		)
+	}
+	return nil
+}
+
+// startupMsgSize returns the size of the encoding of msg, without encoding it.
+func startupMsgSize(msg *pgproto3.StartupMessage) int {
+	// The length and protocol version, followed by the null-terminated keys
+	// and values, and a final null byte.
+	size := 4 + 4 + 1
+	for k, v := range msg.Parameters {
+		size += len(k) + 1 + len(v) + 1
+	}
+	return size
+}
+
+// withDefaultDialTimeout returns a context with a timeout of
+// defaultBackendDialTimeout, measured by timeSource, if ctx has no deadline.
+// Otherwise, ctx is returned as is.
+func withDefaultDialTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return withClockTimeout(ctx, defaultBackendDialTimeout)
+}
+
+// watchConnContext sets the deadline of conn to the deadline of ctx, and
+// interrupts any blocked I/O on conn if ctx is canceled. The returned function
+// must be called once the I/O has completed; it stops watching ctx and clears
+// the deadline on conn so that it does not affect subsequent I/O.
+func watchConnContext(ctx context.Context, conn net.Conn) (stop func()) {
+	// Deadlines of contexts which are driven by a testing clock are not
+	// wall clock times, so I/O is only interrupted once ctx is done.
+	if deadline, ok := ctx.Deadline(); ok && usingRealClock() {
+		_ = conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	if ctx.Done() != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-ctx.Done():
+				// Setting a deadline in the past unblocks pending reads and
+				// writes.
+				_ = conn.SetDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+	}
+	return func() {
+		close(done)
+		wg.Wait()
+		_ = conn.SetDeadline(time.Time{})
+	}
 }
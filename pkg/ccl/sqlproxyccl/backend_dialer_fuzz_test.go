@@ -0,0 +1,52 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+// Native fuzzing requires Go 1.18.
+
+//go:build go1.18
+// +build go1.18
+
+package sqlproxyccl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// FuzzValidateStartupMessage checks that startup messages which are accepted
+// by ValidateStartupMessage are relayed faithfully, i.e. that their encoding
+// decodes to the same message, and fits within the default maximum size.
+func FuzzValidateStartupMessage(f *testing.F) {
+	f.Add(uint32(pgproto3.ProtocolVersionNumber), "application_name", "psql")
+	f.Add(uint32(pgproto3.ProtocolVersionNumber), "options", "--cluster=happy-koala")
+	f.Add(uint32(pgproto3.ProtocolVersionNumber), "", "root")
+	f.Add(uint32(pgproto3.ProtocolVersionNumber), "user\x00database", "root")
+	f.Add(uint32(pgproto3.ProtocolVersionNumber), "options", "x\x00database\x00system")
+	f.Add(uint32(pgproto3.ProtocolVersionNumber), "options", strings.Repeat("x", DefaultMaxStartupMessageSize))
+	f.Add(uint32(2<<16), "user", "root")
+	f.Add(uint32(80877103) /* SSLRequest */, "user", "root")
+
+	f.Fuzz(func(t *testing.T, version uint32, key, value string) {
+		msg := testStartupMessage()
+		msg.ProtocolVersion = version
+		msg.Parameters[key] = value
+		if err := ValidateStartupMessage(msg); err != nil {
+			require.NotZero(t, getErrorCode(err), "%v", err)
+			return
+		}
+		buf := msg.Encode(nil)
+		require.Len(t, buf, startupMsgSize(msg))
+		require.LessOrEqual(t, len(buf), DefaultMaxStartupMessageSize)
+		decoded := &pgproto3.StartupMessage{}
+		require.NoError(t, decoded.Decode(buf[4:]))
+		require.Equal(t, msg, decoded)
+	})
+}
@@ -0,0 +1,1803 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestBackend starts a listener on a loopback address, and invokes
+// handler for every accepted connection. The returned stop function closes
+// the listener and waits for all handlers to return.
+func startTestBackend(
+	t testing.TB, handler func(conn net.Conn),
+) (addr string, stop func()) {
+	return startTestBackendOn(t, "tcp", "127.0.0.1:0", handler)
+}
+
+// unusedTCPAddr returns a loopback address which nothing is listening on.
+func unusedTCPAddr(t testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+	return addr
+}
+
+// startTestBackendOn is like startTestBackend, but listens on the given
+// network and address.
+func startTestBackendOn(
+	t testing.TB, network, address string, handler func(conn net.Conn),
+) (addr string, stop func()) {
+	ln, err := net.Listen(network, address)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() {
+		_ = ln.Close()
+		wg.Wait()
+	}
+}
+
+// receiveStartupMessage reads a StartupMessage from the given connection.
+func receiveStartupMessage(conn net.Conn) (*pgproto3.StartupMessage, error) {
+	be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	msg, err := be.ReceiveStartupMessage()
+	if err != nil {
+		return nil, err
+	}
+	startup, ok := msg.(*pgproto3.StartupMessage)
+	if !ok {
+		return nil, errors.Newf("unexpected message type %T", msg)
+	}
+	return startup, nil
+}
+
+func testStartupMessage() *pgproto3.StartupMessage {
+	return &pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "root", "database": "defaultdb"},
+	}
+}
+
+func TestBackendDialContext(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	t.Run("relays startup message", func(t *testing.T) {
+		msgCh := make(chan *pgproto3.StartupMessage, 1)
+		addr, stop := startTestBackend(t, func(conn net.Conn) {
+			if msg, err := receiveStartupMessage(conn); err == nil {
+				msgCh <- msg
+			}
+		})
+		defer stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		conn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		msg := <-msgCh
+		require.Equal(t, testStartupMessage(), msg)
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		addr, stop := startTestBackend(t, func(conn net.Conn) {})
+		defer stop()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		conn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+		require.Nil(t, conn)
+		require.Error(t, err)
+
+		var codeErr *codeError
+		require.True(t, errors.As(err, &codeErr))
+		require.Equal(t, codeBackendDown, codeErr.code)
+	})
+}
+
+func TestSSLRequestEncoding(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, pgSSLRequest))
+	require.Equal(t, (&pgproto3.SSLRequest{}).Encode(nil), buf.Bytes())
+}
+
+func TestSSLOverlayTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The backend accepts the connection, but never responds to the
+	// SSLRequest.
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	conn, err := BackendDialContext(ctx, testStartupMessage(), addr, &tls.Config{})
+	require.Nil(t, conn)
+	require.Error(t, err)
+	require.Regexp(t, "reading response to SSLRequest", err)
+
+	var codeErr *codeError
+	require.True(t, errors.As(err, &codeErr))
+	require.Equal(t, codeBackendDown, codeErr.code)
+}
+
+func TestRelayStartupMsgTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The backend accepts the connection, but never reads from it.
+	release := make(chan struct{})
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		<-release
+	})
+	defer stop()
+	defer close(release)
+
+	// The startup message is larger than the socket buffers, so that writing
+	// it blocks.
+	msg := testStartupMessage()
+	msg.Parameters["options"] = strings.Repeat("x", 64<<20)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	conn, err := BackendDialContext(
+		ctx, msg, addr, nil /* tlsConfig */, MaxStartupMessageSize(0),
+	)
+	require.Nil(t, conn)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.Regexp(t, "relaying StartupMessage", err)
+}
+
+// failingWriteConn is a net.Conn whose writes fail.
+type failingWriteConn struct {
+	net.Conn
+	err error
+}
+
+func (c failingWriteConn) Write([]byte) (int, error) { return 0, c.err }
+
+// discardConn is a net.Conn which discards writes.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func TestRelayStartupMsgPooledBuffer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	skip.UnderRace(t, "sync.Pool randomly drops buffers under the race detector")
+
+	ctx := context.Background()
+	opts := newDialOptions(nil)
+	msg := testStartupMessage()
+	msg.Parameters["options"] = strings.Repeat("x", 4<<10)
+
+	// The buffer is returned to the pool even if the write fails, so relaying
+	// the message doesn't allocate a buffer for it.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	writeErr := errors.New("write failed")
+	conn := failingWriteConn{Conn: client, err: writeErr}
+	require.True(t, errors.Is(relayStartupMsg(ctx, conn, msg, opts), writeErr))
+	res := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = relayStartupMsg(ctx, conn, msg, opts)
+		}
+	})
+	require.Less(t, res.AllocedBytesPerOp(), int64(startupMsgSize(msg)))
+}
+
+// shortWriteConn is a net.Conn which only writes half of the bytes, without
+// returning an error.
+type shortWriteConn struct {
+	net.Conn
+}
+
+func (c shortWriteConn) Write(b []byte) (int, error) {
+	return c.Conn.Write(b[:len(b)/2])
+}
+
+func TestRelayStartupMsgShortWrite(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+
+	_, err := FinishStartupContext(
+		context.Background(), shortWriteConn{Conn: client}, testStartupMessage(), nil, /* tlsConfig */
+	)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.Regexp(t, "relaying StartupMessage .* wrote 19 of 38 bytes: short write", err)
+}
+
+func BenchmarkRelayStartupMsg(b *testing.B) {
+	ctx := context.Background()
+	opts := newDialOptions(nil)
+	msg := testStartupMessage()
+	msg.Parameters["application_name"] = "benchmark"
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := discardConn{Conn: client}
+
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			// This is the implementation of relayStartupMsg before buffers
+			// were pooled.
+			m := rewriteStartupMsg(msg)
+			if err := checkStartupMsg(m, opts); err != nil {
+				b.Fatal(err)
+			}
+			stop := watchConnContext(ctx, conn)
+			_, err := conn.Write(m.Encode(nil))
+			stop()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := relayStartupMsg(ctx, conn, msg, opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkBackendDial measures complete dials, i.e. the negotiation of TLS
+// through sslOverlay and the relay of the startup message, over in-memory and
+// loopback connections. It establishes a baseline to check changes to the dial
+// path for regressions, e.g. by comparing the output of:
+//
+//	go test ./pkg/ccl/sqlproxyccl -run - -bench BenchmarkBackendDial -benchmem -count 10
+//
+// before and after the change with benchstat.
+func BenchmarkBackendDial(b *testing.B) {
+	ctx := context.Background()
+	msg := testStartupMessage()
+	serverCfg, err := tlsConfig()
+	require.NoError(b, err)
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	// serve is the server side of a dial.
+	serve := func(conn net.Conn, tlsConfig *tls.Config) {
+		if tlsConfig != nil {
+			tlsConn, err := acceptSSLRequest(conn, tlsConfig)
+			if err != nil {
+				return
+			}
+			conn = tlsConn
+		}
+		_, _ = receiveStartupMessage(conn)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		serverCfg *tls.Config
+		clientCfg *tls.Config
+	}{
+		{"plaintext", nil, nil},
+		{"tls", serverCfg, clientCfg},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			// The pipe sub-benchmark isolates the dialer from the network
+			// stack, by finishing the startup over net.Pipe.
+			b.Run("pipe", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					client, server := net.Pipe()
+					done := make(chan struct{})
+					go func() {
+						defer close(done)
+						serve(server, tc.serverCfg)
+					}()
+					conn, err := FinishStartupContext(ctx, client, msg, tc.clientCfg)
+					if err != nil {
+						b.Fatal(err)
+					}
+					// Close the server side first, since closing a TLS
+					// connection sends an alert which the server doesn't read.
+					<-done
+					_ = server.Close()
+					_ = conn.Close()
+				}
+			})
+			b.Run("loopback", func(b *testing.B) {
+				addr, stop := startTestBackend(b, func(conn net.Conn) {
+					serve(conn, tc.serverCfg)
+				})
+				defer stop()
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					conn, err := BackendDialContext(ctx, msg, addr, tc.clientCfg)
+					if err != nil {
+						b.Fatal(err)
+					}
+					_ = conn.Close()
+				}
+			})
+		})
+	}
+}
+
+func TestBackendDialMaxStartupMessageSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		if msg, err := receiveStartupMessage(conn); err == nil {
+			msgCh <- msg
+		}
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	msg := testStartupMessage()
+	msg.Parameters["options"] = strings.Repeat("x", DefaultMaxStartupMessageSize)
+	require.Equal(t, len(msg.Encode(nil)), startupMsgSize(msg))
+
+	// The default limit rejects the message before relaying it.
+	conn, err := BackendDialContext(ctx, msg, addr, nil /* tlsConfig */)
+	require.Nil(t, conn)
+	require.Equal(t, codeClientStartupTooLarge, getErrorCode(err))
+	require.Regexp(t, "exceeds the maximum of 10240 bytes", err)
+	select {
+	case <-msgCh:
+		t.Fatal("unexpected startup message")
+	default:
+	}
+
+	// The limit can be configured.
+	msg.Parameters["options"] = strings.Repeat("x", 1000)
+	_, err = BackendDialContext(
+		ctx, msg, addr, nil /* tlsConfig */, MaxStartupMessageSize(1000),
+	)
+	require.Equal(t, codeClientStartupTooLarge, getErrorCode(err))
+	conn, err = BackendDialContext(
+		ctx, msg, addr, nil /* tlsConfig */, MaxStartupMessageSize(2000),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, msg, <-msgCh)
+}
+
+func TestFinishStartup(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		if msg, err := receiveStartupMessage(tlsConn); err == nil {
+			msgCh <- msg
+		}
+	})
+	defer stop()
+
+	// The connection is established ahead of time.
+	rawConn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer rawConn.Close()
+
+	conn, err := FinishStartup(rawConn, testStartupMessage(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, testStartupMessage(), <-msgCh)
+	_, isTLS := BackendTLSState(conn)
+	require.True(t, isTLS)
+	tcpConn, ok := BackendTCPConn(conn)
+	require.True(t, ok)
+	require.True(t, tcpConn == rawConn)
+
+	// On failure, the connection is left open.
+	refusing, err := newTestBackend(nil /* serverTLSConfig */)
+	require.NoError(t, err)
+	defer refusing.Close()
+	rawConn, err = net.Dial("tcp", refusing.Addr())
+	require.NoError(t, err)
+	defer rawConn.Close()
+	conn, err = FinishStartup(rawConn, testStartupMessage(), &tls.Config{})
+	require.Nil(t, conn)
+	require.Equal(t, codeBackendRefusedTLS, getErrorCode(err))
+	require.NoError(t, rawConn.Close())
+}
+
+func TestBackendDialProtocolVersion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		if msg, err := receiveStartupMessage(conn); err == nil {
+			msgCh <- msg
+		}
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Version 3.1, which is not accepted by default.
+	const version31 = 3<<16 | 1
+	msg := testStartupMessage()
+	msg.ProtocolVersion = version31
+	conn, err := BackendDialContext(ctx, msg, addr, nil /* tlsConfig */)
+	require.Nil(t, conn)
+	require.Equal(t, codeUnsupportedProtocolVersion, getErrorCode(err))
+	require.Regexp(t, "unsupported frontend protocol 3.1", err)
+
+	// The accepted versions can be configured.
+	opt := AcceptedProtocolVersions(pgproto3.ProtocolVersionNumber, version31)
+	conn, err = BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */, opt)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Equal(t, testStartupMessage(), <-msgCh)
+
+	_, err = BackendDialContext(
+		ctx, testStartupMessage(), addr, nil /* tlsConfig */, AcceptedProtocolVersions(version31),
+	)
+	require.Equal(t, codeUnsupportedProtocolVersion, getErrorCode(err))
+}
+
+func TestBackendDialPreferTLS(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The backend refuses TLS, and then expects a plaintext startup message.
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		if _, err := conn.Write([]byte{'N'}); err != nil {
+			return
+		}
+		if msg, err := receiveStartupMessage(conn); err == nil {
+			msgCh <- msg
+		}
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Without PreferTLS, the refusal is an error.
+	conn, err := BackendDialContext(ctx, testStartupMessage(), addr, &tls.Config{})
+	require.Nil(t, conn)
+	var codeErr *codeError
+	require.True(t, errors.As(err, &codeErr))
+	require.Equal(t, codeBackendRefusedTLS, codeErr.code)
+
+	// With PreferTLS, the dialer falls back to plaintext.
+	conn, err = BackendDialContext(
+		ctx, testStartupMessage(), addr, &tls.Config{}, PreferTLS(),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, isTLS := BackendTLSState(conn)
+	require.False(t, isTLS)
+	require.Equal(t, testStartupMessage(), <-msgCh)
+}
+
+func TestBackendDialSlowDialThreshold(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The backend takes its time to respond to the SSLRequest, and refuses
+	// TLS.
+	const delay = 50 * time.Millisecond
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		time.Sleep(delay)
+		_, _ = conn.Write([]byte{'N'})
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var slow []time.Duration
+	onSlowDial := func(serverAddress string, elapsed time.Duration) {
+		require.Equal(t, addr, serverAddress)
+		slow = append(slow, elapsed)
+	}
+
+	// The callback fires for failed and successful dials.
+	_, err := BackendDialContext(
+		ctx, testStartupMessage(), addr, &tls.Config{},
+		SlowDialThreshold(delay/2, onSlowDial),
+	)
+	require.Equal(t, codeBackendRefusedTLS, getErrorCode(err))
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), addr, &tls.Config{}, PreferTLS(),
+		SlowDialThreshold(delay/2, onSlowDial),
+	)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Len(t, slow, 2)
+	for _, elapsed := range slow {
+		require.True(t, elapsed >= delay, elapsed)
+	}
+
+	// It also fires when finishing the startup of an established connection.
+	rawConn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer rawConn.Close()
+	conn, err = FinishStartupContext(
+		ctx, rawConn, testStartupMessage(), &tls.Config{}, PreferTLS(),
+		SlowDialThreshold(delay/2, onSlowDial),
+	)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Len(t, slow, 3)
+
+	// Dials within the threshold don't fire the callback.
+	conn, err = BackendDialContext(
+		ctx, testStartupMessage(), addr, &tls.Config{}, PreferTLS(),
+		SlowDialThreshold(time.Hour, onSlowDial),
+	)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Len(t, slow, 3)
+}
+
+func TestBackendDialSSLErrorResponse(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The backend responds to the SSLRequest with an ErrorResponse.
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+		_ = be.Send(&pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     "53300",
+			Message:  "sorry, too many clients already",
+		})
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The error is reported as is, rather than as a refusal, even with
+	// PreferTLS.
+	for _, opts := range [][]DialOption{nil, {PreferTLS()}} {
+		conn, err := BackendDialContext(ctx, testStartupMessage(), addr, &tls.Config{}, opts...)
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Regexp(t, `target server responded to SSLRequest with an error: `+
+			`sorry, too many clients already \(SQLSTATE 53300\)`, err)
+	}
+}
+
+func TestDialObserver(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var calls []string
+	defer testutils.TestingHook(&DialObserver, func(
+		serverAddress string, d time.Duration, err error,
+	) {
+		require.True(t, d > 0)
+		calls = append(calls, DialErrorCode(err))
+	})()
+
+	// The backend always refuses TLS.
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{'N'})
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	defer stop()
+
+	ctx := context.Background()
+	_, err := BackendDialContext(ctx, testStartupMessage(), addr, &tls.Config{})
+	require.Error(t, err)
+	conn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	require.Equal(t, []string{"codeBackendRefusedTLS", ""}, calls)
+}
+
+func TestBackendDialTracing(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, tlsConn)
+	})
+	defer stop()
+
+	tr := tracing.NewTracer()
+
+	t.Run("success", func(t *testing.T) {
+		ctx, getRec := tracing.ContextWithRecordingSpan(context.Background(), tr, "test")
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, &tls.Config{InsecureSkipVerify: true},
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		rec := getRec()
+		sp, ok := rec.FindSpan(backendDialSpanName)
+		require.True(t, ok)
+		require.Equal(t, addr, sp.Tags["server_address"])
+		require.Equal(t, "ok", sp.Tags["outcome"])
+		require.Equal(t, "true", sp.Tags["tls"])
+		require.Equal(t, addr, sp.Tags["remote_addr"])
+		for _, event := range []string{
+			"connected to backend SQL server",
+			"negotiated TLS",
+			"relayed StartupMessage",
+		} {
+			_, ok := rec.FindLogMessage(event)
+			require.True(t, ok, event)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		deadAddr := unusedTCPAddr(t)
+
+		ctx, getRec := tracing.ContextWithRecordingSpan(context.Background(), tr, "test")
+		_, err := BackendDialContext(ctx, testStartupMessage(), deadAddr, nil /* tlsConfig */)
+		require.Error(t, err)
+
+		rec := getRec()
+		sp, ok := rec.FindSpan(backendDialSpanName)
+		require.True(t, ok)
+		require.Equal(t, deadAddr, sp.Tags["server_address"])
+		require.Equal(t, "error", sp.Tags["outcome"])
+		require.Equal(t, "codeBackendDown", sp.Tags["error_code"])
+		_, ok = rec.FindLogMessage("dial failed: .*unable to reach backend SQL server")
+		require.True(t, ok)
+	})
+
+	t.Run("untraced", func(t *testing.T) {
+		conn, err := BackendDialContext(
+			context.Background(), testStartupMessage(), addr, &tls.Config{InsecureSkipVerify: true},
+		)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+}
+
+func TestRelayStartupMsgBackendClosed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	for _, writeErr := range []error{
+		io.EOF,
+		&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.ECONNRESET)},
+		&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)},
+	} {
+		_, err := FinishStartupContext(
+			context.Background(), failingWriteConn{Conn: client, err: writeErr},
+			testStartupMessage(), nil, /* tlsConfig */
+		)
+		require.Equal(t, codeBackendClosedDuringStartup, getErrorCode(err), "%v", writeErr)
+		require.True(t, errors.Is(err, writeErr))
+		code, retryable := ClassifyDialError(err)
+		require.Equal(t, CodeBackendClosedDuringStartup, code)
+		require.True(t, retryable)
+	}
+
+	// Other errors, such as timeouts, are reported as codeBackendDown.
+	_, err := FinishStartupContext(
+		context.Background(), failingWriteConn{Conn: client, err: os.ErrDeadlineExceeded},
+		testStartupMessage(), nil, /* tlsConfig */
+	)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+}
+
+func TestBackendDialFileDescriptorExhaustion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr, stop := startTestBackend(t, func(conn net.Conn) {})
+	defer stop()
+
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE} {
+		dialer := &net.Dialer{Control: func(string, string, syscall.RawConn) error {
+			return os.NewSyscallError("socket", errno)
+		}}
+		_, err := BackendDialContext(
+			context.Background(), testStartupMessage(), addr, nil, /* tlsConfig */
+			NetDialer(dialer),
+		)
+		require.Equal(t, codeProxyResourceExhausted, getErrorCode(err), "%v", err)
+		require.True(t, errors.Is(err, errno))
+		require.Regexp(t, "ran out of file descriptors; consider raising the limit", err)
+		code, retryable := ClassifyDialError(err)
+		require.Equal(t, CodeProxyResourceExhausted, code)
+		require.False(t, retryable)
+	}
+}
+
+func TestClassifyDialError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tc := range []struct {
+		err       error
+		code      ErrorCode
+		retryable bool
+	}{
+		{nil, 0, false},
+		{newErrorf(codeBackendDown, "unable to reach backend SQL server"), CodeBackendDown, true},
+		{newErrorf(codeBackendRefusedTLS, "refused"), CodeBackendRefusedTLS, false},
+		{newErrorf(codeBackendTLSHandshakeFailed, "bad cert"), CodeBackendTLSHandshakeFailed, false},
+		{
+			newErrorf(codeUnexpectedStartupMessage, "not allowed"),
+			CodeUnexpectedStartupMessage, false,
+		},
+		{
+			newErrorf(codeBackendClosedDuringStartup, "closed"),
+			CodeBackendClosedDuringStartup, true,
+		},
+		{errors.Wrap(syscall.ECONNREFUSED, "dial"), 0, true},
+		{errors.New("boom"), 0, false},
+	} {
+		code, retryable := ClassifyDialError(tc.err)
+		require.Equal(t, tc.code, code, "%v", tc.err)
+		require.Equal(t, tc.retryable, retryable, "%v", tc.err)
+	}
+}
+
+func TestBackendDialWithRetry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr := unusedTCPAddr(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Without retries, the connection is refused.
+	_, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.Regexp(t, "unable to reach backend SQL server", err)
+
+	// Start listening on the address after a short delay. The retry loop
+	// should be able to connect once it's up.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(200 * time.Millisecond)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if msg, err := receiveStartupMessage(conn); err == nil {
+			msgCh <- msg
+		}
+	}()
+	defer wg.Wait()
+
+	conn, err := BackendDialWithRetry(
+		ctx, testStartupMessage(), addr, nil /* tlsConfig */, retry.Options{
+			InitialBackoff: 10 * time.Millisecond,
+			MaxBackoff:     50 * time.Millisecond,
+		},
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, testStartupMessage(), <-msgCh)
+}
+
+func TestBackendDialUnixSocket(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	socketPath := filepath.Join(t.TempDir(), ".s.PGSQL.26257")
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	_, stop := startTestBackendOn(t, "unix", socketPath, func(conn net.Conn) {
+		if msg, err := receiveStartupMessage(conn); err == nil {
+			msgCh <- msg
+		}
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, serverAddress := range []string{"unix://" + socketPath, socketPath} {
+		// TLS is skipped for Unix sockets by default, so the backend receives
+		// a plaintext startup message.
+		conn, err := BackendDialContext(ctx, testStartupMessage(), serverAddress, &tls.Config{})
+		require.NoError(t, err)
+		require.Equal(t, testStartupMessage(), <-msgCh)
+		require.NoError(t, conn.Close())
+	}
+}
+
+func TestBackendNetworkAddress(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tc := range []struct {
+		serverAddress string
+		network       string
+		address       string
+	}{
+		{"127.0.0.1:26257", "tcp", "127.0.0.1:26257"},
+		{"localhost:26257", "tcp", "localhost:26257"},
+		{"[::1]:26257", "tcp", "[::1]:26257"},
+		{"unix:///tmp/.s.PGSQL.26257", "unix", "/tmp/.s.PGSQL.26257"},
+		{"/tmp/.s.PGSQL.26257", "unix", "/tmp/.s.PGSQL.26257"},
+	} {
+		network, address := backendNetworkAddress(tc.serverAddress)
+		require.Equal(t, tc.network, network, tc.serverAddress)
+		require.Equal(t, tc.address, address, tc.serverAddress)
+	}
+}
+
+func TestBackendDialDualStack(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The backend only listens on IPv4. Regardless of whether "localhost"
+	// resolves to an IPv6 address first, the dial should succeed without
+	// waiting out the timeout.
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	defer stop()
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), net.JoinHostPort("localhost", port), nil, /* tlsConfig */
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The connection landed on the IPv4 address.
+	remoteAddr, ok := BackendRemoteAddr(conn)
+	require.True(t, ok)
+	require.Equal(t, addr, remoteAddr.String())
+	require.NotNil(t, remoteAddr.(*net.TCPAddr).IP.To4())
+}
+
+// acceptSSLRequest reads an SSLRequest from conn, accepts it, and performs
+// the server side of the TLS handshake using the given config.
+func acceptSSLRequest(conn net.Conn, cfg *tls.Config) (*tls.Conn, error) {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{pgAcceptSSLRequest}); err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Server(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// testRootCAs returns a certificate pool that trusts the test server
+// certificate.
+func testRootCAs(t *testing.T) *x509.CertPool {
+	pem, err := ioutil.ReadFile(filepath.Join("testdata", "testserver.crt"))
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(pem))
+	return pool
+}
+
+func TestBackendDialDeriveServerName(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		if msg, err := receiveStartupMessage(tlsConn); err == nil {
+			msgCh <- msg
+		}
+	})
+	defer stop()
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientCfg := &tls.Config{RootCAs: testRootCAs(t)}
+
+	t.Run("matching host", func(t *testing.T) {
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), net.JoinHostPort("localhost", port), clientCfg,
+			DeriveServerName(),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, testStartupMessage(), <-msgCh)
+		// The caller's config must not be mutated.
+		require.Empty(t, clientCfg.ServerName)
+	})
+
+	t.Run("mismatched host", func(t *testing.T) {
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, DeriveServerName(),
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendTLSHandshakeFailed, getErrorCode(err))
+		var hostnameErr x509.HostnameError
+		require.True(t, errors.As(err, &hostnameErr))
+	})
+}
+
+func TestBackendDialAddressResolver(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = receiveStartupMessage(tlsConn)
+	})
+	defer stop()
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	resolveErr := errors.New("tenant not found")
+	defer testutils.TestingHook(&AddressResolver, func(
+		ctx context.Context, serverAddress string,
+	) (string, error) {
+		if serverAddress != "tenant-10" {
+			return "", resolveErr
+		}
+		_, ok := ctx.Deadline()
+		require.True(t, ok)
+		return net.JoinHostPort("localhost", port), nil
+	})()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientCfg := &tls.Config{RootCAs: testRootCAs(t)}
+
+	// The ServerName is derived from the resolved address, which matches the
+	// backend certificate.
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), "tenant-10", clientCfg, DeriveServerName(),
+	)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	conn, err = BackendDialContext(ctx, testStartupMessage(), "tenant-20", clientCfg)
+	require.Nil(t, conn)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.True(t, errors.Is(err, resolveErr))
+}
+
+// testDialLimiter is a DialRateLimiter which allows one dial per token sent on
+// its channel.
+type testDialLimiter chan struct{}
+
+func (l testDialLimiter) Wait(ctx context.Context) error {
+	select {
+	case <-l:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestBackendDialLimiter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var mu sync.Mutex
+	var accepted int
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		mu.Lock()
+		accepted++
+		mu.Unlock()
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stop()
+
+	limiter := make(testDialLimiter, 1)
+	defer testutils.TestingHook(&DialLimiter, DialRateLimiter(limiter))()
+
+	// The first dial consumes the only token.
+	limiter <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	// The second dial blocks on the limiter until its deadline is exceeded,
+	// without reaching the backend.
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	conn, err = BackendDialContext(shortCtx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.Nil(t, conn)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	stop()
+	require.Equal(t, 1, accepted)
+}
+
+func TestBackendDialNetDialer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var controlled []string
+	controlErr := errors.New("control failed")
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		Control: func(network, address string, c syscall.RawConn) error {
+			controlled = append(controlled, address)
+			if len(controlled) > 1 {
+				return controlErr
+			}
+			return nil
+		},
+	}
+
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), addr, nil /* tlsConfig */, NetDialer(dialer),
+	)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Equal(t, []string{addr}, controlled)
+
+	// Errors from the dialer fail the dial.
+	conn, err = BackendDialContext(
+		ctx, testStartupMessage(), addr, nil /* tlsConfig */, NetDialer(dialer),
+	)
+	require.Nil(t, conn)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.Regexp(t, "control failed", err)
+}
+
+func TestBackendDialNetwork(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stop()
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var networks []string
+	dialer := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			networks = append(networks, network)
+			return nil
+		},
+	}
+	dial := func(serverAddress, network string) (net.Conn, error) {
+		networks = nil
+		return BackendDialContext(
+			ctx, testStartupMessage(), serverAddress, nil, /* tlsConfig */
+			NetDialer(dialer), DialNetwork(network),
+		)
+	}
+
+	conn, err := dial(net.JoinHostPort("localhost", port), "tcp4")
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Equal(t, []string{"tcp4"}, networks)
+
+	// IPv4 addresses can't be dialed over IPv6.
+	conn, err = dial(addr, "tcp6")
+	require.Nil(t, conn)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.Empty(t, networks)
+
+	conn, err = dial(addr, "udp")
+	require.Nil(t, conn)
+	require.EqualError(t, err, `invalid dial network "udp": must be one of "tcp", "tcp4" or "tcp6"`)
+	_, retryable := ClassifyDialError(err)
+	require.False(t, retryable)
+	require.Empty(t, networks)
+}
+
+func TestCheckBackendAddress(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tc := range []struct {
+		address     string
+		defaultPort string
+		expected    string
+		err         string
+	}{
+		{"localhost:26257", "", "localhost:26257", ""},
+		{"[::1]:26257", "", "[::1]:26257", ""},
+		{"localhost", "", "", `invalid backend SQL server address "localhost": address localhost: missing port in address`},
+		{"localhost:", "", "", `invalid backend SQL server address "localhost:": missing port`},
+		{"::1", "", "", `invalid backend SQL server address "::1": address ::1: too many colons in address`},
+		{"localhost", DefaultSQLPort, "localhost:26257", ""},
+		{"::1", DefaultSQLPort, "[::1]:26257", ""},
+		{"localhost:5432", DefaultSQLPort, "localhost:5432", ""},
+		{"a:b:c", DefaultSQLPort, "", `invalid backend SQL server address "a:b:c": address a:b:c: too many colons in address`},
+	} {
+		address, err := checkBackendAddress(tc.address, newDialOptions(
+			[]DialOption{DefaultBackendPort(tc.defaultPort)},
+		))
+		if tc.err != "" {
+			require.Equal(t, codeInvalidBackendAddress, getErrorCode(err), tc.address)
+			require.EqualError(t, err, "codeInvalidBackendAddress: "+tc.err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, address)
+	}
+}
+
+func TestBackendDialDefaultPort(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stop()
+	host, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A missing port is a configuration error, not an outage.
+	_, err = BackendDialContext(ctx, testStartupMessage(), host, nil /* tlsConfig */)
+	require.Equal(t, codeInvalidBackendAddress, getErrorCode(err))
+	code, retryable := ClassifyDialError(err)
+	require.Equal(t, CodeInvalidBackendAddress, code)
+	require.False(t, retryable)
+
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), host, nil /* tlsConfig */, DefaultBackendPort(port),
+	)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+}
+
+func TestBackendTLSState(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	serverCfg.MinVersion = tls.VersionTLS12
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, tlsConn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), addr, &tls.Config{InsecureSkipVerify: true},
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	state, ok := BackendTLSState(conn)
+	require.True(t, ok)
+	require.True(t, state.HandshakeComplete)
+	require.GreaterOrEqual(t, state.Version, uint16(tls.VersionTLS12))
+
+	// Plaintext connections have no TLS state.
+	plainConn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.NoError(t, err)
+	defer plainConn.Close()
+	_, ok = BackendTLSState(plainConn)
+	require.False(t, ok)
+}
+
+func TestBackendPeerCertificates(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, tlsConn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), addr, &tls.Config{InsecureSkipVerify: true},
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	certs, err := BackendPeerCertificates(conn)
+	require.NoError(t, err)
+	require.Len(t, certs, 1)
+	require.Equal(t, serverCfg.Certificates[0].Certificate[0], certs[0].Raw)
+	require.False(t, certs[0].NotAfter.IsZero())
+
+	// Plaintext connections have no certificates.
+	plainConn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.NoError(t, err)
+	defer plainConn.Close()
+	_, err = BackendPeerCertificates(plainConn)
+	require.EqualError(t, err, "connection to backend is not a TLS connection")
+
+	backend, proxy := net.Pipe()
+	defer backend.Close()
+	defer proxy.Close()
+	_, err = BackendPeerCertificates(proxy)
+	require.EqualError(t, err, "connection of type *net.pipe was not returned by BackendDial")
+}
+
+func TestBackendDialMinTLSVersion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	// The backend only supports TLS 1.1.
+	serverCfg.MinVersion = tls.VersionTLS10
+	serverCfg.MaxVersion = tls.VersionTLS11
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = receiveStartupMessage(tlsConn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("floor", func(t *testing.T) {
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, &tls.Config{InsecureSkipVerify: true},
+			MinTLSVersion(tls.VersionTLS12),
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendTLSHandshakeFailed, getErrorCode(err))
+	})
+
+	t.Run("caller version", func(t *testing.T) {
+		clientCfg := &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS11}
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, MinTLSVersion(tls.VersionTLS12),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		state, ok := BackendTLSState(conn)
+		require.True(t, ok)
+		require.Equal(t, uint16(tls.VersionTLS11), state.Version)
+	})
+}
+
+func TestBackendDialRequireTLS(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	var dials int32
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		atomic.AddInt32(&dials, 1)
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = receiveStartupMessage(tlsConn)
+	})
+	defer stop()
+	defer testutils.TestingHook(&RequireTLS, true)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.Nil(t, conn)
+	require.Equal(t, codeProxyRefusedConnection, getErrorCode(err))
+	require.Regexp(t, "refusing plaintext connection to backend SQL server .*: TLS is required", err)
+	_, retryable := ClassifyDialError(err)
+	require.False(t, retryable)
+
+	// Pre-dialed connections are refused as well.
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	_, err = FinishStartupContext(ctx, clientConn, testStartupMessage(), nil /* tlsConfig */)
+	require.Equal(t, codeProxyRefusedConnection, getErrorCode(err))
+
+	conn, err = BackendDialContext(
+		ctx, testStartupMessage(), addr, &tls.Config{InsecureSkipVerify: true},
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, ok := BackendTLSState(conn)
+	require.True(t, ok)
+	// Only the TLS dial reached the backend.
+	require.Equal(t, int32(1), atomic.LoadInt32(&dials))
+}
+
+func TestBackendDialTLSRefusalObserver(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	responseCh := make(chan byte, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		if _, err := io.ReadFull(conn, make([]byte, 8)); err != nil {
+			return
+		}
+		if _, err := conn.Write([]byte{<-responseCh}); err != nil {
+			return
+		}
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stop()
+
+	var events []TLSRefusalEvent
+	defer testutils.TestingHook(&TLSRefusalObserver, func(_ context.Context, e TLSRefusalEvent) {
+		events = append(events, e)
+	})()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	responseCh <- 'N'
+	_, err := BackendDialContext(ctx, testStartupMessage(), addr, &tls.Config{})
+	require.Equal(t, codeBackendRefusedTLS, getErrorCode(err))
+	responseCh <- 'H'
+	_, err = BackendDialContext(
+		ctx, testStartupMessage(), addr, &tls.Config{ServerName: "backend.example.com"},
+	)
+	require.Equal(t, codeBackendRefusedTLS, getErrorCode(err))
+	responseCh <- 'N'
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), addr, &tls.Config{}, PreferTLS(), DeriveServerName(),
+	)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	require.Equal(t, []TLSRefusalEvent{
+		{ServerAddress: addr, Response: 'N'},
+		{ServerAddress: addr, ServerNameSet: true, Response: 'H'},
+		{ServerAddress: addr, ServerNameSet: true, Response: 'N', FellBack: true},
+	}, events)
+	require.True(t, events[0].PlaintextOnly())
+	require.False(t, events[1].PlaintextOnly())
+}
+
+func TestValidateStartupMessage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	withParam := func(key, value string) *pgproto3.StartupMessage {
+		msg := testStartupMessage()
+		msg.Parameters[key] = value
+		return msg
+	}
+	for _, tc := range []struct {
+		name string
+		msg  *pgproto3.StartupMessage
+		code errorCode
+		err  string
+	}{
+		{name: "valid", msg: testStartupMessage()},
+		{
+			name: "nil",
+			code: codeUnexpectedStartupMessage,
+			err:  "missing startup message",
+		},
+		{
+			name: "protocol version",
+			msg:  &pgproto3.StartupMessage{ProtocolVersion: 2 << 16},
+			code: codeUnsupportedProtocolVersion,
+			err:  "unsupported frontend protocol 2.0",
+		},
+		{
+			name: "empty name",
+			msg:  withParam("", "root"),
+			code: codeInvalidStartupParams,
+			err:  "startup parameter with empty name",
+		},
+		{
+			name: "null byte in name",
+			msg:  withParam("user\x00database", "root"),
+			code: codeInvalidStartupParams,
+			err:  `startup parameter "user\x00database" contains a null byte`,
+		},
+		{
+			name: "null byte in value",
+			msg:  withParam("options", "x\x00database\x00system"),
+			code: codeInvalidStartupParams,
+			err:  `startup parameter "options" contains a null byte`,
+		},
+		{
+			name: "too large",
+			msg:  withParam("options", strings.Repeat("x", DefaultMaxStartupMessageSize)),
+			code: codeClientStartupTooLarge,
+			err:  "exceeds the maximum of 10240 bytes",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateStartupMessage(tc.msg)
+			if tc.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Equal(t, tc.code, getErrorCode(err))
+			require.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
+
+func TestBackendDialTLSSessionResumption(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		if _, err := receiveStartupMessage(tlsConn); err != nil {
+			return
+		}
+		// With TLS 1.3, session tickets are only processed by the client
+		// once it reads from the connection.
+		if _, err := tlsConn.Write([]byte{'x'}); err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, tlsConn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// dial dials the backend with the given ServerName, and returns whether
+	// the TLS session was resumed.
+	dial := func(serverName string) bool {
+		conn, err := BackendDialContext(ctx, testStartupMessage(), addr, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.ReadFull(conn, make([]byte, 1))
+		require.NoError(t, err)
+		state, ok := BackendTLSState(conn)
+		require.True(t, ok)
+		return state.DidResume
+	}
+
+	defer testutils.TestingHook(
+		&BackendTLSSessionCache, tls.NewLRUClientSessionCache(8 /* capacity */),
+	)()
+	require.False(t, dial("a.example"))
+	require.True(t, dial("a.example"))
+	// Sessions are not resumed across ServerNames.
+	require.False(t, dial("b.example"))
+	require.True(t, dial("b.example"))
+
+	// Resumption is disabled without a cache. The hook above restores the
+	// default cache.
+	BackendTLSSessionCache = nil
+	require.False(t, dial("c.example"))
+	require.False(t, dial("c.example"))
+}
+
+func TestBackendDialKeepAlive(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	require.Equal(t, defaultBackendKeepAlivePeriod, newDialOptions(nil).keepAlivePeriod)
+	require.Equal(t, time.Minute,
+		newDialOptions([]DialOption{KeepAlivePeriod(time.Minute)}).keepAlivePeriod)
+
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, period := range []time.Duration{time.Minute, -1} {
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil /* tlsConfig */, KeepAlivePeriod(period),
+		)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	}
+}
+
+// BenchmarkBackendConnRoundTrip measures the latency of round-trips over
+// backend connections, with and without Nagle's algorithm, using the
+// extended query protocol: each query is sent as separate Parse/Bind/Execute
+// and Sync writes, as some drivers do, and the backend only responds once it
+// received the Sync message. With Nagle's algorithm, the Sync message is held
+// back until the first write is acknowledged, which the backend delays. On
+// Linux, this typically turns round-trips of tens of microseconds into
+// round-trips of about 40ms:
+//
+//	go test ./pkg/ccl/sqlproxyccl -run - -bench BenchmarkBackendConnRoundTrip -benchtime 50x
+func BenchmarkBackendConnRoundTrip(b *testing.B) {
+	ctx := context.Background()
+	query := make([]byte, 64)
+	sync := []byte{'S', 0, 0, 0, 4}
+	response := make([]byte, 32)
+
+	addr, stop := startTestBackend(b, func(conn net.Conn) {
+		// The startup message is read from conn directly, since
+		// receiveStartupMessage may read ahead.
+		var header [4]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		startup := make([]byte, binary.BigEndian.Uint32(header[:])-4)
+		if _, err := io.ReadFull(conn, startup); err != nil {
+			return
+		}
+		buf := make([]byte, len(query)+len(sync))
+		for {
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return
+			}
+			if _, err := conn.Write(response); err != nil {
+				return
+			}
+		}
+	})
+	defer stop()
+
+	for _, tc := range []struct {
+		name string
+		opts []DialOption
+	}{
+		{"nodelay", nil},
+		{"nagle", []DialOption{EnableNagle()}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			conn, err := BackendDialContext(
+				ctx, testStartupMessage(), addr, nil /* tlsConfig */, tc.opts...,
+			)
+			require.NoError(b, err)
+			defer conn.Close()
+			buf := make([]byte, len(response))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(query); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := conn.Write(sync); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBackendDialALPN(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	startALPNBackend := func(protos []string) (string, func()) {
+		serverCfg, err := tlsConfig()
+		require.NoError(t, err)
+		serverCfg.NextProtos = protos
+		return startTestBackend(t, func(conn net.Conn) {
+			tlsConn, err := acceptSSLRequest(conn, serverCfg)
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(io.Discard, tlsConn)
+		})
+	}
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("negotiated", func(t *testing.T) {
+		addr, stop := startALPNBackend([]string{"crdb"})
+		defer stop()
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, NextProtos([]string{"crdb"}, true),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		state, ok := BackendTLSState(conn)
+		require.True(t, ok)
+		require.Equal(t, "crdb", state.NegotiatedProtocol)
+	})
+
+	t.Run("not negotiated", func(t *testing.T) {
+		addr, stop := startALPNBackend(nil)
+		defer stop()
+
+		// Optional ALPN.
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, NextProtos([]string{"crdb"}, false),
+		)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+
+		// Required ALPN.
+		conn, err = BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, NextProtos([]string{"crdb"}, true),
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendTLSHandshakeFailed, getErrorCode(err))
+		require.Regexp(t, "did not negotiate any of protocols", err)
+	})
+}
+
+func TestBackendDialInsecureSkipVerifyPolicy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The certificate of the backend is not signed by a trusted CA.
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = receiveStartupMessage(tlsConn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	verifyingCfg := &tls.Config{ServerName: "localhost"}
+	insecureCfg := &tls.Config{InsecureSkipVerify: true}
+
+	var policyAddrs []string
+	defer testutils.TestingHook(&InsecureSkipVerifyPolicy, func(serverAddress string) bool {
+		policyAddrs = append(policyAddrs, serverAddress)
+		return serverAddress == addr
+	})()
+
+	conn, err := BackendDialContext(ctx, testStartupMessage(), addr, verifyingCfg)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Equal(t, []string{addr}, policyAddrs)
+	require.False(t, verifyingCfg.InsecureSkipVerify)
+
+	// The policy also enforces verification.
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	_, err = BackendDialContext(
+		ctx, testStartupMessage(), net.JoinHostPort("localhost", port), insecureCfg,
+		DialNetwork("tcp4"),
+	)
+	require.Equal(t, codeBackendTLSHandshakeFailed, getErrorCode(err))
+	require.True(t, insecureCfg.InsecureSkipVerify)
+}
+
+func TestBackendTLSConfigRenegotiation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	cfg, err := backendTLSConfig("localhost:26257", &tls.Config{}, &dialOptions{})
+	require.NoError(t, err)
+	require.Equal(t, tls.RenegotiateNever, cfg.Renegotiation)
+
+	// An explicit setting of the caller is preserved, and the config of the
+	// caller is left untouched.
+	callerCfg := &tls.Config{Renegotiation: tls.RenegotiateOnceAsClient}
+	cfg, err = backendTLSConfig("localhost:26257", callerCfg, &dialOptions{})
+	require.NoError(t, err)
+	require.Equal(t, tls.RenegotiateOnceAsClient, cfg.Renegotiation)
+	require.NotSame(t, callerCfg, cfg)
+	require.Equal(t, tls.RenegotiateOnceAsClient, callerCfg.Renegotiation)
+}
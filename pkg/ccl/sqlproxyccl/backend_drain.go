@@ -0,0 +1,285 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// drainTerminateTimeout bounds the time spent sending a Terminate message to
+// a backend when closing a drained connection.
+const drainTerminateTimeout = time.Second
+
+// DrainController allows backend connections to be drained gracefully, e.g.
+// when a backend is decommissioned: once draining, a connection is closed at
+// the next transaction boundary, rather than abruptly.
+//
+// Connections returned by BackendDial are registered with Register, which
+// wraps them so that the messages sent by the backend are inspected. A
+// transaction boundary is a ReadyForQuery message with the idle ('I')
+// transaction status. When a draining connection reaches one, the
+// ReadyForQuery message is still returned to the reader, after which a
+// Terminate message is sent to the backend, and the connection is closed:
+// subsequent reads return io.EOF.
+type DrainController struct {
+	mu struct {
+		syncutil.Mutex
+		conns map[*drainConn]struct{}
+	}
+}
+
+// NewDrainController returns a new DrainController.
+func NewDrainController() *DrainController {
+	d := &DrainController{}
+	d.mu.conns = make(map[*drainConn]struct{})
+	return d
+}
+
+// Register registers conn, which should have been returned by BackendDial,
+// with the controller, and returns the connection that must be used in place
+// of conn.
+func (d *DrainController) Register(conn net.Conn) net.Conn {
+	c := &drainConn{Conn: conn, controller: d, closed: make(chan struct{})}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.mu.conns[c] = struct{}{}
+	return c
+}
+
+// Drain marks all registered connections as draining, and waits until they
+// are all closed, or ctx is done, in which case ctx.Err() is returned.
+// Connections which are idle (i.e. outside of a transaction, and not
+// processing a query) are closed right away.
+func (d *DrainController) Drain(ctx context.Context) error {
+	d.mu.Lock()
+	conns := make([]*drainConn, 0, len(d.mu.conns))
+	for c := range d.mu.conns {
+		conns = append(conns, c)
+	}
+	d.mu.Unlock()
+
+	for _, c := range conns {
+		c.drain()
+	}
+	for _, c := range conns {
+		select {
+		case <-c.closed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Len returns the number of registered connections which are not closed.
+func (d *DrainController) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.mu.conns)
+}
+
+func (d *DrainController) unregister(c *drainConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.mu.conns, c)
+}
+
+// drainConn is the net.Conn wrapper returned by DrainController.Register. It
+// parses the framing of the messages read from the backend to detect
+// transaction boundaries.
+type drainConn struct {
+	net.Conn
+	controller *DrainController
+	closed     chan struct{}
+	closeOnce  sync.Once
+
+	mu struct {
+		syncutil.Mutex
+		// draining is true once the connection was drained.
+		draining bool
+		// idle is true if the last message read from the backend was a
+		// ReadyForQuery message with the idle status, and nothing was written
+		// to the backend since.
+		idle bool
+		// done is true once the connection was closed because of draining.
+		done bool
+	}
+
+	// The fields below track the framing of the messages read from the
+	// backend. They are only accessed by Read, which must not be called
+	// concurrently.
+	//
+	// header accumulates the type and length of the current message.
+	header  [5]byte
+	headerN int
+	// remaining is the number of body bytes of the current message which
+	// have not been read yet.
+	remaining int
+	// status is the transaction status of the current message, if it is a
+	// ReadyForQuery message.
+	status byte
+}
+
+var _ net.Conn = &drainConn{}
+
+// Read implements the net.Conn interface.
+func (c *drainConn) Read(b []byte) (int, error) {
+	if c.isDone() {
+		return 0, io.EOF
+	}
+	n, err := c.Conn.Read(b)
+	if err != nil && c.isDone() {
+		// The connection was closed by drain while the read was blocked.
+		return n, io.EOF
+	}
+	if boundary := c.scan(b[:n]); boundary >= 0 {
+		c.mu.Lock()
+		c.mu.idle = true
+		draining := c.mu.draining
+		c.mu.Unlock()
+		if draining {
+			// Anything that follows the boundary is discarded, since the
+			// connection is closed.
+			c.terminate()
+			return boundary, nil
+		}
+	}
+	return n, err
+}
+
+// Write implements the net.Conn interface.
+func (c *drainConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.mu.idle = false
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// Close implements the net.Conn interface.
+func (c *drainConn) Close() error {
+	c.markClosed()
+	return c.Conn.Close()
+}
+
+// scan advances the framing state over b, and returns the offset just past
+// the last ReadyForQuery message with the idle status that completes within
+// b, or -1 if there is none.
+func (c *drainConn) scan(b []byte) int {
+	boundary := -1
+	for i := 0; i < len(b); {
+		if c.headerN < len(c.header) {
+			k := copy(c.header[c.headerN:], b[i:])
+			c.headerN += k
+			i += k
+			if c.headerN < len(c.header) {
+				break
+			}
+			// The length includes itself, but not the type.
+			c.remaining = int(binary.BigEndian.Uint32(c.header[1:])) - 4
+			c.status = 0
+		}
+		k := len(b) - i
+		if k > c.remaining {
+			k = c.remaining
+		}
+		if k > 0 && c.header[0] == 'Z' && c.status == 0 {
+			c.status = b[i]
+		}
+		c.remaining -= k
+		i += k
+		if c.remaining <= 0 {
+			if c.header[0] == 'Z' && c.status == 'I' {
+				boundary = i
+			}
+			c.headerN = 0
+		}
+	}
+	return boundary
+}
+
+// drain marks the connection as draining, and closes it right away if it is
+// idle.
+func (c *drainConn) drain() {
+	c.mu.Lock()
+	c.mu.draining = true
+	idle := c.mu.idle
+	c.mu.Unlock()
+	if idle {
+		c.terminate()
+	}
+}
+
+// terminate sends a Terminate message to the backend, and closes the
+// connection.
+func (c *drainConn) terminate() {
+	c.mu.Lock()
+	done := c.mu.done
+	c.mu.done = true
+	c.mu.Unlock()
+	if done {
+		return
+	}
+	// Don't let a backend which doesn't read block the drain.
+	_ = c.Conn.SetWriteDeadline(timeutil.Now().Add(drainTerminateTimeout))
+	_, _ = c.Conn.Write((&pgproto3.Terminate{}).Encode(nil))
+	_ = c.Close()
+}
+
+// isDone returns whether the connection was closed because of draining.
+func (c *drainConn) isDone() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mu.done
+}
+
+func (c *drainConn) markClosed() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.controller.unregister(c)
+	})
+}
+
+// TrackDials, if true, registers the connections returned by
+// BackendDialContext (and therefore BackendDial and DialBackend) with a
+// process-wide DrainController, so that they can all be drained through
+// DrainAll, e.g. when the proxy receives SIGTERM. Connections are unregistered
+// once they are closed, so that the registry doesn't retain them: callers must
+// close the connections they dial, including those closed by the backend.
+// Connections dialed while TrackDials is false are not tracked.
+var TrackDials = false
+
+// dialRegistry is the DrainController with which connections are registered
+// if TrackDials is true.
+var dialRegistry = NewDrainController()
+
+// trackDial registers conn with dialRegistry if TrackDials is true, and
+// returns the connection that must be used in place of conn.
+func trackDial(conn net.Conn) net.Conn {
+	if !TrackDials {
+		return conn
+	}
+	return dialRegistry.Register(conn)
+}
+
+// DrainAll drains the connections tracked through TrackDials, as described in
+// DrainController.Drain: each of them is closed at its next transaction
+// boundary. It waits until they are all closed, or ctx is done, in which case
+// ctx.Err() is returned.
+func DrainAll(ctx context.Context) error {
+	return dialRegistry.Drain(ctx)
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainController(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// encode concatenates the encoding of msgs.
+	encode := func(msgs ...pgproto3.BackendMessage) []byte {
+		var buf []byte
+		for _, msg := range msgs {
+			buf = msg.Encode(buf)
+		}
+		return buf
+	}
+	inTxn := &pgproto3.ReadyForQuery{TxStatus: 'T'}
+	idle := &pgproto3.ReadyForQuery{TxStatus: 'I'}
+	complete := &pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")}
+
+	t.Run("transaction boundary", func(t *testing.T) {
+		d := NewDrainController()
+		backend, proxy := net.Pipe()
+		defer backend.Close()
+		conn := d.Register(proxy)
+		defer conn.Close()
+		require.Equal(t, 1, d.Len())
+
+		// The client is in the middle of a transaction.
+		go func() {
+			_, _ = backend.Write(encode(complete, inTxn))
+		}()
+		buf := make([]byte, 1024)
+		n, err := io.ReadFull(conn, buf[:len(encode(complete, inTxn))])
+		require.NoError(t, err)
+		require.Equal(t, encode(complete, inTxn), buf[:n])
+
+		drained := make(chan error, 1)
+		go func() { drained <- d.Drain(ctx) }()
+		testutils.SucceedsSoon(t, func() error {
+			c := conn.(*drainConn)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if !c.mu.draining {
+				return errors.New("connection is not draining")
+			}
+			return nil
+		})
+		terminated := make(chan pgproto3.FrontendMessage, 1)
+
+		// The connection remains open until the transaction ends.
+		go func() {
+			_, _ = conn.Write([]byte("COMMIT"))
+		}()
+		readBuf := make([]byte, 1024)
+		n, err = backend.Read(readBuf)
+		require.NoError(t, err)
+		require.Equal(t, "COMMIT", string(readBuf[:n]))
+
+		// The ReadyForQuery message is split across writes, and followed by a
+		// notice which is discarded. Once it was read, the backend receives a
+		// Terminate message.
+		go func() {
+			msg := encode(complete, idle, &pgproto3.NoticeResponse{Message: "discarded"})
+			_, _ = backend.Write(msg[:len(msg)-20])
+			_, _ = backend.Write(msg[len(msg)-20:])
+			be := pgproto3.NewBackend(pgproto3.NewChunkReader(backend), backend)
+			msg2, _ := be.Receive()
+			terminated <- msg2
+		}()
+		var got []byte
+		for {
+			n, err := conn.Read(buf)
+			got = append(got, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+		}
+		require.Equal(t, encode(complete, idle), got)
+		require.IsType(t, &pgproto3.Terminate{}, <-terminated)
+
+		require.NoError(t, <-drained)
+		require.Equal(t, 0, d.Len())
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		d := NewDrainController()
+		backend, proxy := net.Pipe()
+		defer backend.Close()
+		conn := d.Register(proxy)
+		defer conn.Close()
+
+		go func() {
+			_, _ = backend.Write(encode(idle))
+		}()
+		buf := make([]byte, 1024)
+		_, err := io.ReadFull(conn, buf[:len(encode(idle))])
+		require.NoError(t, err)
+
+		// The connection is idle, so it is closed right away.
+		terminated := make(chan pgproto3.FrontendMessage, 1)
+		go func() {
+			be := pgproto3.NewBackend(pgproto3.NewChunkReader(backend), backend)
+			msg, _ := be.Receive()
+			terminated <- msg
+		}()
+		require.NoError(t, d.Drain(ctx))
+		require.IsType(t, &pgproto3.Terminate{}, <-terminated)
+		_, err = conn.Read(buf)
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		d := NewDrainController()
+		backend, proxy := net.Pipe()
+		defer backend.Close()
+		conn := d.Register(proxy)
+		defer conn.Close()
+
+		// The connection never reaches a transaction boundary.
+		shortCtx, shortCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer shortCancel()
+		require.Equal(t, context.DeadlineExceeded, d.Drain(shortCtx))
+		require.Equal(t, 1, d.Len())
+	})
+}
+
+func TestDrainAll(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	terminated := make(chan pgproto3.FrontendMessage, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		if _, err := receiveStartupMessage(conn); err != nil {
+			return
+		}
+		if _, err := conn.Write((&pgproto3.ReadyForQuery{TxStatus: 'I'}).Encode(nil)); err != nil {
+			return
+		}
+		be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+		if msg, err := be.Receive(); err == nil {
+			terminated <- msg
+		}
+	})
+	defer stop()
+
+	// Connections are not tracked by default.
+	conn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.NoError(t, err)
+	require.Equal(t, 0, dialRegistry.Len())
+	require.NoError(t, conn.Close())
+
+	defer testutils.TestingHook(&TrackDials, true)()
+
+	// Closed connections are unregistered.
+	conn, err = BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.NoError(t, err)
+	require.Equal(t, 1, dialRegistry.Len())
+	_, ok := BackendRemoteAddr(conn)
+	require.True(t, ok)
+	require.NoError(t, conn.Close())
+	require.Equal(t, 0, dialRegistry.Len())
+
+	// Idle connections are terminated by DrainAll.
+	conn, err = BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.NoError(t, err)
+	defer conn.Close()
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.NoError(t, DrainAll(ctx))
+	require.IsType(t, &pgproto3.Terminate{}, <-terminated)
+	require.Equal(t, 0, dialRegistry.Len())
+	_, err = conn.Read(buf)
+	require.Equal(t, io.EOF, err)
+}
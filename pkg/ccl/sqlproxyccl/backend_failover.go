@@ -0,0 +1,84 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// DialOrder, if set, is invoked by every BackendDialAnyContext call to decide
+// the order in which the candidate addresses are tried, e.g. to shuffle them
+// or to prefer addresses in the local region. It must return a permutation
+// (or a subset) of addrs, and must not modify addrs. By default, addresses are
+// tried in the order in which they were supplied.
+var DialOrder func(addrs []string) []string
+
+// BackendDialAny is like BackendDial, but tries each of the candidate
+// addresses in turn until a connection is established. It returns the
+// connection along with the address that it was established with. See
+// BackendDialAnyContext for more details.
+func BackendDialAny(
+	msg *pgproto3.StartupMessage, addrs []string, tlsConfig *tls.Config,
+) (net.Conn, string, error) {
+	return BackendDialAnyContext(context.Background(), msg, addrs, tlsConfig)
+}
+
+// BackendDialAnyContext is the context-aware version of BackendDialAny. Every
+// address is dialed through BackendDialContext with the supplied options, so
+// each attempt gets its own dial timeout if ctx has no deadline, and is retried
+// according to DialRetry, if specified.
+//
+// A failure to dial an address, whatever its cause (including
+// codeBackendRefusedTLS), only rules out that address, and the next one is
+// tried. Dialing stops early if ctx is done. If all the addresses fail, the
+// returned error lists the failure of each of them. Its code is the code
+// shared by all the failures, or codeBackendDown if they differ.
+func BackendDialAnyContext(
+	ctx context.Context,
+	msg *pgproto3.StartupMessage,
+	addrs []string,
+	tlsConfig *tls.Config,
+	opts ...DialOption,
+) (net.Conn, string, error) {
+	if DialOrder != nil {
+		addrs = DialOrder(addrs)
+	}
+	if len(addrs) == 0 {
+		return nil, "", newErrorf(codeBackendDown, "no backend SQL server addresses to dial")
+	}
+
+	failures := make([]string, 0, len(addrs))
+	var code errorCode
+	for i, addr := range addrs {
+		conn, err := BackendDialContext(ctx, msg, addr, tlsConfig, opts...)
+		if err == nil {
+			return conn, addr, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", addr, err))
+		if errCode := getErrorCode(err); i == 0 {
+			code = errCode
+		} else if errCode != code {
+			code = codeBackendDown
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if code == 0 {
+		code = codeBackendDown
+	}
+	return nil, "", newErrorf(code, "unable to dial any backend SQL server (%d attempted): %s",
+		len(failures), strings.Join(failures, "; "))
+}
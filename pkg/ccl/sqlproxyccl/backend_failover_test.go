@@ -0,0 +1,148 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendDialAny(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	deadAddr := unusedTCPAddr(t)
+
+	// The refusing backend has no TLS config, so it refuses SSLRequests.
+	refusing, err := newTestBackend(nil /* serverTLSConfig */)
+	require.NoError(t, err)
+	defer refusing.Close()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	goodAddr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		if msg, err := receiveStartupMessage(tlsConn); err == nil {
+			msgCh <- msg
+		}
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	t.Run("failover", func(t *testing.T) {
+		conn, addr, err := BackendDialAnyContext(
+			ctx, testStartupMessage(), []string{deadAddr, refusing.Addr(), goodAddr}, clientCfg,
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, goodAddr, addr)
+		require.Equal(t, testStartupMessage(), <-msgCh)
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		conn, addr, err := BackendDialAnyContext(
+			ctx, testStartupMessage(), []string{deadAddr, refusing.Addr()}, clientCfg,
+		)
+		require.Nil(t, conn)
+		require.Empty(t, addr)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Regexp(t, "2 attempted", err)
+		require.Regexp(t, deadAddr+": codeBackendDown", err)
+		require.Regexp(t, refusing.Addr()+": codeBackendRefusedTLS", err)
+
+		// Failures sharing the same code keep it.
+		_, _, err = BackendDialAnyContext(
+			ctx, testStartupMessage(), []string{refusing.Addr(), refusing.Addr()}, clientCfg,
+		)
+		require.Equal(t, codeBackendRefusedTLS, getErrorCode(err))
+
+		_, _, err = BackendDialAnyContext(ctx, testStartupMessage(), nil /* addrs */, clientCfg)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+	})
+
+	t.Run("dial order", func(t *testing.T) {
+		defer testutils.TestingHook(&DialOrder, func(addrs []string) []string {
+			return []string{addrs[len(addrs)-1]}
+		})()
+		conn, addr, err := BackendDialAnyContext(
+			ctx, testStartupMessage(), []string{deadAddr, goodAddr}, clientCfg,
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, goodAddr, addr)
+		<-msgCh
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, _, err := BackendDialAnyContext(
+			canceledCtx, testStartupMessage(), []string{deadAddr, goodAddr}, clientCfg,
+		)
+		require.Regexp(t, "1 attempted", err)
+	})
+}
+
+func TestBackendDialAnyConnectTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stop()
+
+	// Resolving hostnames stalls until the attempt is abandoned, which stands
+	// for a backend behind a network black hole.
+	dialer := &net.Dialer{
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		},
+	}
+	stalledAddr := "stalled.invalid:26257"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start := timeutil.Now()
+	conn, dialedAddr, err := BackendDialAnyContext(
+		ctx, testStartupMessage(), []string{stalledAddr, addr}, nil, /* tlsConfig */
+		NetDialer(dialer), ConnectTimeout(50*time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, addr, dialedAddr)
+	require.Less(t, int64(timeutil.Since(start)), int64(5*time.Second))
+
+	// A timed out attempt is retryable.
+	_, err = BackendDialContext(
+		ctx, testStartupMessage(), stalledAddr, nil, /* tlsConfig */
+		NetDialer(dialer), ConnectTimeout(50*time.Millisecond),
+	)
+	code, retryable := ClassifyDialError(err)
+	require.Equal(t, codeBackendDown, code)
+	require.True(t, retryable)
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// DialFailureCache is a short-lived negative cache of dial failures, keyed by
+// backend address. After a dial to an address fails with a codeBackendDown
+// error, subsequent dials to the address fail immediately with the cached
+// error until the TTL of the entry expires, rather than each paying the full
+// dial timeout. It complements BackendBreaker, which only trips after a number
+// of failures: the cache covers the window between the first failure and the
+// breaker tripping. As with BackendBreaker, other errors, such as
+// codeBackendRefusedTLS, indicate that the backend was reachable, and clear
+// the entry of the address, as do successful dials. Dials which fail because
+// the caller canceled them, or because of the deadline of the caller, leave
+// the cache untouched.
+type DialFailureCache struct {
+	ttl        time.Duration
+	timeSource timeutil.TimeSource
+
+	mu struct {
+		syncutil.Mutex
+		// failures contains the last failure of the addresses whose entry
+		// may not have expired yet.
+		failures map[string]dialFailure
+	}
+}
+
+// dialFailure is an entry of a DialFailureCache.
+type dialFailure struct {
+	err     error
+	expires time.Time
+}
+
+// NewDialFailureCache returns a DialFailureCache which caches dial failures
+// for ttl (e.g. 500ms). If timeSource is nil, timeutil.DefaultTimeSource is
+// used.
+func NewDialFailureCache(ttl time.Duration, timeSource timeutil.TimeSource) *DialFailureCache {
+	if timeSource == nil {
+		timeSource = timeutil.DefaultTimeSource{}
+	}
+	c := &DialFailureCache{ttl: ttl, timeSource: timeSource}
+	c.mu.failures = make(map[string]dialFailure)
+	return c
+}
+
+// DialFailures, if set, caches the failures of BackendDialContext calls, by
+// backend address once resolved (see AddressResolver). See DialFailureCache
+// for more details. Dials which fail because of a cached failure don't wait
+// for BackendConnLimits or DialLimiter, and are not reported to DialBreaker.
+// Dials rejected by DialBreaker don't update the cache.
+var DialFailures *DialFailureCache
+
+// Len returns the number of backend addresses which have a cached failure,
+// including expired entries which were not cleared yet, e.g. for use as a
+// gauge.
+func (c *DialFailureCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.mu.failures)
+}
+
+// check returns a codeBackendDown error wrapping the cached failure of
+// serverAddress, if any. Expired entries are cleared.
+func (c *DialFailureCache) check(serverAddress string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.mu.failures[serverAddress]
+	if !ok {
+		return nil
+	}
+	if !c.timeSource.Now().Before(f.expires) {
+		delete(c.mu.failures, serverAddress)
+		return nil
+	}
+	return wrapErrorf(
+		codeBackendDown, f.err, "dial to backend SQL server %s failed recently", serverAddress,
+	)
+}
+
+// record reports the outcome of a dial to serverAddress which was allowed by
+// check.
+func (c *DialFailureCache) record(serverAddress string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if getErrorCode(err) != codeBackendDown {
+		delete(c.mu.failures, serverAddress)
+		return
+	}
+	// The code is attached again by check.
+	var codeErr *codeError
+	if errors.As(err, &codeErr) {
+		err = codeErr.err
+	}
+	c.mu.failures[serverAddress] = dialFailure{err: err, expires: c.timeSource.Now().Add(c.ttl)}
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialFailureCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const addr = "127.0.0.1:26257"
+	down := newErrorf(codeBackendDown, "down")
+	refused := newErrorf(codeBackendRefusedTLS, "refused")
+
+	clock := timeutil.NewManualTime(timeutil.Unix(0, 0))
+	c := NewDialFailureCache(500*time.Millisecond, clock)
+
+	// Failures are cached until their TTL expires.
+	require.NoError(t, c.check(addr))
+	c.record(addr, down)
+	require.Equal(t, 1, c.Len())
+	err := c.check(addr)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.Regexp(t, "failed recently: down", err)
+	require.NoError(t, c.check("127.0.0.1:26258"))
+	clock.Advance(500 * time.Millisecond)
+	require.NoError(t, c.check(addr))
+	require.Equal(t, 0, c.Len())
+
+	// Successes, and errors other than codeBackendDown, clear the entry.
+	for _, err := range []error{nil, refused} {
+		c.record(addr, down)
+		require.Error(t, c.check(addr))
+		c.record(addr, err)
+		require.NoError(t, c.check(addr))
+		require.Equal(t, 0, c.Len())
+	}
+}
+
+func TestBackendDialFailureCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	deadAddr := unusedTCPAddr(t)
+
+	cache := NewDialFailureCache(time.Minute, nil /* timeSource */)
+	defer testutils.TestingHook(&DialFailures, cache)()
+	var dials int
+	defer testutils.TestingHook(&DialObserver, func(string, time.Duration, error) {
+		dials++
+	})()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := BackendDialContext(ctx, testStartupMessage(), deadAddr, nil /* tlsConfig */)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.Equal(t, 1, cache.Len())
+
+	// The second dial fails with the cached error.
+	_, cachedErr := BackendDialContext(ctx, testStartupMessage(), deadAddr, nil /* tlsConfig */)
+	require.Equal(t, codeBackendDown, getErrorCode(cachedErr))
+	require.Regexp(t, "failed recently", cachedErr)
+	require.Contains(t, cachedErr.Error(), errors.UnwrapOnce(err).Error())
+	require.Equal(t, 2, dials)
+
+	// Other backends are dialed as usual.
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stop()
+	conn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Equal(t, 1, cache.Len())
+}
+
+func TestBackendDialFailureCacheAbandonedDial(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr, stop := startStallingTestBackend(t)
+	defer stop()
+	cache := NewDialFailureCache(time.Minute, nil /* timeSource */)
+	defer testutils.TestingHook(&DialFailures, cache)()
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	// The deadline of the caller expires during the first dial, which
+	// doesn't poison the cache.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := BackendDialContext(ctx, testStartupMessage(), addr, clientCfg)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.Equal(t, 0, cache.Len())
+
+	conn, err := BackendDialContext(context.Background(), testStartupMessage(), addr, clientCfg)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// GSSEncryptionFunc establishes a GSSAPI security context with the backend
+// over conn once the backend has accepted a GSSENCRequest, and returns a
+// connection which encrypts and decrypts the traffic with it (e.g. using a
+// Kerberos library). ctx bounds the time spent establishing the context.
+type GSSEncryptionFunc func(ctx context.Context, conn net.Conn) (net.Conn, error)
+
+// GSSEncryption configures the dialer to request GSSAPI encryption from the
+// backend, analogous to the "require" gssencmode in PostgreSQL, instead of
+// upgrading the connection to TLS. establish is invoked once the backend has
+// accepted the request.
+//
+// If the backend refuses GSSAPI encryption, the dial fails with a
+// codeBackendRefusedTLS error, unless PreferTLS is also specified, in which
+// case the dialer falls back to the regular SSLRequest negotiation over the
+// same connection, as PostgreSQL clients do. If establish fails, the dial
+// fails with a codeBackendTLSHandshakeFailed error.
+func GSSEncryption(establish GSSEncryptionFunc) DialOption {
+	return func(opts *dialOptions) {
+		opts.gssEncryption = establish
+	}
+}
+
+// gssOverlay attempts to upgrade the PG connection to use GSSAPI encryption
+// if opts.gssEncryption is set. It is the GSSAPI counterpart of sslOverlay, and
+// returns accepted=false, without an error, if GSSAPI encryption was not
+// requested, or if the backend refused it and opts.preferTLS is set. In that
+// case, the caller should continue with sslOverlay.
+func gssOverlay(
+	ctx context.Context, conn net.Conn, opts *dialOptions,
+) (_ net.Conn, accepted bool, _ error) {
+	if opts.gssEncryption == nil {
+		return conn, false, nil
+	}
+
+	stop := watchConnContext(ctx, conn)
+	defer stop()
+
+	// Send GSSENCRequest.
+	if err := binary.Write(conn, binary.BigEndian, pgGSSEncRequest); err != nil {
+		return nil, false, newErrorf(
+			codeBackendDown, "sending GSSENCRequest to target server: %v", err,
+		)
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, false,
+			newErrorf(codeBackendDown, "reading response to GSSENCRequest: %v", err)
+	}
+
+	if response[0] != pgAcceptGSSEncRequest {
+		if opts.preferTLS {
+			return conn, false, nil
+		}
+		return nil, false, newErrorf(
+			codeBackendRefusedTLS, "target server refused GSSAPI encryption",
+		)
+	}
+
+	gssConn, err := opts.gssEncryption(ctx, conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, false, wrapErrorf(
+				codeBackendDown, err, "establishing GSSAPI encryption with target server",
+			)
+		}
+		return nil, false, wrapErrorf(
+			codeBackendTLSHandshakeFailed, err, "establishing GSSAPI encryption with target server",
+		)
+	}
+	return gssConn, true, nil
+}
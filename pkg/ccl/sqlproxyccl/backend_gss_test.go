@@ -0,0 +1,134 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// gssTestConn marks connections returned by the GSSEncryptionFunc used in
+// tests. Traffic is not actually encrypted.
+type gssTestConn struct {
+	net.Conn
+}
+
+func TestBackendDialGSSEncryption(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// startGSSBackend starts a backend which answers a GSSENCRequest with
+	// response, and then expects a StartupMessage, possibly preceded by an
+	// SSLRequest which is always refused.
+	startGSSBackend := func(response byte) (string, <-chan *pgproto3.StartupMessage, func()) {
+		msgCh := make(chan *pgproto3.StartupMessage, 1)
+		addr, stop := startTestBackend(t, func(conn net.Conn) {
+			var req [2]int32
+			if err := binary.Read(conn, binary.BigEndian, &req); err != nil {
+				return
+			}
+			if req != [2]int32{pgGSSEncRequest[0], pgGSSEncRequest[1]} {
+				return
+			}
+			if _, err := conn.Write([]byte{response}); err != nil {
+				return
+			}
+			be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+			msg, err := be.ReceiveStartupMessage()
+			if err != nil {
+				return
+			}
+			if _, ok := msg.(*pgproto3.SSLRequest); ok {
+				if _, err := conn.Write([]byte{'N'}); err != nil {
+					return
+				}
+				if msg, err = be.ReceiveStartupMessage(); err != nil {
+					return
+				}
+			}
+			if startup, ok := msg.(*pgproto3.StartupMessage); ok {
+				msgCh <- startup
+			}
+			_, _ = io.Copy(io.Discard, conn)
+		})
+		return addr, msgCh, stop
+	}
+
+	establish := func(ctx context.Context, conn net.Conn) (net.Conn, error) {
+		return &gssTestConn{Conn: conn}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("accepted", func(t *testing.T) {
+		addr, msgCh, stop := startGSSBackend(pgAcceptGSSEncRequest)
+		defer stop()
+
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil /* tlsConfig */, GSSEncryption(establish),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, ok := conn.(*backendConn).Conn.(*gssTestConn)
+		require.True(t, ok)
+		require.Equal(t, testStartupMessage(), <-msgCh)
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		addr, _, stop := startGSSBackend('N')
+		defer stop()
+
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil /* tlsConfig */, GSSEncryption(establish),
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendRefusedTLS, getErrorCode(err))
+	})
+
+	t.Run("refused with fallback", func(t *testing.T) {
+		addr, msgCh, stop := startGSSBackend('N')
+		defer stop()
+
+		// The backend refuses both GSSAPI encryption and TLS, so the
+		// connection falls back to plaintext.
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, &tls.Config{},
+			GSSEncryption(establish), PreferTLS(),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, testStartupMessage(), <-msgCh)
+	})
+
+	t.Run("establish failed", func(t *testing.T) {
+		addr, _, stop := startGSSBackend(pgAcceptGSSEncRequest)
+		defer stop()
+
+		establishErr := errors.New("no credentials")
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil, /* tlsConfig */
+			GSSEncryption(func(context.Context, net.Conn) (net.Conn, error) {
+				return nil, establishErr
+			}),
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendTLSHandshakeFailed, getErrorCode(err))
+		require.True(t, errors.Is(err, establishErr))
+	})
+}
@@ -0,0 +1,167 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+//go:build !windows
+// +build !windows
+
+package sqlproxyccl
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/cockroachdb/errors"
+)
+
+// The helpers below allow live backend connections to be handed off to
+// another process (e.g. the new process of a proxy which is restarted without
+// downtime) by passing their file descriptor over a Unix domain socket, using
+// SCM_RIGHTS. Only the socket is transferred: state held in the memory of the
+// process can't be, which restricts the connections which can be handed off:
+//
+//   - the connection must not use TLS or GSSAPI encryption, since the
+//     encryption state (keys and sequence numbers) would be lost;
+//   - no bytes must have been buffered by the process without being read yet
+//     (e.g. the first message peeked through PeekFirstMessage);
+//   - the options which wrap the connection (e.g. IdleTimeout), and its byte
+//     counters, don't carry over.
+//
+// The protocol state of the session is not transferred either: the connection
+// should be handed off between two messages, and the receiving process must
+// know where the session stands. The helpers are only available on Unix
+// platforms.
+
+// BackendConnFile returns a duplicate of the file descriptor of conn, a
+// plaintext connection returned by BackendDial or a raw connection returned by
+// BackendPool.Get, e.g. to pass it to another process. The file is
+// independent of conn: closing one doesn't affect the other. An error is
+// returned if conn can't be handed off (see above).
+func BackendConnFile(conn net.Conn) (*os.File, error) {
+	raw, err := handoffRawConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := raw.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.Newf("connection of type %T does not support handoff", raw)
+	}
+	return f.File()
+}
+
+// handoffRawConn returns the raw connection underlying conn, or an error if
+// it can't be handed off.
+func handoffRawConn(conn net.Conn) (net.Conn, error) {
+	c, ok := asBackendConn(conn)
+	if !ok {
+		return unwrapPeeked(conn)
+	}
+	if c.tlsConn != nil {
+		return nil, errors.New("TLS connections can't be handed off")
+	}
+	inner := c.Conn
+	for {
+		switch t := inner.(type) {
+		case *countingConn:
+			if t != c.wire {
+				return nil, errors.New("encrypted connections can't be handed off")
+			}
+			return unwrapPeeked(t.Conn)
+		case *idleTimeoutConn:
+			inner = t.Conn
+		case *keyDataConn:
+			inner = t.Conn
+		case *peekedConn:
+			if len(t.peeked) > 0 {
+				return nil, errors.New("connections with buffered data can't be handed off")
+			}
+			inner = t.Conn
+		default:
+			return nil, errors.New("encrypted connections can't be handed off")
+		}
+	}
+}
+
+// unwrapPeeked returns the connection underlying conn, which may have been
+// wrapped by a peekedConn (e.g. by dialHTTPProxy), or an error if bytes were
+// buffered.
+func unwrapPeeked(conn net.Conn) (net.Conn, error) {
+	for {
+		c, ok := conn.(*peekedConn)
+		if !ok {
+			return conn, nil
+		}
+		if len(c.peeked) > 0 {
+			return nil, errors.New("connections with buffered data can't be handed off")
+		}
+		conn = c.Conn
+	}
+}
+
+// BackendConnFromFile reconstructs a backend connection from f, a file
+// descriptor obtained through BackendConnFile (possibly in another process).
+// The returned connection supports the accessors of the connections returned
+// by BackendDial (e.g. BackendTCPConn); its byte counters start at zero. f is
+// not closed, and can be closed independently of the connection.
+func BackendConnFromFile(f *os.File) (net.Conn, error) {
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	wire := &countingConn{Conn: conn}
+	tcpConn, _ := conn.(*net.TCPConn)
+	return &backendConn{Conn: wire, wire: wire, tcpConn: tcpConn}, nil
+}
+
+// SendBackendConn passes the file descriptor of conn (see BackendConnFile)
+// over via, a Unix domain socket connected to another process, which can
+// reconstruct the connection through ReceiveBackendConn. conn is left open,
+// and should be closed once the other process acknowledged the handoff, so
+// that the backend doesn't see the connection close.
+func SendBackendConn(via *net.UnixConn, conn net.Conn) error {
+	f, err := BackendConnFile(conn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// At least one byte of data must accompany the control message.
+	_, _, err = via.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil)
+	return errors.Wrap(err, "sending backend connection")
+}
+
+// ReceiveBackendConn receives a file descriptor sent through SendBackendConn
+// over via, and reconstructs the backend connection (see BackendConnFromFile).
+func ReceiveBackendConn(via *net.UnixConn) (net.Conn, error) {
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := via.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, errors.Wrap(err, "receiving backend connection")
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, errors.Wrap(err, "receiving backend connection")
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			return nil, errors.Wrap(err, "receiving backend connection")
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			_ = syscall.Close(fd)
+		}
+		return nil, errors.Newf("expected 1 file descriptor, received %d", len(fds))
+	}
+	f := os.NewFile(uintptr(fds[0]), "backend-conn")
+	defer f.Close()
+	return BackendConnFromFile(f)
+}
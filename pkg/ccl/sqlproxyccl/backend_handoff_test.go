@@ -0,0 +1,120 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+//go:build !windows
+// +build !windows
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendConnHandoff(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	recvCh := make(chan string, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		if _, err := receiveStartupMessage(conn); err != nil {
+			return
+		}
+		if _, err := conn.Write((&pgproto3.AuthenticationOk{}).Encode(nil)); err != nil {
+			return
+		}
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err == nil {
+			recvCh <- string(buf)
+		}
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// via is a pair of connected Unix domain sockets, standing for the
+	// connection between the old and the new proxy process.
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(t.TempDir(), "handoff")})
+	require.NoError(t, err)
+	defer l.Close()
+	sender, err := net.DialUnix("unix", nil, l.Addr().(*net.UnixAddr))
+	require.NoError(t, err)
+	defer sender.Close()
+	receiver, err := l.AcceptUnix()
+	require.NoError(t, err)
+	defer receiver.Close()
+
+	t.Run("plaintext", func(t *testing.T) {
+		conn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+		require.NoError(t, err)
+		require.NoError(t, SendBackendConn(sender, conn))
+		// The backend doesn't see the original connection being closed.
+		require.NoError(t, conn.Close())
+
+		handedOff, err := ReceiveBackendConn(receiver)
+		require.NoError(t, err)
+		defer handedOff.Close()
+		_, ok := BackendTCPConn(handedOff)
+		require.True(t, ok)
+		fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(handedOff), handedOff)
+		msg, err := fe.Receive()
+		require.NoError(t, err)
+		require.Equal(t, &pgproto3.AuthenticationOk{}, msg)
+		_, err = handedOff.Write([]byte("ok"))
+		require.NoError(t, err)
+		require.Equal(t, "ok", <-recvCh)
+	})
+
+	t.Run("buffered data", func(t *testing.T) {
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil, /* tlsConfig */
+			PeekFirstMessage(func(pgproto3.BackendMessage) {}),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = BackendConnFile(conn)
+		require.EqualError(t, err, "connections with buffered data can't be handed off")
+
+		// Once the peeked message was read, the connection can be handed
+		// off.
+		_, err = io.ReadFull(conn, make([]byte, len((&pgproto3.AuthenticationOk{}).Encode(nil))))
+		require.NoError(t, err)
+		f, err := BackendConnFile(conn)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		serverCfg, err := tlsConfig()
+		require.NoError(t, err)
+		tlsAddr, stop := startTestBackend(t, func(conn net.Conn) {
+			tlsConn, err := acceptSSLRequest(conn, serverCfg)
+			if err != nil {
+				return
+			}
+			_, _ = receiveStartupMessage(tlsConn)
+		})
+		defer stop()
+
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), tlsAddr, &tls.Config{InsecureSkipVerify: true},
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.EqualError(t, SendBackendConn(sender, conn), "TLS connections can't be handed off")
+	})
+}
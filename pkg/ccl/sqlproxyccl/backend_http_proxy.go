@@ -0,0 +1,105 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/cockroachdb/errors"
+)
+
+// httpProxy contains the configuration of the HTTP proxy through which
+// backends are reached.
+type httpProxy struct {
+	url    *url.URL
+	header http.Header
+}
+
+// HTTPConnectProxy configures the dialer to reach TCP backends through a
+// tunnel established by the HTTP proxy at proxyURL, using the CONNECT method.
+// The TLS negotiation and the startup message relay then happen over the
+// tunnel. Only "http" proxy URLs are supported; if the URL contains a user and
+// password, they are sent to the proxy using basic authentication. header, if
+// set, contains additional headers sent with the CONNECT request, e.g. other
+// forms of Proxy-Authorization. Backends reached over a Unix domain socket are
+// not affected.
+//
+// Options which apply to the TCP connection (e.g. DialRetry, NetDialer or
+// KeepAlivePeriod), as well as DialDNSCache, apply to the connection to the
+// proxy. A failure to establish the tunnel, including a non-200 response from
+// the proxy, results in a codeBackendDown error.
+func HTTPConnectProxy(proxyURL *url.URL, header http.Header) DialOption {
+	return func(opts *dialOptions) {
+		opts.httpProxy = &httpProxy{url: proxyURL, header: header.Clone()}
+	}
+}
+
+// dialHTTPProxy connects to address through a tunnel established by the HTTP
+// proxy.
+func dialHTTPProxy(
+	ctx context.Context, address string, proxy *httpProxy, options *dialOptions,
+) (_ net.Conn, retErr error) {
+	if proxy.url.Scheme != "http" {
+		return nil, errors.Newf("unsupported proxy scheme %q", proxy.url.Scheme)
+	}
+	proxyAddr := proxy.url.Host
+	if proxy.url.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.url.Hostname(), "80")
+	}
+	conn, err := dialTCPConn(ctx, "tcp", proxyAddr, options)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dialing proxy %s", proxyAddr)
+	}
+	defer func() {
+		if retErr != nil {
+			conn.Close()
+		}
+	}()
+
+	stop := watchConnContext(ctx, conn)
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: proxy.header.Clone(),
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if user := proxy.url.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, errors.Wrapf(err, "sending CONNECT request to proxy %s", proxyAddr)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading CONNECT response from proxy %s", proxyAddr)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, errors.Newf("proxy %s refused CONNECT to %s: %s", proxyAddr, address, resp.Status)
+	}
+	if n := br.Buffered(); n > 0 {
+		// Don't lose the bytes that were buffered past the response, if any.
+		peeked, _ := br.Peek(n)
+		return &peekedConn{Conn: conn, peeked: append([]byte(nil), peeked...)}, nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestHTTPProxy starts an HTTP proxy which tunnels CONNECT requests
+// carrying the given Proxy-Authorization header. It returns the URL of the
+// proxy, and a channel which receives the target of each tunnel.
+func startTestHTTPProxy(
+	t *testing.T, wantAuth string,
+) (proxyURL *url.URL, targets <-chan string, stop func()) {
+	targetCh := make(chan string, 16)
+	var wg sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != wantAuth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		targetCh <- r.Host
+		backendConn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		clientConn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			backendConn.Close()
+			return
+		}
+		// Pipe the connections until either one is closed.
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, _ = io.Copy(backendConn, buf)
+			backendConn.Close()
+			clientConn.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			_, _ = io.Copy(clientConn, backendConn)
+			backendConn.Close()
+			clientConn.Close()
+		}()
+	}))
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	return u, targetCh, func() {
+		srv.Close()
+		wg.Wait()
+	}
+}
+
+func TestBackendDialHTTPConnectProxy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	addr, stopBackend := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		if msg, err := receiveStartupMessage(tlsConn); err == nil {
+			msgCh <- msg
+		}
+		_, _ = io.Copy(io.Discard, tlsConn)
+	})
+	defer stopBackend()
+
+	// "dXNlcjpzZWNyZXQ=" is "user:secret" in base64.
+	proxyURL, targets, stopProxy := startTestHTTPProxy(t, "Basic dXNlcjpzZWNyZXQ=")
+	defer stopProxy()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	t.Run("tunneled", func(t *testing.T) {
+		u := *proxyURL
+		u.User = url.UserPassword("user", "secret")
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, HTTPConnectProxy(&u, nil /* header */),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, addr, <-targets)
+		require.Equal(t, testStartupMessage(), <-msgCh)
+		_, isTLS := BackendTLSState(conn)
+		require.True(t, isTLS)
+	})
+
+	t.Run("custom header", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Proxy-Authorization", "Basic dXNlcjpzZWNyZXQ=")
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, HTTPConnectProxy(proxyURL, header),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, addr, <-targets)
+		require.Equal(t, testStartupMessage(), <-msgCh)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, HTTPConnectProxy(proxyURL, nil /* header */),
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Regexp(t, "refused CONNECT .* 407 Proxy Authentication Required", err)
+	})
+
+	t.Run("unsupported scheme", func(t *testing.T) {
+		u := *proxyURL
+		u.Scheme = "socks5"
+		_, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, HTTPConnectProxy(&u, nil /* header */),
+		)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Regexp(t, `unsupported proxy scheme "socks5"`, err)
+	})
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DialEventType identifies a transition in the lifecycle of a backend
+// connection. See LifecycleEvents.
+type DialEventType int
+
+const (
+	// DialStarted is emitted when a BackendDialContext call starts.
+	DialStarted DialEventType = iota
+	// DialSucceeded is emitted when a BackendDialContext call returns a
+	// connection.
+	DialSucceeded
+	// DialFailed is emitted when a BackendDialContext call returns an error.
+	DialFailed
+	// ConnClosed is emitted when a connection returned by BackendDialContext
+	// is closed for the first time.
+	ConnClosed
+)
+
+// String implements the fmt.Stringer interface.
+func (t DialEventType) String() string {
+	switch t {
+	case DialStarted:
+		return "dial-started"
+	case DialSucceeded:
+		return "dial-succeeded"
+	case DialFailed:
+		return "dial-failed"
+	case ConnClosed:
+		return "conn-closed"
+	default:
+		return "unknown"
+	}
+}
+
+// DialEvent describes a transition in the lifecycle of a backend connection.
+type DialEvent struct {
+	Type DialEventType
+	// ServerAddress is the address passed to BackendDialContext.
+	ServerAddress string
+	// ConnectionID is the correlation ID supplied through ConnectionID, if
+	// any.
+	ConnectionID string
+	// Time is the time at which the event occurred, as measured by the clock
+	// of the dialer.
+	Time time.Time
+	// Elapsed is the duration of the dial for DialSucceeded and DialFailed
+	// events, and the time elapsed since the dial succeeded for ConnClosed
+	// events. It is zero for DialStarted events.
+	Elapsed time.Duration
+	// Code is the code of the error of DialFailed events, or 0 if the error
+	// has no code (see ClassifyDialError).
+	Code ErrorCode
+	// Err is the error of DialFailed events.
+	Err error
+}
+
+// LifecycleEvents, if set, receives a DialEvent for each transition in the
+// lifecycle of the connections established through BackendDialContext (and
+// therefore BackendDial): dial start, dial success or failure, and close of
+// the connection. Events are sent without blocking, so that a slow consumer
+// can't stall dials: events which don't fit in the buffer of the channel are
+// dropped, and counted by DroppedLifecycleEvents. The channel is never closed
+// by the dialer.
+//
+// Only the dials which started while LifecycleEvents was set emit events.
+var LifecycleEvents chan<- DialEvent
+
+// droppedLifecycleEvents is the number of events which could not be sent to
+// LifecycleEvents. Accessed atomically.
+var droppedLifecycleEvents int64
+
+// DroppedLifecycleEvents returns the number of events which were dropped
+// because LifecycleEvents was full.
+func DroppedLifecycleEvents() int64 {
+	return atomic.LoadInt64(&droppedLifecycleEvents)
+}
+
+// emitDialEvent sends ev to LifecycleEvents, if set, without blocking.
+func emitDialEvent(ev DialEvent) {
+	ch := LifecycleEvents
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- ev:
+	default:
+		atomic.AddInt64(&droppedLifecycleEvents, 1)
+	}
+}
+
+// emitDialOutcome emits the DialSucceeded or DialFailed event of the dial to
+// serverAddress which started at start, and returned conn or err. On success,
+// the ConnClosed event of conn is emitted once it is closed. Nothing is emitted
+// if start is zero, i.e. if LifecycleEvents was not set when the dial started.
+func emitDialOutcome(
+	serverAddress string, options *dialOptions, start time.Time, conn net.Conn, err error,
+) {
+	if start.IsZero() {
+		return
+	}
+	now := timeSource.Now()
+	ev := DialEvent{
+		Type:          DialSucceeded,
+		ServerAddress: serverAddress,
+		ConnectionID:  options.connID,
+		Time:          now,
+		Elapsed:       now.Sub(start),
+	}
+	if err != nil {
+		ev.Type, ev.Code, ev.Err = DialFailed, getErrorCode(err), err
+		emitDialEvent(ev)
+		return
+	}
+	emitDialEvent(ev)
+	bc, ok := asBackendConn(conn)
+	if !ok {
+		return
+	}
+	established, prevOnClose := now, bc.onClose
+	bc.onClose = func() {
+		if prevOnClose != nil {
+			prevOnClose()
+		}
+		now := timeSource.Now()
+		emitDialEvent(DialEvent{
+			Type:          ConnClosed,
+			ServerAddress: serverAddress,
+			ConnectionID:  options.connID,
+			Time:          now,
+			Elapsed:       now.Sub(established),
+		})
+	}
+}
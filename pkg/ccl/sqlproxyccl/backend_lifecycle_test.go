@@ -0,0 +1,105 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycleEvents(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stop()
+	deadAddr := unusedTCPAddr(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events := make(chan DialEvent, 10)
+	defer testutils.TestingHook(&LifecycleEvents, chan<- DialEvent(events))()
+	nextEvent := func(t *testing.T) DialEvent {
+		select {
+		case ev := <-events:
+			return ev
+		default:
+			t.Fatal("no event")
+			return DialEvent{}
+		}
+	}
+
+	t.Run("success", func(t *testing.T) {
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil /* tlsConfig */, ConnectionID("42"),
+		)
+		require.NoError(t, err)
+
+		started := nextEvent(t)
+		require.Equal(t, DialStarted, started.Type)
+		require.Equal(t, addr, started.ServerAddress)
+		require.Equal(t, "42", started.ConnectionID)
+		require.Zero(t, started.Elapsed)
+
+		succeeded := nextEvent(t)
+		require.Equal(t, DialSucceeded, succeeded.Type)
+		require.Equal(t, "42", succeeded.ConnectionID)
+		require.Equal(t, succeeded.Time.Sub(started.Time), succeeded.Elapsed)
+		require.Empty(t, events)
+
+		require.NoError(t, conn.Close())
+		require.NoError(t, conn.Close())
+		closed := nextEvent(t)
+		require.Equal(t, ConnClosed, closed.Type)
+		require.Equal(t, addr, closed.ServerAddress)
+		require.Equal(t, closed.Time.Sub(succeeded.Time), closed.Elapsed)
+		require.Empty(t, events)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		_, err := BackendDialContext(ctx, testStartupMessage(), deadAddr, nil /* tlsConfig */)
+		require.Error(t, err)
+		require.Equal(t, DialStarted, nextEvent(t).Type)
+		failed := nextEvent(t)
+		require.Equal(t, DialFailed, failed.Type)
+		require.Equal(t, deadAddr, failed.ServerAddress)
+		require.Equal(t, CodeBackendDown, failed.Code)
+		require.Equal(t, err, failed.Err)
+		require.Empty(t, events)
+	})
+
+	t.Run("full channel", func(t *testing.T) {
+		full := make(chan DialEvent, 1)
+		defer testutils.TestingHook(&LifecycleEvents, chan<- DialEvent(full))()
+		dropped := DroppedLifecycleEvents()
+		conn, err := BackendDialContext(ctx, testStartupMessage(), addr, nil /* tlsConfig */)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+		require.Equal(t, DialStarted, (<-full).Type)
+		require.Equal(t, dropped+2, DroppedLifecycleEvents())
+	})
+}
+
+func TestDialEventTypeString(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	require.Equal(t, "dial-started", DialStarted.String())
+	require.Equal(t, "dial-succeeded", DialSucceeded.String())
+	require.Equal(t, "dial-failed", DialFailed.String())
+	require.Equal(t, "conn-closed", ConnClosed.String())
+	require.Equal(t, "unknown", DialEventType(42).String())
+}
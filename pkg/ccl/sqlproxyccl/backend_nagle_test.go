@@ -0,0 +1,67 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+//go:build !windows
+// +build !windows
+
+package sqlproxyccl
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendDialNagle(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, tc := range []struct {
+		opts    []DialOption
+		noDelay bool
+	}{
+		{nil, true},
+		{[]DialOption{EnableNagle()}, false},
+	} {
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil /* tlsConfig */, tc.opts...,
+		)
+		require.NoError(t, err)
+		noDelay := tcpNoDelay(t, conn)
+		require.NoError(t, conn.Close())
+		require.Equal(t, tc.noDelay, noDelay)
+	}
+}
+
+// tcpNoDelay returns whether the TCP_NODELAY option is set on the socket of
+// conn, a connection returned by BackendDialContext.
+func tcpNoDelay(t *testing.T, conn net.Conn) bool {
+	tcpConn, ok := BackendTCPConn(conn)
+	require.True(t, ok)
+	rawConn, err := tcpConn.SyscallConn()
+	require.NoError(t, err)
+	var noDelay int
+	var sockErr error
+	require.NoError(t, rawConn.Control(func(fd uintptr) {
+		noDelay, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	}))
+	require.NoError(t, sockErr)
+	return noDelay != 0
+}
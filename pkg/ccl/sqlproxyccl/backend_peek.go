@@ -0,0 +1,246 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// maxPeekedMessageSize is the maximum size of the first backend message that
+// is peeked by the dialer. Responses to a startup message (e.g. authentication
+// requests and errors) are much smaller.
+const maxPeekedMessageSize = 1 << 20 // 1 MiB
+
+// PeekFirstMessage configures the dialer to read the first message sent by
+// the backend in response to the startup message (e.g. an authentication
+// request or an ErrorResponse), and to invoke fn with it before returning the
+// connection, e.g. for diagnostics. The message is not consumed: its bytes are
+// replayed to the first reads of the returned connection. fn must not retain
+// the message after it returns.
+//
+// If the backend doesn't support the minor protocol version or some of the
+// protocol options (i.e. parameters prefixed by "_pq_.") requested by the
+// startup message, the first message is a *NegotiateProtocolVersion, which
+// lists the unsupported options. It is relayed to the client along with the
+// rest of the backend's response.
+//
+// Since the dial only completes once the backend responded, the time needed
+// by the backend to respond counts towards the dial timeout. Failing to read
+// the message results in a codeBackendDown error.
+func PeekFirstMessage(fn func(msg pgproto3.BackendMessage)) DialOption {
+	return func(opts *dialOptions) {
+		opts.peekFirstMessage = fn
+	}
+}
+
+// AuthTimeout configures the dialer to wait for the first message sent by the
+// backend in response to the startup message (usually the start of the
+// authentication exchange) before returning the connection, for up to
+// timeout, so that a backend which stalls before authenticating the client
+// (e.g. while waiting on an external identity provider) doesn't hold the
+// connection open indefinitely. As with PeekFirstMessage, the message is
+// replayed to the first reads of the returned connection, and no deadline is
+// left on the connection once it was received.
+//
+// If the message isn't received in time, the dial fails with a
+// codeBackendAuthTimeout error, which is not retryable. The message must also
+// be received before the deadline of the dial, which results in a
+// codeBackendDown error otherwise.
+func AuthTimeout(timeout time.Duration) DialOption {
+	return func(opts *dialOptions) {
+		opts.authTimeout = timeout
+	}
+}
+
+// awaitFirstMessage peeks at the first message sent by the backend over conn,
+// as configured by PeekFirstMessage and AuthTimeout, and returns a connection
+// which replays it.
+func awaitFirstMessage(ctx context.Context, conn net.Conn, opts *dialOptions) (net.Conn, error) {
+	fn := opts.peekFirstMessage
+	if fn == nil {
+		fn = func(pgproto3.BackendMessage) {}
+	}
+	if opts.authTimeout <= 0 {
+		return peekFirstMessage(ctx, conn, fn)
+	}
+	authDeadline := timeSource.Now().Add(opts.authTimeout)
+	authCtx, cancel := withClockTimeout(ctx, opts.authTimeout)
+	defer cancel()
+	peeked, err := peekFirstMessage(authCtx, conn, fn)
+	// The read may time out through a connection deadline slightly before
+	// authCtx is done.
+	if err != nil && !timeSource.Now().Before(authDeadline) {
+		if deadline, ok := ctx.Deadline(); !ok || authDeadline.Before(deadline) {
+			return nil, wrapErrorf(
+				codeBackendAuthTimeout, err,
+				"target server did not respond to the startup message within %s", opts.authTimeout,
+			)
+		}
+	}
+	return peeked, err
+}
+
+// peekFirstMessage reads the first message sent by the backend over conn,
+// invokes fn with it, and returns a connection which replays the bytes of the
+// message before reading from conn.
+func peekFirstMessage(
+	ctx context.Context, conn net.Conn, fn func(msg pgproto3.BackendMessage),
+) (_ net.Conn, err error) {
+	raw, err := readFirstMessage(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := decodeBackendMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	fn(msg)
+	return &peekedConn{Conn: conn, peeked: raw}, nil
+}
+
+// readFirstMessage returns the raw bytes of the next message read from conn.
+func readFirstMessage(ctx context.Context, conn net.Conn) ([]byte, error) {
+	stop := watchConnContext(ctx, conn)
+	defer stop()
+	return readBackendMessage(conn)
+}
+
+// readBackendMessage returns the raw bytes of the next message read from r,
+// which must be at most maxPeekedMessageSize bytes long.
+func readBackendMessage(r io.Reader) ([]byte, error) {
+	// The type of the message is followed by its length, which includes
+	// itself, but not the type.
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header[1:]))
+	if length < 4 || length-4 > maxPeekedMessageSize {
+		return nil, errors.Newf("invalid length %d for backend message %q", length, header[0])
+	}
+	raw := make([]byte, len(header)+length-4)
+	copy(raw, header)
+	if _, err := io.ReadFull(r, raw[len(header):]); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// decodeBackendMessage decodes raw, the bytes of a message returned by
+// readBackendMessage.
+func decodeBackendMessage(raw []byte) (pgproto3.BackendMessage, error) {
+	if raw[0] == pgNegotiateProtocolVersion {
+		// pgproto3 doesn't support this message.
+		msg := &NegotiateProtocolVersion{}
+		if err := msg.Decode(raw[5:]); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+	fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(bytes.NewReader(raw)), io.Discard)
+	return fe.Receive()
+}
+
+// peekedConn is a net.Conn wrapper which returns the bytes which were peeked
+// from the underlying connection before reading from it.
+type peekedConn struct {
+	net.Conn
+	// peeked contains the peeked bytes which were not read yet. Reads must
+	// not be called concurrently.
+	peeked []byte
+}
+
+var _ net.Conn = &peekedConn{}
+
+// Read implements the net.Conn interface.
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// NegotiateProtocolVersion is the message sent by the backend in response to a
+// startup message which requests a newer minor protocol version, or protocol
+// options, which the backend doesn't support. The backend proceeds with the
+// startup using the protocol version and options it supports.
+type NegotiateProtocolVersion struct {
+	// NewestMinorProtocol is the newest minor protocol version supported by the
+	// backend for the major protocol version requested by the client.
+	NewestMinorProtocol uint32
+	// UnsupportedOptions are the names of the protocol options requested by
+	// the client which the backend doesn't support.
+	UnsupportedOptions []string
+}
+
+var _ pgproto3.BackendMessage = &NegotiateProtocolVersion{}
+
+// Backend implements the pgproto3.BackendMessage interface.
+func (*NegotiateProtocolVersion) Backend() {}
+
+// Decode implements the pgproto3.BackendMessage interface. src must contain the
+// complete message, without its type and length.
+func (dst *NegotiateProtocolVersion) Decode(src []byte) error {
+	if len(src) < 8 {
+		return errors.Newf("invalid NegotiateProtocolVersion message of %d bytes", len(src))
+	}
+	dst.NewestMinorProtocol = binary.BigEndian.Uint32(src)
+	count := binary.BigEndian.Uint32(src[4:])
+	src = src[8:]
+	// Each option takes at least one byte.
+	if uint64(count) > uint64(len(src)) {
+		return errors.Newf("invalid NegotiateProtocolVersion option count %d", count)
+	}
+	dst.UnsupportedOptions = make([]string, 0, count)
+	for i := uint32(0); i < count; i++ {
+		idx := bytes.IndexByte(src, 0)
+		if idx < 0 {
+			return errors.New("invalid NegotiateProtocolVersion option: missing terminator")
+		}
+		dst.UnsupportedOptions = append(dst.UnsupportedOptions, string(src[:idx]))
+		src = src[idx+1:]
+	}
+	if len(src) > 0 {
+		return errors.Newf("invalid NegotiateProtocolVersion message: %d trailing bytes", len(src))
+	}
+	return nil
+}
+
+// Encode implements the pgproto3.BackendMessage interface, e.g. to synthesize
+// the message for clients. dst will include the type and length of the
+// message.
+func (src *NegotiateProtocolVersion) Encode(dst []byte) []byte {
+	start := len(dst)
+	dst = append(dst, pgNegotiateProtocolVersion, 0, 0, 0, 0)
+	dst = appendUint32(dst, src.NewestMinorProtocol)
+	dst = appendUint32(dst, uint32(len(src.UnsupportedOptions)))
+	for _, option := range src.UnsupportedOptions {
+		dst = append(dst, option...)
+		dst = append(dst, 0)
+	}
+	binary.BigEndian.PutUint32(dst[start+1:], uint32(len(dst)-start-1))
+	return dst
+}
+
+// appendUint32 appends the big-endian encoding of v to dst.
+func appendUint32(dst []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(dst, b[:]...)
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendDialPeekFirstMessage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("replayed", func(t *testing.T) {
+		backend, err := newTestBackend(nil /* serverTLSConfig */)
+		require.NoError(t, err)
+		defer backend.Close()
+
+		var peeked []pgproto3.BackendMessage
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), backend.Addr(), nil, /* tlsConfig */
+			PeekFirstMessage(func(msg pgproto3.BackendMessage) {
+				peeked = append(peeked, msg)
+			}),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, []pgproto3.BackendMessage{&pgproto3.AuthenticationOk{}}, peeked)
+
+		// The peeked message is still read by the next consumer, even with
+		// reads smaller than the message.
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(io.MultiReader(
+			bytes.NewReader(buf), conn,
+		)), conn)
+		msg, err := fe.Receive()
+		require.NoError(t, err)
+		require.Equal(t, &pgproto3.AuthenticationOk{}, msg)
+		msg, err = fe.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ReadyForQuery{}, msg)
+	})
+
+	t.Run("no response", func(t *testing.T) {
+		addr, stop := startTestBackend(t, func(conn net.Conn) {
+			_, _ = receiveStartupMessage(conn)
+		})
+		defer stop()
+
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil, /* tlsConfig */
+			PeekFirstMessage(func(msg pgproto3.BackendMessage) {
+				t.Fatalf("unexpected message %T", msg)
+			}),
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Regexp(t, "reading first message", err)
+	})
+
+	t.Run("NegotiateProtocolVersion", func(t *testing.T) {
+		negotiate := &NegotiateProtocolVersion{
+			NewestMinorProtocol: 0,
+			UnsupportedOptions:  []string{"_pq_.compression", "_pq_.tracing"},
+		}
+		addr, stop := startTestBackend(t, func(conn net.Conn) {
+			if _, err := receiveStartupMessage(conn); err != nil {
+				return
+			}
+			buf := negotiate.Encode(nil)
+			buf = (&pgproto3.AuthenticationOk{}).Encode(buf)
+			_, _ = conn.Write(buf)
+		})
+		defer stop()
+
+		var peeked pgproto3.BackendMessage
+		msg := testStartupMessage()
+		msg.Parameters["_pq_.compression"] = "on"
+		conn, err := BackendDialContext(
+			ctx, msg, addr, nil, /* tlsConfig */
+			PeekFirstMessage(func(msg pgproto3.BackendMessage) { peeked = msg }),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, negotiate, peeked)
+
+		// The message is relayed as is.
+		buf := make([]byte, len(negotiate.Encode(nil)))
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, negotiate.Encode(nil), buf)
+	})
+}
+
+func TestNegotiateProtocolVersionDecode(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, msg := range []*NegotiateProtocolVersion{
+		{NewestMinorProtocol: 2, UnsupportedOptions: []string{}},
+		{NewestMinorProtocol: 0, UnsupportedOptions: []string{"_pq_.a", ""}},
+	} {
+		raw := msg.Encode([]byte("prefix"))[len("prefix"):]
+		decoded, err := decodeBackendMessage(raw)
+		require.NoError(t, err)
+		require.Equal(t, msg, decoded)
+	}
+
+	for _, body := range [][]byte{
+		{0, 0, 0, 0},
+		{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 'a', 0},
+		{0, 0, 0, 0, 0, 0, 0, 1, 'a'},
+		{0, 0, 0, 0, 0, 0, 0, 1, 'a', 0, 'b'},
+	} {
+		err := (&NegotiateProtocolVersion{}).Decode(body)
+		require.Regexp(t, "invalid NegotiateProtocolVersion", err)
+	}
+}
+
+func TestBackendDialAuthTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const timeout = 50 * time.Millisecond
+	// respondCh controls whether the backend responds to the startup message.
+	respondCh := make(chan bool, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		if _, err := receiveStartupMessage(conn); err != nil {
+			return
+		}
+		if !<-respondCh {
+			_, _ = io.Copy(io.Discard, conn)
+			return
+		}
+		if _, err := conn.Write((&pgproto3.AuthenticationOk{}).Encode(nil)); err != nil {
+			return
+		}
+		// Subsequent messages are not subject to the timeout.
+		time.Sleep(2 * timeout)
+		_, _ = conn.Write((&pgproto3.ReadyForQuery{TxStatus: 'I'}).Encode(nil))
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("stalled", func(t *testing.T) {
+		respondCh <- false
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil /* tlsConfig */, AuthTimeout(timeout),
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendAuthTimeout, getErrorCode(err))
+		require.Regexp(t, "did not respond to the startup message within 50ms", err)
+		_, retryable := ClassifyDialError(err)
+		require.False(t, retryable)
+	})
+
+	t.Run("dial deadline", func(t *testing.T) {
+		respondCh <- false
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil /* tlsConfig */, AuthTimeout(time.Minute),
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+	})
+
+	t.Run("responded", func(t *testing.T) {
+		respondCh <- true
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, nil /* tlsConfig */, AuthTimeout(timeout),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+		msg, err := fe.Receive()
+		require.NoError(t, err)
+		require.Equal(t, &pgproto3.AuthenticationOk{}, msg)
+		msg, err = fe.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ReadyForQuery{}, msg)
+	})
+}
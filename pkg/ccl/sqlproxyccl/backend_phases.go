@@ -0,0 +1,125 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import "time"
+
+// DialPhase identifies a phase of a dial. A dial goes through the phases in
+// order, although some of them may be skipped (e.g. FinishStartupContext
+// starts with DialPhaseTLSHandshake), and some may be repeated (e.g. when
+// TLSFallback retries the dial).
+type DialPhase int
+
+const (
+	// DialPhaseResolving covers everything preceding the connection attempt:
+	// routing the startup message, resolving the backend address through
+	// AddressResolver, and waiting for DialConcurrency and DialLimiter.
+	DialPhaseResolving DialPhase = iota
+	// DialPhaseConnecting covers establishing the connection to the backend,
+	// including writing the PROXY protocol header.
+	DialPhaseConnecting
+	// DialPhaseTLSHandshake covers negotiating TLS (or GSSAPI encryption)
+	// with the backend.
+	DialPhaseTLSHandshake
+	// DialPhaseRelayingStartup covers relaying the startup message, and
+	// reading the first message of the backend if PeekFirstMessage or
+	// AuthTimeout is used.
+	DialPhaseRelayingStartup
+	// DialPhaseDone is entered once the dial is over, whether it succeeded or
+	// not.
+	DialPhaseDone
+)
+
+// String implements the fmt.Stringer interface.
+func (p DialPhase) String() string {
+	switch p {
+	case DialPhaseResolving:
+		return "resolve"
+	case DialPhaseConnecting:
+		return "dial"
+	case DialPhaseTLSHandshake:
+		return "TLS handshake"
+	case DialPhaseRelayingStartup:
+		return "startup relay"
+	case DialPhaseDone:
+		return "done"
+	default:
+		return "unknown"
+	}
+}
+
+// DialPhaseObserver is invoked each time a dial enters a phase, with the time
+// at which the phase was entered, as measured by the clock of the dialer. It is
+// invoked synchronously by the goroutine dialing, so it must not block.
+type DialPhaseObserver func(phase DialPhase, entered time.Time)
+
+// ObserveDialPhases configures the dialer to invoke fn as the dial goes through
+// its phases, which makes it possible to tell where a dial stalls. fn is
+// invoked with DialPhaseDone exactly once per BackendDialContext or
+// FinishStartupContext call, at its end. DialTiming.Observe can be used as fn
+// to collect the time spent in each phase.
+func ObserveDialPhases(fn DialPhaseObserver) DialOption {
+	return func(opts *dialOptions) {
+		opts.phaseObserver = fn
+	}
+}
+
+// enterDialPhase notifies the DialPhaseObserver of options, if any, that the
+// dial entered phase.
+func enterDialPhase(options *dialOptions, phase DialPhase) {
+	if options.phaseObserver != nil {
+		options.phaseObserver(phase, timeSource.Now())
+	}
+}
+
+// DialTiming is the breakdown of the time spent by a dial in each of its
+// phases. Its Observe method is a DialPhaseObserver, which records the phases
+// of a single dial. The zero value is ready to use. A DialTiming is not safe
+// for concurrent use.
+type DialTiming struct {
+	Resolving       time.Duration
+	Connecting      time.Duration
+	TLSHandshake    time.Duration
+	RelayingStartup time.Duration
+
+	// phase is the current phase of the dial, entered at entered. entered is
+	// zero until the first phase is entered.
+	phase   DialPhase
+	entered time.Time
+}
+
+// Observe implements DialPhaseObserver. The time elapsed since the previous
+// phase was entered is attributed to that phase.
+func (t *DialTiming) Observe(phase DialPhase, entered time.Time) {
+	if !t.entered.IsZero() {
+		elapsed := entered.Sub(t.entered)
+		switch t.phase {
+		case DialPhaseResolving:
+			t.Resolving += elapsed
+		case DialPhaseConnecting:
+			t.Connecting += elapsed
+		case DialPhaseTLSHandshake:
+			t.TLSHandshake += elapsed
+		case DialPhaseRelayingStartup:
+			t.RelayingStartup += elapsed
+		}
+	}
+	t.phase, t.entered = phase, entered
+}
+
+// Phase returns the phase the dial is currently in, and the time at which it
+// was entered. The time is zero if no phase was entered yet.
+func (t *DialTiming) Phase() (DialPhase, time.Time) {
+	return t.phase, t.entered
+}
+
+// Total returns the total time spent by the dial, up to the current phase.
+func (t *DialTiming) Total() time.Duration {
+	return t.Resolving + t.Connecting + t.TLSHandshake + t.RelayingStartup
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialTiming(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var timing DialTiming
+	phase, entered := timing.Phase()
+	require.Equal(t, DialPhaseResolving, phase)
+	require.True(t, entered.IsZero())
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	timing.Observe(DialPhaseResolving, start)
+	timing.Observe(DialPhaseConnecting, start.Add(1*time.Millisecond))
+	timing.Observe(DialPhaseTLSHandshake, start.Add(3*time.Millisecond))
+	timing.Observe(DialPhaseRelayingStartup, start.Add(6*time.Millisecond))
+	timing.Observe(DialPhaseDone, start.Add(10*time.Millisecond))
+	require.Equal(t, 1*time.Millisecond, timing.Resolving)
+	require.Equal(t, 2*time.Millisecond, timing.Connecting)
+	require.Equal(t, 3*time.Millisecond, timing.TLSHandshake)
+	require.Equal(t, 4*time.Millisecond, timing.RelayingStartup)
+	require.Equal(t, 10*time.Millisecond, timing.Total())
+	phase, entered = timing.Phase()
+	require.Equal(t, DialPhaseDone, phase)
+	require.Equal(t, start.Add(10*time.Millisecond), entered)
+}
+
+func TestObserveDialPhases(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = receiveStartupMessage(tlsConn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	// recordPhases returns a DialOption which records the phases of a dial
+	// into phases, and their timing into timing.
+	recordPhases := func(phases *[]DialPhase, timing *DialTiming) DialOption {
+		return ObserveDialPhases(func(phase DialPhase, entered time.Time) {
+			*phases = append(*phases, phase)
+			timing.Observe(phase, entered)
+		})
+	}
+
+	t.Run("dial", func(t *testing.T) {
+		var phases []DialPhase
+		var timing DialTiming
+		start := time.Now()
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, recordPhases(&phases, &timing),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, []DialPhase{
+			DialPhaseResolving, DialPhaseConnecting, DialPhaseTLSHandshake,
+			DialPhaseRelayingStartup, DialPhaseDone,
+		}, phases)
+		require.Greater(t, int64(timing.TLSHandshake), int64(0))
+		require.LessOrEqual(t, int64(timing.Total()), int64(time.Since(start)))
+	})
+
+	t.Run("failed dial", func(t *testing.T) {
+		deadAddr := unusedTCPAddr(t)
+
+		var phases []DialPhase
+		_, err := BackendDialContext(
+			ctx, testStartupMessage(), deadAddr, clientCfg, recordPhases(&phases, &DialTiming{}),
+		)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Equal(t, []DialPhase{
+			DialPhaseResolving, DialPhaseConnecting, DialPhaseDone,
+		}, phases)
+	})
+
+	t.Run("finish startup", func(t *testing.T) {
+		rawConn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer rawConn.Close()
+
+		var phases []DialPhase
+		conn, err := FinishStartupContext(
+			ctx, rawConn, testStartupMessage(), clientCfg, recordPhases(&phases, &DialTiming{}),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, []DialPhase{
+			DialPhaseTLSHandshake, DialPhaseRelayingStartup, DialPhaseDone,
+		}, phases)
+	})
+}
@@ -0,0 +1,232 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// BackendPool maintains a set of connections to a backend which are dialed
+// ahead of time, so that the latency of establishing the TCP connection is
+// taken off the hot path. Since the startup message carries the user and
+// database, it can't be shared across sessions: the pooled connections are
+// raw connections on which FinishStartupContext must be called, which Dial
+// does.
+//
+// Connections which are handed out are replaced asynchronously. Pooled
+// connections are health-checked when handed out and when returned through
+// Put, so that connections which were closed by the backend (or which
+// received unexpected data) are discarded.
+type BackendPool struct {
+	serverAddress string
+	size          int
+	opts          []DialOption
+	options       *dialOptions
+
+	// ctx is canceled when the pool is closed, which aborts pending dials.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu struct {
+		syncutil.Mutex
+		// conns contains the pooled connections.
+		conns []net.Conn
+		// filling is the number of connections being dialed.
+		filling int
+		closed  bool
+	}
+}
+
+// NewBackendPool returns a pool which keeps size connections to the backend at
+// serverAddress. The options which apply to establishing the connection (e.g.
+// DialRetry, KeepAlivePeriod, NetDialer or HTTPConnectProxy) are used to dial
+// the pooled connections, and the others are used by Dial to finish the
+// startup. ProxyProtocol must not be used, since the PROXY protocol header
+// describes a single client. Close must be called to release the resources of
+// the pool.
+func NewBackendPool(serverAddress string, size int, opts ...DialOption) *BackendPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &BackendPool{
+		serverAddress: serverAddress,
+		size:          size,
+		opts:          opts,
+		options:       newDialOptions(opts),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refillLocked()
+	return p
+}
+
+// Get returns a raw connection to the backend, which is either a pooled
+// connection, or a new connection if the pool is empty. The startup must be
+// finished by calling FinishStartupContext on the connection, and the
+// connection may be returned to the pool using Put if it wasn't used.
+func (p *BackendPool) Get(ctx context.Context) (net.Conn, error) {
+	for {
+		conn, err := p.pop()
+		if err != nil {
+			return nil, err
+		}
+		if conn == nil {
+			return p.dial(ctx)
+		}
+		if isHealthyPooledConn(conn) {
+			return conn, nil
+		}
+		_ = conn.Close()
+	}
+}
+
+// pop removes a connection from the pool, and starts dialing its replacement.
+// It returns nil if the pool is empty.
+func (p *BackendPool) pop() (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mu.closed {
+		return nil, errors.New("backend pool is closed")
+	}
+	var conn net.Conn
+	if n := len(p.mu.conns); n > 0 {
+		conn = p.mu.conns[n-1]
+		p.mu.conns = p.mu.conns[:n-1]
+	}
+	p.refillLocked()
+	return conn, nil
+}
+
+// Put returns conn, which must have been returned by Get, and on which the
+// startup was not finished, to the pool. conn is closed instead if the pool is
+// full, or if it isn't healthy.
+func (p *BackendPool) Put(conn net.Conn) {
+	if !isHealthyPooledConn(conn) {
+		_ = conn.Close()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mu.closed || len(p.mu.conns) >= p.size {
+		_ = conn.Close()
+		return
+	}
+	p.mu.conns = append(p.mu.conns, conn)
+}
+
+// Dial is like BackendDialContext, but uses a connection returned by Get. If
+// msg can't be relayed over a pooled connection, the error is returned, and
+// the connection is discarded.
+func (p *BackendPool) Dial(
+	ctx context.Context, msg *pgproto3.StartupMessage, tlsConfig *tls.Config,
+) (net.Conn, error) {
+	conn, err := p.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	backendConn, err := FinishStartupContext(ctx, conn, msg, tlsConfig, p.opts...)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return backendConn, nil
+}
+
+// Len returns the number of pooled connections.
+func (p *BackendPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.mu.conns)
+}
+
+// Close closes the pooled connections, and waits for the pending dials to
+// complete. Connections which were handed out are not affected.
+func (p *BackendPool) Close() {
+	p.mu.Lock()
+	p.mu.closed = true
+	conns := p.mu.conns
+	p.mu.conns = nil
+	p.mu.Unlock()
+
+	p.cancel()
+	p.wg.Wait()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// refillLocked starts dialing connections asynchronously until the pool is
+// full, taking the pending dials into account.
+func (p *BackendPool) refillLocked() {
+	for ; !p.mu.closed && len(p.mu.conns)+p.mu.filling < p.size; p.mu.filling++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			conn, err := p.dial(p.ctx)
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.mu.filling--
+			if err != nil {
+				// Don't retry right away, since the backend is likely down.
+				// The pool is refilled when the next connection is handed out.
+				return
+			}
+			if p.mu.closed || len(p.mu.conns) >= p.size {
+				_ = conn.Close()
+				return
+			}
+			p.mu.conns = append(p.mu.conns, conn)
+		}()
+	}
+}
+
+// dial establishes a new raw connection to the backend.
+func (p *BackendPool) dial(ctx context.Context) (net.Conn, error) {
+	if err := validateDialNetwork(p.options); err != nil {
+		return nil, err
+	}
+	ctx, cancel := withDefaultDialTimeout(ctx)
+	defer cancel()
+	network, address := backendNetworkAddress(p.serverAddress)
+	conn, err := dialBackendConn(ctx, network, address, p.options)
+	if getErrorCode(err) == codeBackendAddressForbidden {
+		return nil, err
+	}
+	if err != nil {
+		return nil, newConnectError(err)
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := configureTCPConn(tcpConn, p.options); err != nil {
+			_ = conn.Close()
+			return nil, newErrorf(
+				codeBackendDown, "configuring connection to target server %v: %v",
+				p.serverAddress, err)
+		}
+	}
+	return conn, nil
+}
+
+// isHealthyPooledConn returns whether conn, a raw connection on which no
+// startup message was sent, is still usable. Since the backend doesn't send
+// anything before receiving a startup message, the connection is healthy if
+// it is alive (see ProbeBackendConn) and no data was received: any data, such
+// as an ErrorResponse, indicates that the connection is unusable.
+func isHealthyPooledConn(conn net.Conn) bool {
+	pending, err := probeConn(conn)
+	return err == nil && !pending
+}
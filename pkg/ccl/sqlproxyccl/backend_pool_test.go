@@ -0,0 +1,105 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendPool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	backend, err := newTestBackend(nil /* serverTLSConfig */)
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pool := NewBackendPool(backend.Addr(), 2 /* size */)
+	defer pool.Close()
+	waitForLen := func(n int) {
+		testutils.SucceedsSoon(t, func() error {
+			if l := pool.Len(); l != n {
+				return errors.Newf("expected %d pooled connections, found %d", n, l)
+			}
+			return nil
+		})
+	}
+	waitForLen(2)
+	// makeRoom discards a pooled connection, without replacing it.
+	makeRoom := func() {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		require.NoError(t, pool.mu.conns[0].Close())
+		pool.mu.conns = pool.mu.conns[1:]
+	}
+
+	// The startup is finished over a pooled connection, which is replaced.
+	conn, err := pool.Dial(ctx, testStartupMessage(), nil /* tlsConfig */)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, testStartupMessage(), <-backend.StartupMessages())
+	fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+	msg, err := fe.Receive()
+	require.NoError(t, err)
+	require.Equal(t, &pgproto3.AuthenticationOk{}, msg)
+	waitForLen(2)
+
+	// Unused connections can be returned to the pool, unless it is full.
+	raw, err := pool.Get(ctx)
+	require.NoError(t, err)
+	waitForLen(2)
+	pool.Put(raw)
+	require.Equal(t, 2, pool.Len())
+	_, err = raw.Read(make([]byte, 1))
+	require.True(t, errors.Is(err, net.ErrClosed))
+
+	raw, err = pool.Get(ctx)
+	require.NoError(t, err)
+	waitForLen(2)
+	makeRoom()
+	pool.Put(raw)
+	require.Equal(t, 2, pool.Len())
+
+	// Connections on which data was received are discarded.
+	raw, err = pool.Get(ctx)
+	require.NoError(t, err)
+	_, err = raw.Write(testStartupMessage().Encode(nil))
+	require.NoError(t, err)
+	<-backend.StartupMessages()
+	waitForLen(2)
+	testutils.SucceedsSoon(t, func() error {
+		// Wait for the response of the backend to be received.
+		if isHealthyPooledConn(raw) {
+			return errors.New("connection is still healthy")
+		}
+		return nil
+	})
+	makeRoom()
+	pool.Put(raw)
+	require.Equal(t, 1, pool.Len())
+	_, err = raw.Read(make([]byte, 1))
+	require.True(t, errors.Is(err, net.ErrClosed))
+
+	// A closed pool doesn't hand out connections.
+	pool.Close()
+	require.Equal(t, 0, pool.Len())
+	_, err = pool.Get(ctx)
+	require.Regexp(t, "backend pool is closed", err)
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// backendProbeTimeout is the time spent waiting for data when probing a
+// connection which can't be peeked at.
+const backendProbeTimeout = time.Millisecond
+
+// errUnexpectedData is returned when probing a connection on which data was
+// received, and which can't be peeked at.
+var errUnexpectedData = errors.New("unexpected data received on idle backend connection")
+
+// ProbeBackendConn checks whether conn, an idle connection to a backend (e.g.
+// a raw connection of a BackendPool, or a connection returned by BackendDial),
+// is still alive, without blocking and without disturbing the state of the
+// session. It returns an error if the backend closed or reset the connection,
+// in which case the connection should be discarded.
+//
+// Since a zero-byte read returns immediately in Go without reaching the
+// socket, the probe peeks at the socket of TCP and Unix domain socket
+// connections without consuming anything: data waiting to be read indicates
+// that the connection is alive. Other connections, or all connections on
+// platforms which don't support peeking, are probed by reading from them with
+// a short deadline instead, in which case received data is consumed, and an
+// error is returned since the connection is then unusable.
+//
+// The probe must only be run on idle connections, i.e. with no protocol
+// exchange in flight and no concurrent reads, since it would otherwise race
+// with the reads of the session.
+func ProbeBackendConn(conn net.Conn) error {
+	_, err := probeConn(conn)
+	return err
+}
+
+// probeConn implements ProbeBackendConn, and returns whether data is waiting
+// to be read from conn.
+func probeConn(conn net.Conn) (pending bool, _ error) {
+	var raw net.Conn = conn
+	if tcpConn, ok := BackendTCPConn(conn); ok {
+		raw = tcpConn
+	}
+	if sc, ok := raw.(syscall.Conn); ok {
+		if pending, ok, err := peekConn(sc); ok {
+			return pending, err
+		}
+	}
+	return false, probeConnRead(conn)
+}
+
+// probeConnRead probes conn by attempting to read from it with a short
+// deadline. The connection is alive if the read times out.
+func probeConnRead(conn net.Conn) error {
+	if err := conn.SetReadDeadline(timeutil.Now().Add(backendProbeTimeout)); err != nil {
+		return err
+	}
+	var buf [1]byte
+	n, err := conn.Read(buf[:])
+	if n > 0 {
+		return errUnexpectedData
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		if err == nil {
+			err = errUnexpectedData
+		}
+		return err
+	}
+	return conn.SetReadDeadline(time.Time{})
+}
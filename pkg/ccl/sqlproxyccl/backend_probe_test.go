@@ -0,0 +1,114 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeBackendConn(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// awaitUnhealthy waits for the probe of conn to fail.
+	awaitUnhealthy := func(t *testing.T, conn net.Conn) error {
+		var err error
+		testutils.SucceedsSoon(t, func() error {
+			if err = ProbeBackendConn(conn); err == nil {
+				return errors.New("connection is still healthy")
+			}
+			return nil
+		})
+		return err
+	}
+
+	t.Run("TCP", func(t *testing.T) {
+		sendCh := make(chan struct{})
+		addr, stop := startTestBackend(t, func(conn net.Conn) {
+			<-sendCh
+			_, _ = conn.Write([]byte("x"))
+			<-sendCh
+		})
+		defer stop()
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, ProbeBackendConn(conn))
+
+		// Pending data is not consumed.
+		sendCh <- struct{}{}
+		testutils.SucceedsSoon(t, func() error {
+			if pending, err := probeConn(conn); err != nil || !pending {
+				return errors.Newf("no pending data (err: %v)", err)
+			}
+			return nil
+		})
+		require.NoError(t, ProbeBackendConn(conn))
+		require.False(t, isHealthyPooledConn(conn))
+		buf := make([]byte, 1)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "x", string(buf))
+
+		// The backend closes the connection.
+		close(sendCh)
+		require.True(t, errors.Is(awaitUnhealthy(t, conn), io.EOF))
+	})
+
+	t.Run("BackendDial", func(t *testing.T) {
+		serverCfg, err := tlsConfig()
+		require.NoError(t, err)
+		closeCh := make(chan struct{})
+		addr, stop := startTestBackend(t, func(conn net.Conn) {
+			tlsConn, err := acceptSSLRequest(conn, serverCfg)
+			if err != nil {
+				return
+			}
+			if _, err := receiveStartupMessage(tlsConn); err != nil {
+				return
+			}
+			<-closeCh
+		})
+		defer stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, &tls.Config{InsecureSkipVerify: true},
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, ProbeBackendConn(conn))
+		close(closeCh)
+		require.Error(t, awaitUnhealthy(t, conn))
+	})
+
+	t.Run("not peekable", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		require.NoError(t, ProbeBackendConn(clientConn))
+
+		go func() { _, _ = serverConn.Write([]byte("x")) }()
+		require.True(t, errors.Is(awaitUnhealthy(t, clientConn), errUnexpectedData))
+
+		_ = serverConn.Close()
+		require.Error(t, awaitUnhealthy(t, clientConn))
+	})
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+//go:build !windows
+// +build !windows
+
+package sqlproxyccl
+
+import (
+	"io"
+	"syscall"
+
+	"github.com/cockroachdb/errors"
+)
+
+// peekConn peeks at the socket of sc without blocking, and returns whether
+// data is waiting to be read, or the error if the connection was closed or
+// reset. ok is false if the socket can't be peeked at.
+func peekConn(sc syscall.Conn) (pending, ok bool, err error) {
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return false, false, nil
+	}
+	var n int
+	var peekErr error
+	var buf [1]byte
+	if err := rawConn.Read(func(fd uintptr) bool {
+		n, _, peekErr = syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		// Don't wait for the socket to be readable.
+		return true
+	}); err != nil {
+		// The connection was closed locally.
+		return false, true, err
+	}
+	switch {
+	case errors.Is(peekErr, syscall.EAGAIN) || errors.Is(peekErr, syscall.EWOULDBLOCK):
+		return false, true, nil
+	case peekErr != nil:
+		return false, true, peekErr
+	case n == 0:
+		return false, true, io.EOF
+	}
+	return true, true, nil
+}
@@ -0,0 +1,17 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import "syscall"
+
+// peekConn is not supported on Windows, where connections are probed by
+// reading from them.
+func peekConn(sc syscall.Conn) (pending, ok bool, err error) {
+	return false, false, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// DefaultDNSCacheTTL is the suggested TTL for a DNSCache.
+const DefaultDNSCacheTTL = 5 * time.Second
+
+// DNSCache caches the IP addresses that backend hostnames resolve to, so that
+// reconnection storms do not trigger a DNS lookup for every dial. Dials to a
+// cached host are spread across its addresses in a round-robin fashion. If
+// dialing a cached address fails, the address is evicted, and the dial is
+// retried once with a fresh lookup of the host.
+//
+// Since a single address is dialed at a time, connections to hosts resolved
+// through the cache do not race IPv4 and IPv6 addresses (see
+// newBackendDialer).
+type DNSCache struct {
+	ttl        time.Duration
+	timeSource timeutil.TimeSource
+	// lookupHost resolves a host to its addresses. It can be overridden in
+	// tests.
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu struct {
+		syncutil.Mutex
+		entries map[string]*dnsCacheEntry
+	}
+}
+
+// dnsCacheEntry contains the cached addresses of a host.
+type dnsCacheEntry struct {
+	addrs     []string
+	expiresAt time.Time
+	// next is the index of the address returned by the next lookup.
+	next int
+}
+
+// NewDNSCache returns a DNSCache which caches lookups for ttl. A zero ttl
+// disables caching, in which case dialing behaves as if no cache were set. If
+// timeSource is nil, timeutil.DefaultTimeSource is used.
+func NewDNSCache(ttl time.Duration, timeSource timeutil.TimeSource) *DNSCache {
+	if timeSource == nil {
+		timeSource = timeutil.DefaultTimeSource{}
+	}
+	c := &DNSCache{
+		ttl:        ttl,
+		timeSource: timeSource,
+		lookupHost: net.DefaultResolver.LookupHost,
+	}
+	c.mu.entries = make(map[string]*dnsCacheEntry)
+	return c
+}
+
+// DialDNSCache, if set, is used by every BackendDialContext call to resolve
+// the hostnames of TCP backends. See DNSCache for more details.
+var DialDNSCache *DNSCache
+
+// dialContext dials address through dialer, resolving its host through the
+// cache. Addresses which do not contain a hostname are dialed as is.
+func (c *DNSCache) dialContext(
+	ctx context.Context, dialer *net.Dialer, network, address string,
+) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if c.ttl <= 0 || network != "tcp" || err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	ip, cached, err := c.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+	if err == nil || !cached {
+		return conn, err
+	}
+	// The cached address may be stale. Evict it, and try again with a fresh
+	// lookup.
+	c.evict(host, ip)
+	if ip, err = c.lookup(ctx, host); err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+}
+
+// resolve returns the next address of host. cached is true if the address was
+// served from the cache, rather than from a fresh lookup.
+func (c *DNSCache) resolve(ctx context.Context, host string) (ip string, cached bool, _ error) {
+	c.mu.Lock()
+	if e, ok := c.mu.entries[host]; ok && len(e.addrs) > 0 &&
+		c.timeSource.Now().Before(e.expiresAt) {
+		ip = e.addrs[e.next%len(e.addrs)]
+		e.next++
+		c.mu.Unlock()
+		return ip, true, nil
+	}
+	c.mu.Unlock()
+	ip, err := c.lookup(ctx, host)
+	return ip, false, err
+}
+
+// lookup resolves host, caches its addresses, and returns the first one.
+func (c *DNSCache) lookup(ctx context.Context, host string) (string, error) {
+	addrs, err := c.lookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", &net.DNSError{Err: "no addresses found", Name: host, IsNotFound: true}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mu.entries[host] = &dnsCacheEntry{
+		addrs:     addrs,
+		expiresAt: c.timeSource.Now().Add(c.ttl),
+		next:      1,
+	}
+	return addrs[0], nil
+}
+
+// evict removes ip from the cached addresses of host.
+func (c *DNSCache) evict(host, ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.mu.entries[host]
+	if !ok {
+		return
+	}
+	for i, addr := range e.addrs {
+		if addr == ip {
+			e.addrs = append(e.addrs[:i:i], e.addrs[i+1:]...)
+			break
+		}
+	}
+	if len(e.addrs) == 0 {
+		delete(c.mu.entries, host)
+	}
+}
+
+// ChainResolvers returns an address resolver, suitable for AddressResolver,
+// which tries resolvers in order, e.g. to fall back to the backends of a
+// secondary region when none of the backends of the primary region are
+// available. The address returned by the first resolver which succeeds with a
+// non-empty address is dialed. If all the resolvers fail, or return an empty
+// address, the returned error lists the failure of each of them. Resolution
+// stops early if the context is done.
+func ChainResolvers(
+	resolvers ...func(ctx context.Context, serverAddress string) (string, error),
+) func(ctx context.Context, serverAddress string) (string, error) {
+	return func(ctx context.Context, serverAddress string) (string, error) {
+		failures := make([]string, 0, len(resolvers))
+		for i, resolve := range resolvers {
+			resolved, err := resolve(ctx, serverAddress)
+			if err == nil && resolved != "" {
+				return resolved, nil
+			}
+			if err == nil {
+				err = errors.New("no address")
+			}
+			failures = append(failures, fmt.Sprintf("resolver %d: %v", i, err))
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return "", errors.Newf(
+			"no resolver returned an address for %s (%d attempted): %s",
+			serverAddress, len(failures), strings.Join(failures, "; "),
+		)
+	}
+}
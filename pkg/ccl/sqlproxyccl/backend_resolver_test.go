@@ -0,0 +1,172 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	clock := timeutil.NewManualTime(timeutil.Unix(0, 0))
+	c := NewDNSCache(time.Second, clock)
+	var lookups int
+	c.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		return []string{"10.0.0.1", "10.0.0.2"}, nil
+	}
+
+	resolve := func() string {
+		ip, _, err := c.resolve(ctx, "backend")
+		require.NoError(t, err)
+		return ip
+	}
+
+	// Addresses are served round-robin until the TTL expires.
+	require.Equal(t, "10.0.0.1", resolve())
+	require.Equal(t, "10.0.0.2", resolve())
+	require.Equal(t, "10.0.0.1", resolve())
+	require.Equal(t, 1, lookups)
+	clock.Advance(time.Second)
+	require.Equal(t, "10.0.0.1", resolve())
+	require.Equal(t, 2, lookups)
+
+	// Evicted addresses are no longer served.
+	c.evict("backend", "10.0.0.1")
+	require.Equal(t, "10.0.0.2", resolve())
+	require.Equal(t, "10.0.0.2", resolve())
+	c.evict("backend", "10.0.0.2")
+	require.Equal(t, "10.0.0.1", resolve())
+	require.Equal(t, 3, lookups)
+}
+
+func TestBackendDialDNSCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		_, _ = receiveStartupMessage(conn)
+	})
+	defer stop()
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	hostAddr := net.JoinHostPort("backend.example", port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dial := func() error {
+		conn, err := BackendDialContext(ctx, testStartupMessage(), hostAddr, nil /* tlsConfig */)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err
+	}
+
+	// Nothing listens on 127.0.0.2, which simulates a stale record.
+	answers := [][]string{{"127.0.0.2"}, {"127.0.0.1"}}
+	var lookups int
+	cache := NewDNSCache(time.Hour, nil /* timeSource */)
+	cache.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		require.Equal(t, "backend.example", host)
+		ips := answers[lookups%len(answers)]
+		lookups++
+		return ips, nil
+	}
+	defer testutils.TestingHook(&DialDNSCache, cache)()
+
+	// A fresh lookup which resolves to a dead address fails the dial.
+	require.Regexp(t, "unable to reach backend SQL server", dial())
+	require.Equal(t, 1, lookups)
+
+	// The stale cached address is evicted, and the dial is retried with a
+	// fresh lookup.
+	require.NoError(t, dial())
+	require.Equal(t, 2, lookups)
+
+	// Subsequent dials are served from the cache.
+	require.NoError(t, dial())
+	require.Equal(t, 2, lookups)
+
+	// A zero TTL disables the cache.
+	disabled := NewDNSCache(0 /* ttl */, nil /* timeSource */)
+	disabled.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		t.Fatal("unexpected lookup")
+		return nil, nil
+	}
+	defer testutils.TestingHook(&DialDNSCache, disabled)()
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), net.JoinHostPort("localhost", port), nil, /* tlsConfig */
+	)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+}
+
+func TestChainResolvers(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	var calls []string
+	resolver := func(name, resolved string, err error) func(context.Context, string) (string, error) {
+		return func(ctx context.Context, serverAddress string) (string, error) {
+			calls = append(calls, name)
+			return resolved, err
+		}
+	}
+
+	resolve := ChainResolvers(
+		resolver("primary", "", errors.New("region down")),
+		resolver("empty", "", nil),
+		resolver("secondary", "10.0.1.1:26257", nil),
+		resolver("unused", "10.0.2.1:26257", nil),
+	)
+	addr, err := resolve(ctx, "tenant:26257")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.1.1:26257", addr)
+	require.Equal(t, []string{"primary", "empty", "secondary"}, calls)
+
+	calls = nil
+	resolve = ChainResolvers(
+		resolver("primary", "", errors.New("region down")),
+		resolver("secondary", "", nil),
+	)
+	_, err = resolve(ctx, "tenant:26257")
+	require.EqualError(t, err, "no resolver returned an address for tenant:26257 (2 attempted): "+
+		"resolver 0: region down; resolver 1: no address")
+	require.Equal(t, []string{"primary", "secondary"}, calls)
+
+	// Resolution stops once the context is done.
+	calls = nil
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	resolve = ChainResolvers(
+		resolver("primary", "", context.Canceled), resolver("secondary", "10.0.1.1:26257", nil),
+	)
+	_, err = resolve(canceledCtx, "tenant:26257")
+	require.Regexp(t, `\(1 attempted\): resolver 0: context canceled`, err)
+	require.Equal(t, []string{"primary"}, calls)
+
+	// The errors of the chain are wrapped by the dialer as any other
+	// resolver error.
+	defer testutils.TestingHook(&AddressResolver, ChainResolvers(
+		resolver("primary", "", errors.New("region down")),
+	))()
+	_, err = BackendDialContext(ctx, testStartupMessage(), "tenant:26257", nil /* tlsConfig */)
+	require.Equal(t, codeBackendDown, getErrorCode(err))
+	require.Regexp(t, "resolving backend address tenant:26257: no resolver returned an address", err)
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"crypto/tls"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// StartupParamRouter returns the address of the backend to which a connection
+// is routed, based on the parameters of its startup message.
+type StartupParamRouter func(params map[string]string) (string, error)
+
+// RouteByStartupParams configures the dialer to derive the backend address
+// from the parameters of the startup message (e.g. the database, or a custom
+// cluster parameter), through router, in place of the serverAddress passed to
+// BackendDialContext, which may be left empty. router is invoked with a copy
+// of the parameters before StartupParamRewriter is applied, and before
+// AddressResolver, which translates the address it returned. This allows
+// proxies which route by database name to keep their routing logic in the
+// dialer.
+//
+// If router returns an error, or an empty address, the dial fails before the
+// backend is contacted with a codeParamsRoutingFailed error, unless the error
+// already has a code attached. The error is not retryable.
+func RouteByStartupParams(router StartupParamRouter) DialOption {
+	return func(opts *dialOptions) {
+		opts.router = router
+	}
+}
+
+// StartupParamRoutes returns a StartupParamRouter which routes connections by
+// the value of the param startup parameter, using routes, which maps values to
+// backend addresses. Connections without the parameter, or with a value
+// missing from routes, are not routable.
+func StartupParamRoutes(param string, routes map[string]string) StartupParamRouter {
+	return func(params map[string]string) (string, error) {
+		value, ok := params[param]
+		if !ok || value == "" {
+			return "", errors.Newf("missing startup parameter %q", param)
+		}
+		address, ok := routes[value]
+		if !ok {
+			return "", errors.Newf("no backend for startup parameter %s=%q", param, value)
+		}
+		return address, nil
+	}
+}
+
+// routeStartupMsg returns the backend address to which msg is routed by
+// router.
+func routeStartupMsg(router StartupParamRouter, msg *pgproto3.StartupMessage) (string, error) {
+	params := StartupParams(msg)
+	address, err := router(params)
+	if err == nil && address == "" {
+		err = errors.New("no backend address returned")
+	}
+	if err != nil {
+		if getErrorCode(err) != 0 {
+			return "", err
+		}
+		return "", wrapErrorf(codeParamsRoutingFailed, err, "routing by startup parameters")
+	}
+	return address, nil
+}
+
+// TLSConfigByStartupParams configures the dialer to derive the tls.Config
+// used to negotiate TLS with the backend from the parameters of the startup
+// message, through fn, in place of the tlsConfig passed to
+// BackendDialContext, e.g. so that the backends of each tenant are verified
+// against the CA pool of the tenant. fn is invoked with a copy of the
+// parameters before StartupParamRewriter is applied, and the returned config is
+// cloned before use, so it may be shared by several dials but must not be
+// modified afterwards. If fn returns a nil config, the connection is not
+// upgraded to TLS (see RequireTLS). The option also applies to
+// FinishStartupContext.
+//
+// If fn returns an error, the dial fails before the backend is contacted with
+// a codeParamsRoutingFailed error, unless the error already has a code
+// attached. The error is not retryable.
+func TLSConfigByStartupParams(
+	fn func(params map[string]string) (*tls.Config, error),
+) DialOption {
+	return func(opts *dialOptions) {
+		opts.tlsConfigFunc = fn
+	}
+}
+
+// resolveTLSConfig returns the tls.Config to use to dial the backend for msg:
+// the config returned by the function configured through
+// TLSConfigByStartupParams if any, or tlsConfig otherwise.
+func resolveTLSConfig(
+	msg *pgproto3.StartupMessage, tlsConfig *tls.Config, options *dialOptions,
+) (*tls.Config, error) {
+	// A missing message is rejected when it is relayed.
+	if options.tlsConfigFunc == nil || msg == nil {
+		return tlsConfig, nil
+	}
+	params := StartupParams(msg)
+	cfg, err := options.tlsConfigFunc(params)
+	if err != nil {
+		if getErrorCode(err) != 0 {
+			return nil, err
+		}
+		return nil, wrapErrorf(
+			codeParamsRoutingFailed, err, "resolving TLS config by startup parameters",
+		)
+	}
+	return cfg, nil
+}
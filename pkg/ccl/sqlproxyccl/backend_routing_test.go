@@ -0,0 +1,172 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendDialRouteByStartupParams(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		if msg, err := receiveStartupMessage(conn); err == nil {
+			msgCh <- msg
+		}
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	routes := RouteByStartupParams(StartupParamRoutes("database", map[string]string{
+		"defaultdb": addr,
+	}))
+	withParams := func(params map[string]string) *pgproto3.StartupMessage {
+		return &pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      params,
+		}
+	}
+
+	t.Run("routed", func(t *testing.T) {
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), "" /* serverAddress */, nil /* tlsConfig */, routes,
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, testStartupMessage(), <-msgCh)
+	})
+
+	t.Run("missing parameter", func(t *testing.T) {
+		msg := withParams(map[string]string{"user": "root"})
+		conn, err := BackendDialContext(
+			ctx, msg, "" /* serverAddress */, nil /* tlsConfig */, routes,
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeParamsRoutingFailed, getErrorCode(err))
+		require.Regexp(t, `missing startup parameter "database"`, err)
+		_, retryable := ClassifyDialError(err)
+		require.False(t, retryable)
+	})
+
+	t.Run("unroutable", func(t *testing.T) {
+		msg := withParams(map[string]string{"user": "root", "database": "otherdb"})
+		conn, err := BackendDialContext(
+			ctx, msg, "" /* serverAddress */, nil /* tlsConfig */, routes,
+		)
+		require.Nil(t, conn)
+		require.Equal(t, codeParamsRoutingFailed, getErrorCode(err))
+		require.Regexp(t, `no backend for startup parameter database="otherdb"`, err)
+	})
+
+	t.Run("custom router", func(t *testing.T) {
+		routerErr := newErrorf(codeUnavailable, "cluster is suspended")
+		router := func(params map[string]string) (string, error) {
+			// The router can't affect the relayed message.
+			params["database"] = "mutated"
+			switch params["cluster"] {
+			case "empty":
+				return "", nil
+			case "suspended":
+				return "", routerErr
+			}
+			return addr, nil
+		}
+
+		msg := withParams(map[string]string{"user": "root", "cluster": "happy-koala"})
+		conn, err := BackendDialContext(
+			ctx, msg, "" /* serverAddress */, nil /* tlsConfig */, RouteByStartupParams(router),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, msg, <-msgCh)
+		require.NotContains(t, msg.Parameters, "database")
+
+		msg = withParams(map[string]string{"cluster": "empty"})
+		_, err = BackendDialContext(
+			ctx, msg, "" /* serverAddress */, nil /* tlsConfig */, RouteByStartupParams(router),
+		)
+		require.Equal(t, codeParamsRoutingFailed, getErrorCode(err))
+		require.Regexp(t, "no backend address returned", err)
+
+		// Errors with a code attached are returned as is.
+		msg = withParams(map[string]string{"cluster": "suspended"})
+		_, err = BackendDialContext(
+			ctx, msg, "" /* serverAddress */, nil /* tlsConfig */, RouteByStartupParams(router),
+		)
+		require.True(t, errors.Is(err, routerErr))
+		require.Equal(t, codeUnavailable, getErrorCode(err))
+	})
+}
+
+func TestBackendDialTLSConfigByStartupParams(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = receiveStartupMessage(tlsConn)
+	})
+	defer stop()
+
+	// Each tenant (i.e. database) trusts its own CA pool.
+	tenantConfigs := map[string]*tls.Config{
+		"trusting":  {RootCAs: testRootCAs(t)},
+		"untrusted": {RootCAs: x509.NewCertPool()},
+	}
+	configFn := func(params map[string]string) (*tls.Config, error) {
+		cfg, ok := tenantConfigs[params["database"]]
+		if !ok {
+			return nil, errors.Newf("unknown tenant %q", params["database"])
+		}
+		return cfg, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dial := func(database string) (net.Conn, error) {
+		msg := testStartupMessage()
+		msg.Parameters["database"] = database
+		_, port, err := net.SplitHostPort(addr)
+		require.NoError(t, err)
+		return BackendDialContext(
+			ctx, msg, net.JoinHostPort("localhost", port), nil, /* tlsConfig */
+			TLSConfigByStartupParams(configFn), DeriveServerName(),
+		)
+	}
+
+	conn, err := dial("trusting")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, ok := BackendTLSState(conn)
+	require.True(t, ok)
+	// The resolved config is cloned before use.
+	require.Empty(t, tenantConfigs["trusting"].ServerName)
+
+	_, err = dial("untrusted")
+	require.Equal(t, codeBackendTLSHandshakeFailed, getErrorCode(err))
+
+	_, err = dial("unknown")
+	require.Equal(t, codeParamsRoutingFailed, getErrorCode(err))
+	require.Regexp(t, `resolving TLS config by startup parameters: unknown tenant "unknown"`, err)
+}
@@ -0,0 +1,239 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestSOCKS5Proxy starts a SOCKS5 proxy which supports the CONNECT
+// command with IPv4 and domain name addresses. If user is not empty, clients
+// must authenticate with user and password. It returns the URL of the proxy,
+// and a channel which receives the target of each connection.
+func startTestSOCKS5Proxy(
+	t *testing.T, user, password string,
+) (proxyURL *url.URL, targets <-chan string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	targetCh := make(chan string, 16)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serveTestSOCKS5Conn(conn, user, password, targetCh, &wg)
+			}()
+		}
+	}()
+	return &url.URL{Scheme: "socks5", Host: ln.Addr().String()}, targetCh, func() {
+		_ = ln.Close()
+		wg.Wait()
+	}
+}
+
+// serveTestSOCKS5Conn serves a single client of the test SOCKS5 proxy.
+func serveTestSOCKS5Conn(
+	conn net.Conn, user, password string, targets chan<- string, wg *sync.WaitGroup,
+) {
+	closeConn := true
+	defer func() {
+		if closeConn {
+			conn.Close()
+		}
+	}()
+	// Greeting: version, and the authentication methods of the client.
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if user == "" {
+		_, _ = conn.Write([]byte{5, 0})
+	} else {
+		_, _ = conn.Write([]byte{5, 2})
+		// Username/password authentication (RFC 1929).
+		var b [1]byte
+		readString := func() string {
+			if _, err := io.ReadFull(conn, b[:]); err != nil {
+				return ""
+			}
+			s := make([]byte, b[0])
+			_, _ = io.ReadFull(conn, s)
+			return string(s)
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return
+		}
+		gotUser, gotPassword := readString(), readString()
+		if gotUser != user || gotPassword != password {
+			_, _ = conn.Write([]byte{1, 1})
+			return
+		}
+		_, _ = conn.Write([]byte{1, 0})
+	}
+	// Request: version, command, reserved, address type.
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make(net.IP, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case 3:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	targets <- target
+	backendConn, err := net.Dial("tcp", target)
+	if err != nil {
+		// Connection refused.
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	// Pipe the connections until either one is closed.
+	closeConn = false
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(backendConn, conn)
+		backendConn.Close()
+		conn.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(conn, backendConn)
+		backendConn.Close()
+		conn.Close()
+	}()
+}
+
+func TestBackendDialSOCKS5Proxy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	addr, stopBackend := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		if msg, err := receiveStartupMessage(tlsConn); err == nil {
+			msgCh <- msg
+		}
+		_, _ = io.Copy(io.Discard, tlsConn)
+	})
+	defer stopBackend()
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	proxyURL, targets, stopProxy := startTestSOCKS5Proxy(t, "user", "secret")
+	defer stopProxy()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	t.Run("proxied", func(t *testing.T) {
+		u := *proxyURL
+		u.User = url.UserPassword("user", "secret")
+		conn, err := BackendDialContext(ctx, testStartupMessage(), addr, clientCfg, SOCKS5Proxy(&u))
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, addr, <-targets)
+		require.Equal(t, testStartupMessage(), <-msgCh)
+		_, isTLS := BackendTLSState(conn)
+		require.True(t, isTLS)
+	})
+
+	t.Run("hostname resolved by the proxy", func(t *testing.T) {
+		u := *proxyURL
+		u.User = url.UserPassword("user", "secret")
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), net.JoinHostPort("localhost", port), clientCfg, SOCKS5Proxy(&u),
+		)
+		// The proxy may resolve localhost to an address which the backend
+		// doesn't listen on, so only the target matters.
+		if err == nil {
+			defer conn.Close()
+			<-msgCh
+		}
+		require.Equal(t, net.JoinHostPort("localhost", port), <-targets)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		u := *proxyURL
+		u.User = url.UserPassword("user", "wrong")
+		conn, err := BackendDialContext(ctx, testStartupMessage(), addr, clientCfg, SOCKS5Proxy(&u))
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		deadAddr := unusedTCPAddr(t)
+
+		u := *proxyURL
+		u.User = url.UserPassword("user", "secret")
+		_, err := BackendDialContext(ctx, testStartupMessage(), deadAddr, clientCfg, SOCKS5Proxy(&u))
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Equal(t, deadAddr, <-targets)
+		require.Regexp(t, "connection refused", err)
+	})
+
+	t.Run("unsupported scheme", func(t *testing.T) {
+		u := *proxyURL
+		u.Scheme = "http"
+		_, err := BackendDialContext(ctx, testStartupMessage(), addr, clientCfg, SOCKS5Proxy(&u))
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+		require.Regexp(t, `unsupported proxy scheme "http"`, err)
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"net"
+	"syscall"
+)
+
+// StrictStartupOrdering configures the dialer to check that the backend
+// doesn't send data out of turn while the connection is established: once the
+// backend responded to the SSLRequest with 'S', nothing else may have been
+// received before the TLS handshake starts, and on plaintext connections,
+// nothing may have been received before the startup message is relayed.
+// Premature data, which an out-of-spec or malicious backend (or an attacker
+// between the proxy and the backend) could use to inject messages ahead of
+// the startup exchange, fails the dial with a codeBackendProtocolViolation
+// error, which is not retried.
+//
+// The checks peek at the socket without blocking, so they only detect data
+// which was received by the time they run. They are not supported on Windows,
+// where they are skipped.
+func StrictStartupOrdering() DialOption {
+	return func(opts *dialOptions) {
+		opts.strictStartupOrdering = true
+	}
+}
+
+// checkNoPrematureData returns a codeBackendProtocolViolation error if data
+// sent by the backend at serverAddress is waiting to be read on conn, i.e. if
+// the backend sent data before it was expected to, which is described by
+// stage. The wrappers of the raw connection used by the dialer are looked
+// through, and bytes buffered by them count as pending data.
+func checkNoPrematureData(conn net.Conn, serverAddress, stage string) error {
+	for unwrapped := false; !unwrapped; {
+		switch c := conn.(type) {
+		case *countingConn:
+			conn = c.Conn
+		case *wireTraceConn:
+			conn = c.Conn
+		case *peekedConn:
+			if len(c.peeked) > 0 {
+				return newPrematureDataError(serverAddress, stage)
+			}
+			conn = c.Conn
+		default:
+			unwrapped = true
+		}
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	// Errors, such as the backend closing the connection, are left to the
+	// next read to report.
+	if pending, ok, err := peekConn(sc); !ok || err != nil || !pending {
+		return nil
+	}
+	return newPrematureDataError(serverAddress, stage)
+}
+
+// newPrematureDataError returns the error of checkNoPrematureData.
+func newPrematureDataError(serverAddress, stage string) error {
+	return newErrorf(
+		codeBackendProtocolViolation, "target server %v sent unexpected data %s", serverAddress, stage,
+	)
+}
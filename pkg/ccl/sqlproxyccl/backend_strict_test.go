@@ -0,0 +1,116 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+//go:build !windows
+// +build !windows
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendDialStrictStartupOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// startBackend starts a backend which responds to the SSLRequest with
+	// response, immediately followed by the bytes of a ReadyForQuery message.
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	startBackend := func(t *testing.T, response byte) (string, func()) {
+		return startTestBackend(t, func(conn net.Conn) {
+			var req [8]byte
+			if _, err := io.ReadFull(conn, req[:]); err != nil {
+				return
+			}
+			if _, err := conn.Write([]byte{response, 'Z', 0, 0, 0, 5, 'I'}); err != nil {
+				return
+			}
+			if response == pgAcceptSSLRequest {
+				conn = tls.Server(conn, serverCfg)
+			}
+			_, _ = io.Copy(io.Discard, conn)
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	t.Run("after SSLRequest accept", func(t *testing.T) {
+		addr, stop := startBackend(t, pgAcceptSSLRequest)
+		defer stop()
+		_, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, StrictStartupOrdering(),
+		)
+		require.Equal(t, codeBackendProtocolViolation, getErrorCode(err))
+		require.Regexp(t, "sent unexpected data after accepting the SSLRequest", err)
+		code, retryable := ClassifyDialError(err)
+		require.Equal(t, CodeBackendProtocolViolation, code)
+		require.False(t, retryable)
+
+		// Without strict ordering, the data is interpreted as the start of
+		// the TLS handshake.
+		_, err = BackendDialContext(ctx, testStartupMessage(), addr, clientCfg)
+		require.Equal(t, codeBackendTLSHandshakeFailed, getErrorCode(err))
+	})
+
+	t.Run("before StartupMessage relay", func(t *testing.T) {
+		addr, stop := startBackend(t, pgRejectSSLRequest)
+		defer stop()
+		_, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, PreferTLS(), StrictStartupOrdering(),
+			WireTrace(func(Direction, []byte) {}),
+		)
+		require.Equal(t, codeBackendProtocolViolation, getErrorCode(err))
+		require.Regexp(t, "sent unexpected data before the StartupMessage was relayed", err)
+
+		conn, err := BackendDialContext(ctx, testStartupMessage(), addr, clientCfg, PreferTLS())
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+
+	t.Run("buffered data", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		conn := &countingConn{Conn: &peekedConn{Conn: client, peeked: []byte{'Z'}}}
+		err := checkNoPrematureData(conn, "backend:26257", "after accepting the SSLRequest")
+		require.Equal(t, codeBackendProtocolViolation, getErrorCode(err))
+		conn = &countingConn{Conn: &peekedConn{Conn: client}}
+		require.NoError(t, checkNoPrematureData(conn, "backend:26257", "after accepting the SSLRequest"))
+	})
+
+	t.Run("well-behaved backend", func(t *testing.T) {
+		addr, stop := startTestBackend(t, func(conn net.Conn) {
+			tlsConn, err := acceptSSLRequest(conn, serverCfg)
+			if err != nil {
+				return
+			}
+			if _, err := receiveStartupMessage(tlsConn); err != nil {
+				return
+			}
+			// Data sent once the startup message was received is expected.
+			_, _ = tlsConn.Write([]byte{'Z', 0, 0, 0, 5, 'I'})
+		})
+		defer stop()
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, StrictStartupOrdering(),
+		)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// TLSFallback configures BackendDialContext to retry the dial once with
+// fallbackConfig if the TLS handshake with the backend fails because the
+// backend and the tls.Config have no TLS version or cipher suite in common
+// (e.g. for backends with a narrow cipher set). fallbackConfig is typically a
+// clone of the tls.Config with a broader CipherSuites list. Its MinVersion is
+// raised to that of the tls.Config (or to MinTLSVersion) if it is lower, so
+// that the fallback never negotiates below the floor.
+//
+// The backend accepted the SSLRequest on the first connection, which can't be
+// reused once the handshake failed, so the retry re-dials the backend: both
+// attempts are bounded by the deadline of the context passed to
+// BackendDialContext. Other handshake failures, such as certificate
+// verification errors, are not retried. The option is ignored by
+// FinishStartupContext, which can't re-dial.
+func TLSFallback(fallbackConfig *tls.Config) DialOption {
+	return func(opts *dialOptions) {
+		opts.tlsFallback = fallbackConfig
+	}
+}
+
+// tlsNegotiationFailures are the TLS errors which indicate that the client and
+// the backend have no TLS version or cipher suite in common. The alerts sent
+// by the backend aren't exported by crypto/tls, and neither are the errors of
+// the client, so the error message is inspected instead.
+var tlsNegotiationFailures = []string{
+	"remote error: tls: handshake failure",
+	"remote error: tls: insufficient security",
+	"remote error: tls: protocol version not supported",
+	"tls: server chose an unconfigured cipher suite",
+	"tls: server selected unsupported protocol version",
+	"tls: no supported versions satisfy MinVersion and MaxVersion",
+}
+
+// isTLSNegotiationFailure returns whether err is a TLS handshake failure
+// which the fallback config of TLSFallback may resolve.
+func isTLSNegotiationFailure(err error) bool {
+	if getErrorCode(err) != codeBackendTLSHandshakeFailed {
+		return false
+	}
+	msg := err.Error()
+	for _, failure := range tlsNegotiationFailures {
+		if strings.Contains(msg, failure) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialWithTLSFallback is like backendDial, but re-dials the backend with the
+// fallback config of TLSFallback, if any, if the TLS negotiation fails.
+func dialWithTLSFallback(
+	ctx context.Context,
+	msg *pgproto3.StartupMessage,
+	serverAddress string,
+	tlsConfig *tls.Config,
+	options *dialOptions,
+) (net.Conn, error) {
+	if options.tlsFallback == nil || tlsConfig == nil {
+		return backendDial(ctx, msg, serverAddress, tlsConfig, options)
+	}
+	// Bound both attempts by the same deadline.
+	ctx, cancel := withDefaultDialTimeout(ctx)
+	defer cancel()
+	conn, err := backendDial(ctx, msg, serverAddress, tlsConfig, options)
+	if err == nil || !isTLSNegotiationFailure(err) || ctx.Err() != nil {
+		return conn, err
+	}
+	log.VEventf(ctx, 2, "retrying dial to %s with fallback TLS config: %v", serverAddress, err)
+
+	fallbackConfig := options.tlsFallback.Clone()
+	floor := tlsConfig.MinVersion
+	if floor == 0 {
+		floor = options.minTLSVersion
+	}
+	if fallbackConfig.MinVersion < floor {
+		fallbackConfig.MinVersion = floor
+	}
+	fallbackOptions := *options
+	fallbackOptions.tlsFallback = nil
+	conn, fallbackErr := backendDial(ctx, msg, serverAddress, fallbackConfig, &fallbackOptions)
+	if fallbackErr != nil {
+		return nil, errors.WithSecondaryError(fallbackErr, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendDialTLSFallback(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The backend only supports a single cipher suite.
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	serverCfg.MaxVersion = tls.VersionTLS12
+	serverCfg.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
+
+	var dials int32
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		atomic.AddInt32(&dials, 1)
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = receiveStartupMessage(tlsConn)
+	})
+	defer stop()
+
+	narrowCfg := &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305},
+	}
+	broadCfg := &tls.Config{
+		InsecureSkipVerify: true,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("no fallback", func(t *testing.T) {
+		atomic.StoreInt32(&dials, 0)
+		_, err := BackendDialContext(ctx, testStartupMessage(), addr, narrowCfg)
+		require.Equal(t, codeBackendTLSHandshakeFailed, getErrorCode(err))
+		require.Equal(t, int32(1), atomic.LoadInt32(&dials))
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		atomic.StoreInt32(&dials, 0)
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, narrowCfg, TLSFallback(broadCfg),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, int32(2), atomic.LoadInt32(&dials))
+
+		state, ok := BackendTLSState(conn)
+		require.True(t, ok)
+		require.Equal(t, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, state.CipherSuite)
+	})
+
+	t.Run("fallback fails", func(t *testing.T) {
+		atomic.StoreInt32(&dials, 0)
+		_, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, narrowCfg, TLSFallback(narrowCfg),
+		)
+		require.Equal(t, codeBackendTLSHandshakeFailed, getErrorCode(err))
+		require.Equal(t, int32(2), atomic.LoadInt32(&dials))
+	})
+
+	t.Run("certificate verification is not retried", func(t *testing.T) {
+		atomic.StoreInt32(&dials, 0)
+		_, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, &tls.Config{ServerName: "localhost"},
+			TLSFallback(broadCfg),
+		)
+		require.Equal(t, codeBackendTLSHandshakeFailed, getErrorCode(err))
+		require.Equal(t, int32(1), atomic.LoadInt32(&dials))
+	})
+}
+
+func TestBackendDialTLSFallbackMinVersion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The backend only supports TLS 1.2, while the tls.Config requires
+	// TLS 1.3: the fallback config can't lower the floor.
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	serverCfg.MaxVersion = tls.VersionTLS12
+
+	var dials int32
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		atomic.AddInt32(&dials, 1)
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = receiveStartupMessage(tlsConn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = BackendDialContext(
+		ctx, testStartupMessage(), addr,
+		&tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13},
+		TLSFallback(&tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12}),
+	)
+	require.Equal(t, codeBackendTLSHandshakeFailed, getErrorCode(err))
+	require.Equal(t, int32(2), atomic.LoadInt32(&dials))
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Direction is the direction of the bytes passed to a WireTracer.
+type Direction int
+
+const (
+	// DirectionSent indicates bytes sent to the backend.
+	DirectionSent Direction = iota
+	// DirectionReceived indicates bytes received from the backend.
+	DirectionReceived
+)
+
+// String implements the fmt.Stringer interface.
+func (d Direction) String() string {
+	if d == DirectionSent {
+		return "sent"
+	}
+	return "received"
+}
+
+// WireTracer, if set, is invoked with the bytes exchanged with the backend
+// while negotiating TLS (i.e. the SSLRequest, the response of the backend, and
+// the TLS handshake) and relaying the startup message, for every dial, e.g. to
+// diagnose incompatibilities with some backends. The SSLRequest negotiation
+// and TLS handshake are traced as they are written to and read from the wire,
+// once per read or write, while the startup message is traced in the clear,
+// once it was relayed. Subsequent traffic is not traced. The tracer must not
+// retain b after it returns, and must not block.
+//
+// Since the startup message may contain credentials, and tracing every dial
+// is expensive, WireTrace should usually be preferred, to trace a single
+// connection.
+var WireTracer func(dir Direction, b []byte)
+
+// WireTrace configures the dialer to invoke tracer with the bytes exchanged
+// with the backend during the dial, as WireTracer does for all dials. tracer
+// takes precedence over WireTracer.
+func WireTrace(tracer func(dir Direction, b []byte)) DialOption {
+	return func(opts *dialOptions) {
+		opts.wireTracer = tracer
+	}
+}
+
+// wireTracerFor returns the tracer of the dial configured by opts, or nil if
+// the dial isn't traced.
+func wireTracerFor(opts *dialOptions) func(dir Direction, b []byte) {
+	if opts.wireTracer != nil {
+		return opts.wireTracer
+	}
+	return WireTracer
+}
+
+// wireTraceConn is a net.Conn wrapper which passes the bytes which are read
+// and written to a tracer, until stop is called.
+type wireTraceConn struct {
+	net.Conn
+	tracer func(dir Direction, b []byte)
+	// stopped is set to 1 once tracing stopped. Accessed atomically.
+	stopped int32
+}
+
+var _ net.Conn = &wireTraceConn{}
+
+// Read implements the net.Conn interface.
+func (c *wireTraceConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && atomic.LoadInt32(&c.stopped) == 0 {
+		c.tracer(DirectionReceived, b[:n])
+	}
+	return n, err
+}
+
+// Write implements the net.Conn interface.
+func (c *wireTraceConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 && atomic.LoadInt32(&c.stopped) == 0 {
+		c.tracer(DirectionSent, b[:n])
+	}
+	return n, err
+}
+
+// stop stops tracing. Since the wrapper may remain in use (e.g. below the TLS
+// layer), it doesn't affect subsequent reads and writes otherwise.
+func (c *wireTraceConn) stop() {
+	atomic.StoreInt32(&c.stopped, 1)
+}
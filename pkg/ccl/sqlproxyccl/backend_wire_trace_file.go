@@ -0,0 +1,228 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// WireTraceSinkOptions configures a WireTraceSink.
+type WireTraceSinkOptions struct {
+	// Gzip, if true, compresses the trace files with gzip. zstd compression
+	// is not supported.
+	Gzip bool
+	// MaxFileSize, if positive, is the maximum number of bytes written to a
+	// trace file, before compression. Once a record would exceed it, the
+	// trace continues in a new file, so a single connection may be traced
+	// across several files. A record is never split across files.
+	MaxFileSize int64
+}
+
+// WireTraceSink is a ready-to-use tracer for WireTrace, which writes the bytes
+// exchanged with the backends to files in a directory, one file per dial (or
+// more when rotating, see MaxFileSize). The files are named after the
+// correlation ID of the dial (see ConnectionID), if any, followed by a
+// sequence number which is unique per sink, so that dials reusing a
+// correlation ID (e.g. retries, or FinishStartupContext after a handoff) are
+// traced in files of their own: e.g. "conn-42-7.0.trace" or, with gzip
+// compression, "conn-42-7.0.trace.gz" for ConnectionID("42"), followed by
+// "conn-42-7.1.trace" when rotating, and "conn-7.0.trace" without correlation
+// ID. Each record of a file contains the time at which the bytes
+// were traced, their direction and their hex dump.
+type WireTraceSink struct {
+	// seq is the sequence number of the last traced dial. Accessed
+	// atomically. Kept first in the struct to guarantee 64-bit
+	// alignment.
+	seq uint64
+
+	dir  string
+	opts WireTraceSinkOptions
+}
+
+// NewWireTraceSink returns a WireTraceSink which writes trace files to dir,
+// which must exist.
+func NewWireTraceSink(dir string, opts WireTraceSinkOptions) *WireTraceSink {
+	return &WireTraceSink{dir: dir, opts: opts}
+}
+
+// WireTraceToFiles configures the dialer to trace the bytes exchanged with the
+// backend during the dial into a trace file of sink, as WireTrace does. The
+// file is flushed and closed once the dial completes, whether it succeeded or
+// not. Failing to create or write the file doesn't fail the dial, and is only
+// logged. WireTrace takes precedence over WireTraceToFiles.
+func WireTraceToFiles(sink *WireTraceSink) DialOption {
+	return func(opts *dialOptions) {
+		opts.wireTraceSink = sink
+	}
+}
+
+// startWireTraceFile opens the trace file of the dial to serverAddress if
+// options has a WireTraceSink, and sets it as the tracer of the dial. It
+// returns a function which closes the trace file, to be called once the dial
+// completes.
+func startWireTraceFile(
+	ctx context.Context, serverAddress string, options *dialOptions,
+) (closeTrace func()) {
+	sink := options.wireTraceSink
+	if sink == nil || options.wireTracer != nil {
+		return func() {}
+	}
+	f, err := sink.open(options.connID)
+	if err != nil {
+		log.Warningf(ctx, "unable to trace dial to %s: %v", serverAddress, err)
+		return func() {}
+	}
+	options.wireTracer = f.trace
+	return func() {
+		if err := f.close(); err != nil {
+			log.Warningf(ctx, "unable to trace dial to %s: %v", serverAddress, err)
+		}
+	}
+}
+
+// open creates the trace file of a dial with the given correlation ID, which
+// may be empty.
+func (s *WireTraceSink) open(connID string) (*wireTraceFile, error) {
+	name := strconv.FormatUint(atomic.AddUint64(&s.seq, 1), 10)
+	if connID != "" {
+		name = sanitizeTraceFileName(connID) + "-" + name
+	}
+	f := &wireTraceFile{sink: s, name: "conn-" + name}
+	if err := f.openPart(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// sanitizeTraceFileName replaces the characters of name which are not safe in
+// file names.
+func sanitizeTraceFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// wireTraceFile is the trace file of a single dial, possibly rotated across
+// several parts.
+type wireTraceFile struct {
+	sink *WireTraceSink
+	name string
+
+	mu struct {
+		syncutil.Mutex
+		// part is the index of the current part.
+		part int
+		file *os.File
+		gz   *gzip.Writer
+		buf  *bufio.Writer
+		// size is the number of bytes written to the current part, before
+		// compression.
+		size int64
+		// err is the first error encountered while writing the trace.
+		err error
+	}
+}
+
+// openPart creates the file of the current part. It must be called with
+// f.mu held, or before f is shared.
+func (f *wireTraceFile) openPart() error {
+	fileName := fmt.Sprintf("%s.%d.trace", f.name, f.mu.part)
+	if f.sink.opts.Gzip {
+		fileName += ".gz"
+	}
+	file, err := os.OpenFile(
+		filepath.Join(f.sink.dir, fileName), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600,
+	)
+	if err != nil {
+		return errors.Wrap(err, "creating wire trace file")
+	}
+	var w io.Writer = file
+	f.mu.gz = nil
+	if f.sink.opts.Gzip {
+		f.mu.gz = gzip.NewWriter(file)
+		w = f.mu.gz
+	}
+	f.mu.file = file
+	f.mu.buf = bufio.NewWriter(w)
+	f.mu.size = 0
+	return nil
+}
+
+// closePart flushes and closes the file of the current part. It must be called
+// with f.mu held.
+func (f *wireTraceFile) closePart() error {
+	err := f.mu.buf.Flush()
+	if f.mu.gz != nil {
+		err = errors.CombineErrors(err, f.mu.gz.Close())
+	}
+	return errors.CombineErrors(err, f.mu.file.Close())
+}
+
+// trace is the tracer of the dial. It has the signature of the tracers passed
+// to WireTrace.
+func (f *wireTraceFile) trace(dir Direction, b []byte) {
+	record := fmt.Sprintf(
+		"%s %s %d bytes\n%s", timeutil.Now().Format(time.RFC3339Nano), dir, len(b), hex.Dump(b),
+	)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.mu.err != nil {
+		return
+	}
+	maxSize := f.sink.opts.MaxFileSize
+	if maxSize > 0 && f.mu.size > 0 && f.mu.size+int64(len(record)) > maxSize {
+		f.mu.err = f.closePart()
+		// The closed part must not be closed again.
+		f.mu.file = nil
+		if f.mu.err != nil {
+			return
+		}
+		f.mu.part++
+		if f.mu.err = f.openPart(); f.mu.err != nil {
+			return
+		}
+	}
+	n, err := f.mu.buf.WriteString(record)
+	f.mu.size += int64(n)
+	f.mu.err = err
+}
+
+// close flushes and closes the trace file, and returns the first error
+// encountered while writing the trace, if any.
+func (f *wireTraceFile) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.mu.err
+	if f.mu.file != nil {
+		err = errors.CombineErrors(err, f.closePart())
+		f.mu.file = nil
+	}
+	return err
+}
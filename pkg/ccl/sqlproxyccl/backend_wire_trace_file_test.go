@@ -0,0 +1,165 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+// readTraceFiles returns the names of the trace files in dir, sorted, along
+// with their decompressed contents.
+func readTraceFiles(t *testing.T, dir string) ([]string, []string) {
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	contents := make([]string, 0, len(names))
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		require.NoError(t, err)
+		var b []byte
+		if strings.HasSuffix(name, ".gz") {
+			gz, err := gzip.NewReader(f)
+			require.NoError(t, err)
+			b, err = ioutil.ReadAll(gz)
+			require.NoError(t, err)
+		} else {
+			b, err = ioutil.ReadAll(f)
+			require.NoError(t, err)
+		}
+		require.NoError(t, f.Close())
+		contents = append(contents, string(b))
+	}
+	return names, contents
+}
+
+func TestWireTraceToFiles(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		_, _ = receiveStartupMessage(tlsConn)
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	t.Run("plain", func(t *testing.T) {
+		dir := t.TempDir()
+		sink := NewWireTraceSink(dir, WireTraceSinkOptions{})
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg,
+			WireTraceToFiles(sink), ConnectionID("a/b"),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		// Without correlation ID, the file is only named after the sequence
+		// number.
+		conn2, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, WireTraceToFiles(sink),
+		)
+		require.NoError(t, err)
+		defer conn2.Close()
+
+		// The files are complete once the dials return.
+		names, contents := readTraceFiles(t, dir)
+		require.Equal(t, []string{"conn-2.0.trace", "conn-a_b-1.0.trace"}, names)
+		for _, c := range contents {
+			// The SSLRequest is the first record.
+			require.Regexp(t, `^\S+ sent 8 bytes\n00000000  00 00 00 08 04 d2 16 2f`, c)
+			require.Contains(t, c, " received 1 bytes\n")
+		}
+	})
+
+	t.Run("gzip with rotation", func(t *testing.T) {
+		dir := t.TempDir()
+		sink := NewWireTraceSink(dir, WireTraceSinkOptions{Gzip: true, MaxFileSize: 1})
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg,
+			WireTraceToFiles(sink), ConnectionID("42"),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// Every record is in its own file, since they all exceed the
+		// maximum size.
+		names, contents := readTraceFiles(t, dir)
+		require.Greater(t, len(names), 2)
+		require.Equal(t, "conn-42-1.0.trace.gz", names[0])
+		require.Equal(t, "conn-42-1.1.trace.gz", names[1])
+		for _, c := range contents {
+			require.Equal(t, 1, strings.Count(c, " bytes\n"), c)
+		}
+	})
+
+	t.Run("reused correlation ID", func(t *testing.T) {
+		dir := t.TempDir()
+		sink := NewWireTraceSink(dir, WireTraceSinkOptions{})
+		for i := 0; i < 2; i++ {
+			conn, err := BackendDialContext(
+				ctx, testStartupMessage(), addr, clientCfg,
+				WireTraceToFiles(sink), ConnectionID("42"),
+			)
+			require.NoError(t, err)
+			require.NoError(t, conn.Close())
+		}
+		names, contents := readTraceFiles(t, dir)
+		require.Equal(t, []string{"conn-42-1.0.trace", "conn-42-2.0.trace"}, names)
+		for _, c := range contents {
+			require.Regexp(t, `^\S+ sent 8 bytes\n`, c)
+		}
+	})
+
+	t.Run("WireTrace takes precedence", func(t *testing.T) {
+		dir := t.TempDir()
+		var traced int
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg,
+			WireTraceToFiles(NewWireTraceSink(dir, WireTraceSinkOptions{})),
+			WireTrace(func(Direction, []byte) { traced++ }),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Greater(t, traced, 0)
+		names, _ := readTraceFiles(t, dir)
+		require.Empty(t, names)
+	})
+
+	t.Run("file errors don't fail the dial", func(t *testing.T) {
+		sink := NewWireTraceSink(filepath.Join(t.TempDir(), "missing"), WireTraceSinkOptions{})
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, WireTraceToFiles(sink),
+		)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendDialWireTrace(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	type traced struct {
+		dir Direction
+		b   []byte
+	}
+	var trace []traced
+	tracer := func(dir Direction, b []byte) {
+		trace = append(trace, traced{dir: dir, b: append([]byte(nil), b...)})
+	}
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		if _, err := receiveStartupMessage(tlsConn); err != nil {
+			return
+		}
+		_, _ = tlsConn.Write([]byte("ok"))
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+	// requireStartupMsg asserts that tr is the sent startup message. The
+	// parameters are encoded in map order, so the message is decoded.
+	requireStartupMsg := func(t *testing.T, tr traced) {
+		require.Equal(t, DirectionSent, tr.dir)
+		require.Len(t, tr.b, startupMsgSize(testStartupMessage()))
+		var msg pgproto3.StartupMessage
+		require.NoError(t, msg.Decode(tr.b[4:]))
+		require.Equal(t, testStartupMessage(), &msg)
+	}
+
+	t.Run("single connection", func(t *testing.T) {
+		trace = nil
+		conn, err := BackendDialContext(
+			ctx, testStartupMessage(), addr, clientCfg, WireTrace(tracer),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Greater(t, len(trace), 4)
+		require.Equal(t, traced{DirectionSent, (&pgproto3.SSLRequest{}).Encode(nil)}, trace[0])
+		require.Equal(t, traced{DirectionReceived, []byte{pgAcceptSSLRequest}}, trace[1])
+		// The TLS handshake is traced on the wire, and the startup message in
+		// the clear.
+		require.Equal(t, byte(22) /* handshake record */, trace[2].b[0])
+		requireStartupMsg(t, trace[len(trace)-1])
+
+		// Subsequent traffic is not traced.
+		n := len(trace)
+		_, err = io.ReadFull(conn, make([]byte, 2))
+		require.NoError(t, err)
+		require.Len(t, trace, n)
+
+		// Other connections are not traced.
+		trace = nil
+		conn, err = BackendDialContext(ctx, testStartupMessage(), addr, clientCfg)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Empty(t, trace)
+	})
+
+	t.Run("all connections", func(t *testing.T) {
+		plainAddr, stop := startTestBackend(t, func(conn net.Conn) {
+			_, _ = receiveStartupMessage(conn)
+		})
+		defer stop()
+		defer testutils.TestingHook(&WireTracer, tracer)()
+
+		trace = nil
+		conn, err := BackendDialContext(ctx, testStartupMessage(), plainAddr, nil /* tlsConfig */)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Len(t, trace, 1)
+		requireStartupMsg(t, trace[0])
+		require.Equal(t, "sent", trace[0].dir.String())
+	})
+}
@@ -54,7 +54,7 @@ const (
 	codeBackendDown
 
 	// codeBackendRefusedTLS indicates that the backend SQL server refused a TLS-
-	// enabled SQL connection.
+	// enabled SQL connection, or rejected the client certificate.
 	codeBackendRefusedTLS
 
 	// codeBackendDisconnected indicates that the backend disconnected (with a
@@ -76,6 +76,91 @@ const (
 	// codeUnavailable indicates that the backend SQL server exists but is not
 	// accepting connections. For example, a tenant cluster that has maxPods set to 0.
 	codeUnavailable
+
+	// codeBackendTLSHandshakeFailed indicates that the backend SQL server
+	// accepted to upgrade the SQL connection to TLS, but the TLS handshake
+	// failed, e.g. because of a certificate verification failure or no common
+	// cipher suite or protocol.
+	codeBackendTLSHandshakeFailed
+
+	// codeUnsupportedChannelBinding indicates that the client attempted to
+	// authenticate using SCRAM with channel binding, which cannot succeed
+	// because the proxy terminates TLS connections.
+	codeUnsupportedChannelBinding
+
+	// codeClientStartupTooLarge indicates that the startup message received
+	// from the client exceeds the maximum size that is relayed to the backend.
+	codeClientStartupTooLarge
+
+	// codeUnsupportedProtocolVersion indicates that the startup message
+	// received from the client uses a protocol version which is not accepted
+	// by the proxy.
+	codeUnsupportedProtocolVersion
+
+	// codeStartupGateRejected indicates that the connection was rejected by
+	// StartupGate based on the startup parameters sent by the client.
+	codeStartupGateRejected
+
+	// codeInvalidStartupParams indicates that the startup message received
+	// from the client has parameters which can't be relayed, e.g. because
+	// they contain null bytes.
+	codeInvalidStartupParams
+
+	// codeBackendAuthTimeout indicates that the backend SQL server did not
+	// respond to the startup message within the timeout configured through
+	// AuthTimeout, e.g. because it stalled during authentication.
+	codeBackendAuthTimeout
+
+	// codeBackendAddressForbidden indicates that the address of the backend
+	// SQL server, as resolved for dialing, is forbidden by DialAddressFilter.
+	codeBackendAddressForbidden
+
+	// codeBackendClosedDuringStartup indicates that the backend SQL server
+	// closed the connection (or reset it) while the startup message was
+	// relayed, e.g. because it is shutting down. Unlike a codeBackendDown
+	// timeout, it calls for retrying another backend right away.
+	codeBackendClosedDuringStartup
+
+	// codeProxyResourceExhausted indicates that the proxy could not dial the
+	// backend SQL server because it ran out of resources, such as file
+	// descriptors. This is an issue with the proxy, not the backend.
+	codeProxyResourceExhausted
+
+	// codeInvalidBackendAddress indicates that the address of the backend SQL
+	// server is malformed, e.g. because it lacks a port. This is an issue
+	// with the configuration of the proxy, not an outage of the backend.
+	codeInvalidBackendAddress
+
+	// codeBackendProtocolViolation indicates that the backend SQL server sent
+	// data out of turn while the connection was established, e.g. right
+	// after accepting the SSLRequest. See StrictStartupOrdering.
+	codeBackendProtocolViolation
+
+	// codeStartupParamNotAllowed indicates that the startup message received
+	// from the client has parameters which are not allowed by
+	// StartupParamAllowlist.
+	codeStartupParamNotAllowed
+)
+
+// ErrorCode is the exported name of errorCode, for callers which need to
+// classify the errors returned by BackendDial (see ClassifyDialError).
+type ErrorCode = errorCode
+
+// Exported error codes, which may be attached to errors returned by
+// BackendDial.
+const (
+	CodeBackendDown                = codeBackendDown
+	CodeBackendRefusedTLS          = codeBackendRefusedTLS
+	CodeBackendTLSHandshakeFailed  = codeBackendTLSHandshakeFailed
+	CodeUnexpectedStartupMessage   = codeUnexpectedStartupMessage
+	CodeParamsRoutingFailed        = codeParamsRoutingFailed
+	CodeBackendAuthTimeout         = codeBackendAuthTimeout
+	CodeBackendAddressForbidden    = codeBackendAddressForbidden
+	CodeBackendClosedDuringStartup = codeBackendClosedDuringStartup
+	CodeProxyResourceExhausted     = codeProxyResourceExhausted
+	CodeInvalidBackendAddress      = codeInvalidBackendAddress
+	CodeBackendProtocolViolation   = codeBackendProtocolViolation
+	CodeStartupParamNotAllowed     = codeStartupParamNotAllowed
 )
 
 // codeError is combines an error with one of the above codes to ease
@@ -89,6 +174,12 @@ func (e *codeError) Error() string {
 	return fmt.Sprintf("%s: %s", e.code, e.err)
 }
 
+// Unwrap returns the underlying error, so that errors.Is and errors.As can
+// inspect it.
+func (e *codeError) Unwrap() error {
+	return e.err
+}
+
 // newErrorf returns a new codeError out of the supplied args.
 func newErrorf(code errorCode, format string, args ...interface{}) error {
 	return &codeError{
@@ -96,3 +187,23 @@ func newErrorf(code errorCode, format string, args ...interface{}) error {
 		err:  errors.Errorf(format, args...),
 	}
 }
+
+// wrapErrorf returns a new codeError which wraps err with the message built
+// out of the supplied args. Unlike newErrorf with a %v verb, the original error
+// remains accessible through errors.Is and errors.As.
+func wrapErrorf(code errorCode, err error, format string, args ...interface{}) error {
+	return &codeError{
+		code: code,
+		err:  errors.Wrapf(err, format, args...),
+	}
+}
+
+// getErrorCode returns the errorCode attached to err, or 0 if err does not
+// wrap a codeError.
+func getErrorCode(err error) errorCode {
+	var codeErr *codeError
+	if errors.As(err, &codeErr) {
+		return codeErr.code
+	}
+	return 0
+}
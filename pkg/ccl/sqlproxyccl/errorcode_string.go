@@ -23,11 +23,24 @@ func _() {
 	_ = x[codeProxyRefusedConnection-13]
 	_ = x[codeExpiredClientConnection-14]
 	_ = x[codeUnavailable-15]
+	_ = x[codeBackendTLSHandshakeFailed-16]
+	_ = x[codeUnsupportedChannelBinding-17]
+	_ = x[codeClientStartupTooLarge-18]
+	_ = x[codeUnsupportedProtocolVersion-19]
+	_ = x[codeStartupGateRejected-20]
+	_ = x[codeInvalidStartupParams-21]
+	_ = x[codeBackendAuthTimeout-22]
+	_ = x[codeBackendAddressForbidden-23]
+	_ = x[codeBackendClosedDuringStartup-24]
+	_ = x[codeProxyResourceExhausted-25]
+	_ = x[codeInvalidBackendAddress-26]
+	_ = x[codeBackendProtocolViolation-27]
+	_ = x[codeStartupParamNotAllowed-28]
 }
 
-const _errorCode_name = "codeAuthFailedcodeBackendReadFailedcodeBackendWriteFailedcodeClientReadFailedcodeClientWriteFailedcodeUnexpectedInsecureStartupMessagecodeUnexpectedStartupMessagecodeParamsRoutingFailedcodeBackendDowncodeBackendRefusedTLScodeBackendDisconnectedcodeClientDisconnectedcodeProxyRefusedConnectioncodeExpiredClientConnectioncodeUnavailable"
+const _errorCode_name = "codeAuthFailedcodeBackendReadFailedcodeBackendWriteFailedcodeClientReadFailedcodeClientWriteFailedcodeUnexpectedInsecureStartupMessagecodeUnexpectedStartupMessagecodeParamsRoutingFailedcodeBackendDowncodeBackendRefusedTLScodeBackendDisconnectedcodeClientDisconnectedcodeProxyRefusedConnectioncodeExpiredClientConnectioncodeUnavailablecodeBackendTLSHandshakeFailedcodeUnsupportedChannelBindingcodeClientStartupTooLargecodeUnsupportedProtocolVersioncodeStartupGateRejectedcodeInvalidStartupParamscodeBackendAuthTimeoutcodeBackendAddressForbiddencodeBackendClosedDuringStartupcodeProxyResourceExhaustedcodeInvalidBackendAddresscodeBackendProtocolViolationcodeStartupParamNotAllowed"
 
-var _errorCode_index = [...]uint16{0, 14, 35, 57, 77, 98, 134, 162, 185, 200, 221, 244, 266, 292, 319, 334}
+var _errorCode_index = [...]uint16{0, 14, 35, 57, 77, 98, 134, 162, 185, 200, 221, 244, 266, 292, 319, 334, 363, 392, 417, 447, 470, 494, 516, 543, 573, 599, 624, 652, 678}
 
 func (i errorCode) String() string {
 	i -= 1
@@ -10,6 +10,7 @@ package sqlproxyccl
 
 import (
 	"crypto/tls"
+	"encoding/binary"
 	"net"
 
 	"github.com/jackc/pgproto3/v2"
@@ -51,6 +52,24 @@ var FrontendAdmit = func(
 		}
 	}
 
+	// Clients which prefer GSSAPI encryption (e.g. libpq with
+	// gssencmode=prefer) send a GSSEncRequest first. The proxy doesn't
+	// support GSSAPI encryption, so refuse it, after which the client
+	// proceeds with an SSLRequest or a StartupMessage.
+	if _, ok := m.(*pgproto3.GSSEncRequest); ok {
+		if _, err := conn.Write([]byte{pgRejectSSLRequest}); err != nil {
+			return &FrontendAdmitInfo{
+				Conn: conn, Err: newErrorf(codeClientWriteFailed, "refusing GSSEncRequest: %v", err),
+			}
+		}
+		m, err = pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn).ReceiveStartupMessage()
+		if err != nil {
+			return &FrontendAdmitInfo{
+				Conn: conn, Err: newErrorf(codeClientReadFailed, "while receiving startup message"),
+			}
+		}
+	}
+
 	// CancelRequest is unencrypted and unauthenticated, regardless of whether
 	// the server requires TLS connections. For now, ignore the request to cancel,
 	// and send back a nil StartupMessage, which will cause the proxy to just
@@ -116,3 +135,40 @@ var FrontendAdmit = func(
 		Err:  newErrorf(code, "unsupported post-TLS startup message: %T", m),
 	}
 }
+
+// handleClientSSLRequest reads an SSLRequest from a client connection, and
+// either accepts or refuses it, mirroring the exchange that sslOverlay performs
+// with the backend. Exactly the 8 bytes of the SSLRequest are consumed, so
+// that, if accept is true, the caller can proceed with the TLS handshake over
+// conn right away. A GSSEncRequest preceding the SSLRequest is refused, as
+// GSSAPI encryption is not supported. If the client sends anything else, a
+// codeUnexpectedInsecureStartupMessage error is returned, and nothing is
+// written back.
+func handleClientSSLRequest(conn net.Conn, accept bool) error {
+	var req [2]int32
+	if err := binary.Read(conn, binary.BigEndian, &req); err != nil {
+		return newErrorf(codeClientReadFailed, "reading SSLRequest: %v", err)
+	}
+	if req[0] == pgGSSEncRequest[0] && req[1] == pgGSSEncRequest[1] {
+		if _, err := conn.Write([]byte{pgRejectSSLRequest}); err != nil {
+			return newErrorf(codeClientWriteFailed, "refusing GSSEncRequest: %v", err)
+		}
+		if err := binary.Read(conn, binary.BigEndian, &req); err != nil {
+			return newErrorf(codeClientReadFailed, "reading SSLRequest: %v", err)
+		}
+	}
+	if req[0] != pgSSLRequest[0] || req[1] != pgSSLRequest[1] {
+		return newErrorf(
+			codeUnexpectedInsecureStartupMessage,
+			"unexpected startup message: length %d, code %d", req[0], req[1],
+		)
+	}
+	response := byte(pgRejectSSLRequest)
+	if accept {
+		response = pgAcceptSSLRequest
+	}
+	if _, err := conn.Write([]byte{response}); err != nil {
+		return newErrorf(codeClientWriteFailed, "responding to SSLRequest: %v", err)
+	}
+	return nil
+}
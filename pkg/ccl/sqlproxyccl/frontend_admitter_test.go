@@ -12,9 +12,11 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
@@ -211,3 +213,123 @@ func TestFrontendAdmitSessionRevivalToken(t *testing.T) {
 	require.NotNil(t, fe.Conn)
 	require.Nil(t, fe.Msg)
 }
+
+func TestHandleClientSSLRequest(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("accept", func(t *testing.T) {
+		cli, srv := net.Pipe()
+		defer cli.Close()
+		defer srv.Close()
+
+		errCh := make(chan error, 1)
+		go func() {
+			if err := handleClientSSLRequest(srv, true /* accept */); err != nil {
+				errCh <- err
+				return
+			}
+			errCh <- tls.Server(srv, serverCfg).HandshakeContext(ctx)
+		}()
+
+		conn, err := sslOverlay(
+			ctx, cli, "localhost", &tls.Config{InsecureSkipVerify: true}, &dialOptions{},
+		)
+		require.NoError(t, err)
+		_, ok := conn.(*tls.Conn)
+		require.True(t, ok)
+		require.NoError(t, <-errCh)
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		cli, srv := net.Pipe()
+		defer cli.Close()
+		defer srv.Close()
+
+		errCh := make(chan error, 1)
+		go func() { errCh <- handleClientSSLRequest(srv, false /* accept */) }()
+
+		_, err := sslOverlay(ctx, cli, "localhost", &tls.Config{}, &dialOptions{})
+		require.Equal(t, codeBackendRefusedTLS, getErrorCode(err))
+		require.NoError(t, <-errCh)
+	})
+
+	t.Run("unexpected message", func(t *testing.T) {
+		cli, srv := net.Pipe()
+		defer cli.Close()
+		defer srv.Close()
+
+		go func() {
+			_, _ = cli.Write((&pgproto3.StartupMessage{
+				ProtocolVersion: pgproto3.ProtocolVersionNumber,
+				Parameters:      map[string]string{"user": "root"},
+			}).Encode(nil))
+		}()
+
+		err := handleClientSSLRequest(srv, true /* accept */)
+		require.Equal(t, codeUnexpectedInsecureStartupMessage, getErrorCode(err))
+	})
+
+	t.Run("gss first", func(t *testing.T) {
+		cli, srv := net.Pipe()
+		defer cli.Close()
+		defer srv.Close()
+
+		errCh := make(chan error, 1)
+		go func() { errCh <- handleClientSSLRequest(srv, false /* accept */) }()
+
+		// The GSSEncRequest is refused, and the SSLRequest is handled next.
+		_, err := cli.Write((&pgproto3.GSSEncRequest{}).Encode(nil))
+		require.NoError(t, err)
+		response := make([]byte, 1)
+		_, err = io.ReadFull(cli, response)
+		require.NoError(t, err)
+		require.Equal(t, byte(pgRejectSSLRequest), response[0])
+		_, err = sslOverlay(ctx, cli, "localhost", &tls.Config{}, &dialOptions{})
+		require.Equal(t, codeBackendRefusedTLS, getErrorCode(err))
+		require.NoError(t, <-errCh)
+	})
+}
+
+// TestFrontendAdmitWithGSSEncRequest sends a GSSEncRequest, followed by an
+// SSLRequest and a StartupMessage once the GSSEncRequest was refused.
+func TestFrontendAdmitWithGSSEncRequest(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	cli, srv := net.Pipe()
+	require.NoError(t, srv.SetReadDeadline(timeutil.Now().Add(3e9)))
+	require.NoError(t, cli.SetReadDeadline(timeutil.Now().Add(3e9)))
+
+	go func() {
+		b := []byte{0}
+		_, err := cli.Write((&pgproto3.GSSEncRequest{}).Encode(nil))
+		require.NoError(t, err)
+		_, err = io.ReadFull(cli, b)
+		require.NoError(t, err)
+		require.Equal(t, byte(pgRejectSSLRequest), b[0])
+		_, err = cli.Write((&pgproto3.SSLRequest{}).Encode(nil))
+		require.NoError(t, err)
+		_, err = io.ReadFull(cli, b)
+		require.NoError(t, err)
+		require.Equal(t, byte(pgAcceptSSLRequest), b[0])
+		cli = tls.Client(cli, &tls.Config{InsecureSkipVerify: true})
+		startup := pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"p1": "a"},
+		}
+		_, err = cli.Write(startup.Encode(nil))
+		require.NoError(t, err)
+	}()
+
+	tlsConfig, err := tlsConfig()
+	require.NoError(t, err)
+	fe := FrontendAdmit(srv, tlsConfig)
+	require.NoError(t, fe.Err)
+	require.NotNil(t, fe.Conn)
+	require.NotNil(t, fe.Msg)
+	require.Equal(t, "a", fe.Msg.Parameters["p1"])
+}
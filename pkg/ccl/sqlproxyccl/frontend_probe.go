@@ -0,0 +1,136 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// ClientProbe classifies the first bytes sent by a client, to tell PostgreSQL
+// clients from health-check probes of monitoring tools and load balancers.
+type ClientProbe int
+
+const (
+	// ClientProbeNone indicates that the client started with a PostgreSQL
+	// message: an SSLRequest, a GSSEncRequest, a CancelRequest or a
+	// StartupMessage.
+	ClientProbeNone ClientProbe = iota
+	// ClientProbeEmpty indicates that the client closed the connection
+	// without sending anything, e.g. a TCP health check.
+	ClientProbeEmpty
+	// ClientProbeHTTP indicates that the client started with an HTTP request
+	// line, e.g. an HTTP health check pointed at the SQL port.
+	ClientProbeHTTP
+	// ClientProbeUnknown indicates that the client sent bytes which are not
+	// the start of a PostgreSQL message.
+	ClientProbeUnknown
+)
+
+// String implements the fmt.Stringer interface.
+func (p ClientProbe) String() string {
+	switch p {
+	case ClientProbeNone:
+		return "none"
+	case ClientProbeEmpty:
+		return "empty"
+	case ClientProbeHTTP:
+		return "http"
+	case ClientProbeUnknown:
+		return "unknown"
+	default:
+		return "invalid"
+	}
+}
+
+// pgCancelRequestCode is the request code of the CancelRequest message.
+const pgCancelRequestCode = 80877102
+
+// httpMethods are the methods which may start the request line of an HTTP
+// health check, followed by a space.
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "OPTIONS"}
+
+// probeHTTPResponse is the response written by HandleClientProbe to HTTP
+// probes.
+const probeHTTPResponse = "HTTP/1.1 200 OK\r\n" +
+	"Content-Length: 0\r\n" +
+	"Connection: close\r\n\r\n"
+
+// DetectClientProbe reads the first 8 bytes sent by the client over conn, i.e.
+// the length and code of the first PostgreSQL message, and classifies the
+// connection. It allows proxies to recognize health-check probes before
+// admitting the connection, so that no backend is dialed on their behalf (see
+// HandleClientProbe).
+//
+// The returned connection replays the bytes which were read before reading
+// from conn, so that it can be passed to FrontendAdmit or ReadClientStartup
+// if the probe is ClientProbeNone. Failing to read from conn, other than
+// because the client closed it, results in a codeClientReadFailed error.
+// Callers should set a deadline on conn to bound the time waiting for the
+// client. Connections which start with a TLS handshake, rather than an
+// SSLRequest, are classified as ClientProbeUnknown, so DetectClientProbe
+// must not be used alongside ExtractSNI.
+func DetectClientProbe(conn net.Conn) (ClientProbe, net.Conn, error) {
+	var header [8]byte
+	n, err := io.ReadFull(conn, header[:])
+	if err != nil && !errors.IsAny(err, io.EOF, io.ErrUnexpectedEOF) {
+		return 0, nil, newErrorf(codeClientReadFailed, "reading first message: %v", err)
+	}
+	peeked := &peekedConn{Conn: conn, peeked: header[:n]}
+	return classifyClientProbe(header[:n]), peeked, nil
+}
+
+// classifyClientProbe classifies the first bytes sent by a client, which are
+// at most 8 bytes long. Fewer bytes indicate that the client closed the
+// connection.
+func classifyClientProbe(b []byte) ClientProbe {
+	if len(b) == 0 {
+		return ClientProbeEmpty
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(b, []byte(method+" ")) || bytes.HasPrefix([]byte(method+" "), b) {
+			return ClientProbeHTTP
+		}
+	}
+	if len(b) < 8 {
+		return ClientProbeUnknown
+	}
+	length := binary.BigEndian.Uint32(b[:4])
+	code := binary.BigEndian.Uint32(b[4:])
+	switch {
+	case length == 8 && (code == SSLRequestCode || code == uint32(pgGSSEncRequest[1])):
+		return ClientProbeNone
+	case length == 16 && code == pgCancelRequestCode:
+		return ClientProbeNone
+	case length > 8 && code>>16 == pgproto3.ProtocolVersionNumber>>16:
+		return ClientProbeNone
+	default:
+		return ClientProbeUnknown
+	}
+}
+
+// HandleClientProbe responds to a health-check probe detected by
+// DetectClientProbe: HTTP probes are answered with an empty "200 OK"
+// response, and nothing is written for the other probes. The caller remains
+// responsible for closing conn. Failing to write the response results in a
+// codeClientWriteFailed error.
+func HandleClientProbe(conn net.Conn, probe ClientProbe) error {
+	if probe != ClientProbeHTTP {
+		return nil
+	}
+	if _, err := io.WriteString(conn, probeHTTPResponse); err != nil {
+		return newErrorf(codeClientWriteFailed, "responding to HTTP probe: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectClientProbe(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tc := range []struct {
+		name  string
+		sent  []byte
+		probe ClientProbe
+	}{
+		{"startup", testStartupMessage().Encode(nil), ClientProbeNone},
+		{"ssl request", (&pgproto3.SSLRequest{}).Encode(nil), ClientProbeNone},
+		{"gss request", (&pgproto3.GSSEncRequest{}).Encode(nil), ClientProbeNone},
+		{"cancel request", (&pgproto3.CancelRequest{ProcessID: 1, SecretKey: 2}).Encode(nil), ClientProbeNone},
+		{"empty", nil, ClientProbeEmpty},
+		{"http", []byte("GET /health HTTP/1.1\r\nHost: proxy\r\n\r\n"), ClientProbeHTTP},
+		{"short http", []byte("HEAD"), ClientProbeHTTP},
+		{"tls", []byte{0x16, 0x03, 0x01, 0x00, 0xc8, 0x01, 0x00, 0x00, 0xc4}, ClientProbeUnknown},
+		{"short", []byte{0, 0, 0}, ClientProbeUnknown},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cli, srv := net.Pipe()
+			defer srv.Close()
+			require.NoError(t, srv.SetDeadline(time.Now().Add(10*time.Second)))
+			go func() {
+				_, _ = cli.Write(tc.sent)
+				_ = cli.Close()
+			}()
+
+			probe, conn, err := DetectClientProbe(srv)
+			require.NoError(t, err)
+			require.Equal(t, tc.probe, probe)
+			// The bytes which were read are replayed.
+			b, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			require.Equal(t, string(tc.sent), string(b))
+		})
+	}
+
+	t.Run("read failure", func(t *testing.T) {
+		cli, srv := net.Pipe()
+		defer cli.Close()
+		require.NoError(t, srv.SetDeadline(time.Now().Add(10*time.Millisecond)))
+		_, _, err := DetectClientProbe(srv)
+		require.Equal(t, codeClientReadFailed, getErrorCode(err))
+	})
+}
+
+func TestHandleClientProbe(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go func() {
+		_ = HandleClientProbe(srv, ClientProbeHTTP)
+		_ = srv.Close()
+	}()
+	b, err := io.ReadAll(cli)
+	require.NoError(t, err)
+	require.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", string(b))
+
+	// Nothing is written for the other probes.
+	writeErr := failingWriteConn{err: io.ErrClosedPipe}
+	require.NoError(t, HandleClientProbe(writeErr, ClientProbeEmpty))
+	require.NoError(t, HandleClientProbe(writeErr, ClientProbeUnknown))
+	err = HandleClientProbe(writeErr, ClientProbeHTTP)
+	require.Equal(t, codeClientWriteFailed, getErrorCode(err))
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// errClientHelloRead is returned by the GetConfigForClient callback of
+// ExtractSNI to abort the handshake once the ClientHello was parsed.
+var errClientHelloRead = errors.New("ClientHello read")
+
+// ExtractSNI reads the TLS ClientHello sent by the client over clientConn,
+// which must start with a TLS handshake (e.g. for a transparent TLS proxy,
+// rather than a PostgreSQL SSLRequest), and returns the server name requested
+// through SNI, so that the proxy can pick a backend before terminating TLS.
+// The serverName is empty if the client did not send the SNI extension.
+//
+// The handshake is not completed, and nothing is written to clientConn: the
+// returned bufferedConn replays the bytes of the ClientHello before reading
+// from clientConn, so that it can be passed to tls.Server. Failing to read or
+// parse the ClientHello results in a codeClientReadFailed error. Callers
+// should set a deadline on clientConn to bound the time waiting for the
+// client.
+func ExtractSNI(clientConn net.Conn) (serverName string, bufferedConn net.Conn, err error) {
+	var peeked bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err = tls.Server(&readOnlyConn{
+		Conn:   clientConn,
+		reader: io.TeeReader(clientConn, &peeked),
+	}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", nil, wrapErrorf(codeClientReadFailed, err, "reading TLS ClientHello")
+	}
+	return hello.ServerName, &peekedConn{Conn: clientConn, peeked: peeked.Bytes()}, nil
+}
+
+// readOnlyConn is a net.Conn wrapper which reads through reader, and discards
+// writes and deadline changes, so that a TLS handshake can be initiated over
+// a connection without affecting it.
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+var _ net.Conn = &readOnlyConn{}
+
+// Read implements the net.Conn interface.
+func (c *readOnlyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Write implements the net.Conn interface.
+func (c *readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// Close implements the net.Conn interface.
+func (c *readOnlyConn) Close() error {
+	return nil
+}
+
+// SetDeadline implements the net.Conn interface.
+func (c *readOnlyConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+// SetReadDeadline implements the net.Conn interface.
+func (c *readOnlyConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn interface.
+func (c *readOnlyConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractSNI(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+
+	for _, serverName := range []string{"tenant-42.example.com", ""} {
+		t.Run(serverName, func(t *testing.T) {
+			clientConn, proxyConn := net.Pipe()
+			defer clientConn.Close()
+			defer proxyConn.Close()
+
+			errCh := make(chan error, 1)
+			go func() {
+				tlsConn := tls.Client(clientConn, &tls.Config{
+					ServerName:         serverName,
+					InsecureSkipVerify: true,
+				})
+				if err := tlsConn.Handshake(); err != nil {
+					errCh <- err
+					return
+				}
+				_, err := tlsConn.Write([]byte("ok"))
+				errCh <- err
+			}()
+
+			sni, conn, err := ExtractSNI(proxyConn)
+			require.NoError(t, err)
+			require.Equal(t, serverName, sni)
+
+			// The handshake can be completed over the returned connection.
+			tlsConn := tls.Server(conn, serverCfg)
+			buf := make([]byte, 2)
+			_, err = io.ReadFull(tlsConn, buf)
+			require.NoError(t, err)
+			require.Equal(t, "ok", string(buf))
+			require.NoError(t, <-errCh)
+		})
+	}
+
+	t.Run("not TLS", func(t *testing.T) {
+		clientConn, proxyConn := net.Pipe()
+		defer proxyConn.Close()
+		go func() {
+			defer clientConn.Close()
+			_, _ = clientConn.Write((&pgproto3.SSLRequest{}).Encode(nil))
+		}()
+
+		_, conn, err := ExtractSNI(proxyConn)
+		require.Nil(t, conn)
+		require.Equal(t, codeClientReadFailed, getErrorCode(err))
+		require.Regexp(t, "reading TLS ClientHello", err)
+	})
+}
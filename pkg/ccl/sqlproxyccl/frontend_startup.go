@@ -0,0 +1,153 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// maxClientNegotiationRequests is the maximum number of SSLRequest and
+// GSSEncRequest messages accepted by NegotiateClient before the startup
+// message. PostgreSQL clients send at most one of each.
+const maxClientNegotiationRequests = 2
+
+// ReadClientStartup reads the StartupMessage sent by a client over conn, in
+// plaintext. It is the client-side counterpart of the relay of the startup
+// message to the backend. SSLRequest and GSSEncRequest messages which precede
+// the startup message are refused (i.e. answered with 'N'), after which the
+// client proceeds without encryption; callers which terminate TLS should use
+// NegotiateClient or FrontendAdmit instead.
+//
+// Exactly the bytes of the messages are consumed, so that conn can be used
+// for the rest of the session. Messages are read in full, however the stream
+// is fragmented, once their length was checked: if the startup message is
+// larger than maxSize bytes (DefaultMaxStartupMessageSize if maxSize is not
+// positive), a codeClientStartupTooLarge error is returned. Other messages,
+// such as a CancelRequest, result in a codeUnexpectedStartupMessage error.
+func ReadClientStartup(conn net.Conn, maxSize int) (*pgproto3.StartupMessage, error) {
+	msg, _, _, err := NegotiateClient(conn, NegotiationOpts{MaxStartupMessageSize: maxSize})
+	return msg, err
+}
+
+// NegotiationOpts configures the negotiation of NegotiateClient.
+type NegotiationOpts struct {
+	// TLSConfig, if set, is used to accept the SSLRequest of the client and
+	// terminate TLS. Otherwise, SSLRequests are refused.
+	TLSConfig *tls.Config
+	// RequireTLS, if true, rejects clients which send their startup message
+	// without establishing TLS first, with a
+	// codeUnexpectedInsecureStartupMessage error.
+	RequireTLS bool
+	// MaxStartupMessageSize is the maximum size of the startup message, or
+	// DefaultMaxStartupMessageSize if it is not positive.
+	MaxStartupMessageSize int
+}
+
+// NegotiateClient reads the negotiation requests sent by a client over conn,
+// up to and including its StartupMessage. PostgreSQL clients may send a
+// GSSEncRequest, which is always refused since GSSAPI encryption is not
+// supported, and an SSLRequest, which is accepted if opts.TLSConfig is set, in
+// which case the TLS handshake is performed, and the rest of the negotiation
+// proceeds over TLS. The requests may come in any order (e.g. a GSSEncRequest,
+// refused, followed by an SSLRequest), but no more than
+// maxClientNegotiationRequests of them, and none once TLS is established.
+//
+// It returns the startup message, the connection to use for the rest of the
+// session, which is a *tls.Conn over conn if TLS was established, and whether
+// TLS was established. The connection is returned along with errors which
+// occur after TLS was established, so that the caller can report them to the
+// client over TLS; otherwise it is conn. Messages are read as by
+// ReadClientStartup, whose errors NegotiateClient shares.
+func NegotiateClient(
+	conn net.Conn, opts NegotiationOpts,
+) (_ *pgproto3.StartupMessage, _ net.Conn, tlsEstablished bool, _ error) {
+	maxSize := opts.MaxStartupMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxStartupMessageSize
+	}
+	for requests := 0; ; requests++ {
+		var header [8]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return nil, conn, tlsEstablished, newErrorf(
+				codeClientReadFailed, "reading startup message: %v", err,
+			)
+		}
+		length := int(binary.BigEndian.Uint32(header[:4]))
+		code := int32(binary.BigEndian.Uint32(header[4:]))
+		if length == 8 && (code == pgSSLRequest[1] || code == pgGSSEncRequest[1]) {
+			if requests >= maxClientNegotiationRequests {
+				return nil, conn, tlsEstablished, newErrorf(
+					codeUnexpectedStartupMessage, "too many encryption requests before startup message",
+				)
+			}
+			if tlsEstablished {
+				return nil, conn, tlsEstablished, newErrorf(
+					codeUnexpectedStartupMessage, "unexpected encryption request over TLS",
+				)
+			}
+			if code != pgSSLRequest[1] || opts.TLSConfig == nil {
+				if _, err := conn.Write([]byte{pgRejectSSLRequest}); err != nil {
+					return nil, conn, tlsEstablished, newErrorf(
+						codeClientWriteFailed, "refusing encryption request: %v", err,
+					)
+				}
+				continue
+			}
+			if _, err := conn.Write([]byte{pgAcceptSSLRequest}); err != nil {
+				return nil, conn, tlsEstablished, newErrorf(
+					codeClientWriteFailed, "accepting SSLRequest: %v", err,
+				)
+			}
+			tlsConn := tls.Server(conn, opts.TLSConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, conn, tlsEstablished, newErrorf(
+					codeClientReadFailed, "TLS handshake with client: %v", err,
+				)
+			}
+			conn, tlsEstablished = tlsConn, true
+			continue
+		}
+		if opts.RequireTLS && !tlsEstablished {
+			return nil, conn, tlsEstablished, newErrorf(
+				codeUnexpectedInsecureStartupMessage, "startup message received without TLS",
+			)
+		}
+		if length > maxSize {
+			return nil, conn, tlsEstablished, newErrorf(
+				codeClientStartupTooLarge, "startup message of %d bytes exceeds the maximum of %d bytes",
+				length, maxSize,
+			)
+		}
+		if length < len(header) || code>>16 != pgproto3.ProtocolVersionNumber>>16 {
+			return nil, conn, tlsEstablished, newErrorf(
+				codeUnexpectedStartupMessage, "unexpected startup message: length %d, code %d",
+				length, code,
+			)
+		}
+		body := make([]byte, length-4)
+		copy(body, header[4:])
+		if _, err := io.ReadFull(conn, body[4:]); err != nil {
+			return nil, conn, tlsEstablished, newErrorf(
+				codeClientReadFailed, "reading startup message: %v", err,
+			)
+		}
+		msg := &pgproto3.StartupMessage{}
+		if err := msg.Decode(body); err != nil {
+			return nil, conn, tlsEstablished, newErrorf(
+				codeUnexpectedStartupMessage, "decoding startup message: %v", err,
+			)
+		}
+		return msg, conn, tlsEstablished, nil
+	}
+}
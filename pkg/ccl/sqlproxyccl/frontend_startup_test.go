@@ -0,0 +1,226 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadClientStartup(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	sslRequest := (&pgproto3.SSLRequest{}).Encode(nil)
+	gssEncRequest := (&pgproto3.GSSEncRequest{}).Encode(nil)
+	// client sends msgs over a pipe, one byte at a time, and returns the
+	// responses it received, once the proxy end of the pipe is closed.
+	client := func(msgs ...[]byte) (proxyConn net.Conn, responses <-chan string) {
+		clientConn, proxyConn := net.Pipe()
+		responseCh := make(chan string, 1)
+		go func() {
+			defer clientConn.Close()
+			var received []byte
+			for _, msg := range msgs {
+				for i := range msg {
+					if _, err := clientConn.Write(msg[i : i+1]); err != nil {
+						break
+					}
+				}
+				if bytes.Equal(msg, sslRequest) || bytes.Equal(msg, gssEncRequest) {
+					buf := make([]byte, 1)
+					if _, err := io.ReadFull(clientConn, buf); err != nil {
+						break
+					}
+					received = append(received, buf...)
+				}
+			}
+			responseCh <- string(received)
+		}()
+		return proxyConn, responseCh
+	}
+
+	t.Run("negotiation", func(t *testing.T) {
+		conn, responses := client(
+			sslRequest, gssEncRequest, testStartupMessage().Encode(nil), []byte("Q"),
+		)
+		defer conn.Close()
+		msg, err := ReadClientStartup(conn, 0 /* maxSize */)
+		require.NoError(t, err)
+		require.Equal(t, testStartupMessage(), msg)
+		// The bytes following the startup message are not consumed.
+		buf := make([]byte, 1)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "Q", string(buf))
+		require.Equal(t, "NN", <-responses)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		msg := testStartupMessage()
+		msg.Parameters["options"] = strings.Repeat("x", 100)
+		conn, _ := client(msg.Encode(nil))
+		defer conn.Close()
+		_, err := ReadClientStartup(conn, 100 /* maxSize */)
+		require.Equal(t, codeClientStartupTooLarge, getErrorCode(err))
+		require.Regexp(t, "startup message of 147 bytes exceeds the maximum of 100 bytes", err)
+	})
+
+	t.Run("too many requests", func(t *testing.T) {
+		conn, _ := client(sslRequest, sslRequest, sslRequest)
+		defer conn.Close()
+		_, err := ReadClientStartup(conn, 0 /* maxSize */)
+		require.Equal(t, codeUnexpectedStartupMessage, getErrorCode(err))
+		require.Regexp(t, "too many encryption requests", err)
+	})
+
+	t.Run("cancel request", func(t *testing.T) {
+		conn, _ := client((&pgproto3.CancelRequest{ProcessID: 1, SecretKey: 2}).Encode(nil))
+		defer conn.Close()
+		_, err := ReadClientStartup(conn, 0 /* maxSize */)
+		require.Equal(t, codeUnexpectedStartupMessage, getErrorCode(err))
+		require.Regexp(t, "unexpected startup message: length 16, code 80877102", err)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		conn, _ := client(testStartupMessage().Encode(nil)[:20])
+		defer conn.Close()
+		_, err := ReadClientStartup(conn, 0 /* maxSize */)
+		require.Equal(t, codeClientReadFailed, getErrorCode(err))
+	})
+}
+
+func TestNegotiateClient(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	sslRequest := (&pgproto3.SSLRequest{}).Encode(nil)
+	gssEncRequest := (&pgproto3.GSSEncRequest{}).Encode(nil)
+
+	// client sends the requests over a pipe, followed by the startup message
+	// (over TLS if the SSLRequest is accepted) and by extra, and returns the
+	// responses it received to the requests, and its error, if any.
+	type result struct {
+		responses string
+		err       error
+	}
+	client := func(extra []byte, requests ...[]byte) (net.Conn, <-chan result) {
+		clientConn, proxyConn := net.Pipe()
+		resultCh := make(chan result, 1)
+		go func() {
+			defer clientConn.Close()
+			var res result
+			defer func() { resultCh <- res }()
+			var conn net.Conn = clientConn
+			for _, req := range requests {
+				if _, res.err = conn.Write(req); res.err != nil {
+					return
+				}
+				buf := make([]byte, 1)
+				if _, res.err = io.ReadFull(conn, buf); res.err != nil {
+					return
+				}
+				res.responses += string(buf)
+				if buf[0] == pgAcceptSSLRequest {
+					tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+					if res.err = tlsConn.Handshake(); res.err != nil {
+						return
+					}
+					conn = tlsConn
+				}
+			}
+			if _, res.err = conn.Write(append(testStartupMessage().Encode(nil), extra...)); res.err != nil {
+				return
+			}
+			// Wait for the proxy end to be closed.
+			_, _ = io.Copy(io.Discard, conn)
+		}()
+		return proxyConn, resultCh
+	}
+
+	t.Run("GSS then SSL", func(t *testing.T) {
+		conn, results := client([]byte("Q"), gssEncRequest, sslRequest)
+		msg, negotiated, isTLS, err := NegotiateClient(conn, NegotiationOpts{
+			TLSConfig: serverCfg, RequireTLS: true,
+		})
+		require.NoError(t, err)
+		require.Equal(t, testStartupMessage(), msg)
+		require.True(t, isTLS)
+		_, ok := negotiated.(*tls.Conn)
+		require.True(t, ok)
+		// The bytes following the startup message are not consumed.
+		buf := make([]byte, 1)
+		_, err = io.ReadFull(negotiated, buf)
+		require.NoError(t, err)
+		require.Equal(t, "Q", string(buf))
+		require.NoError(t, negotiated.Close())
+		res := <-results
+		require.NoError(t, res.err)
+		require.Equal(t, "NS", res.responses)
+	})
+
+	t.Run("SSL refused", func(t *testing.T) {
+		conn, results := client(nil, sslRequest, gssEncRequest)
+		msg, negotiated, isTLS, err := NegotiateClient(conn, NegotiationOpts{})
+		require.NoError(t, err)
+		require.Equal(t, testStartupMessage(), msg)
+		require.False(t, isTLS)
+		require.True(t, negotiated == conn)
+		require.NoError(t, negotiated.Close())
+		require.Equal(t, "NN", (<-results).responses)
+	})
+
+	t.Run("TLS required", func(t *testing.T) {
+		conn, _ := client(nil, gssEncRequest)
+		defer conn.Close()
+		_, _, isTLS, err := NegotiateClient(conn, NegotiationOpts{
+			TLSConfig: serverCfg, RequireTLS: true,
+		})
+		require.False(t, isTLS)
+		require.Equal(t, codeUnexpectedInsecureStartupMessage, getErrorCode(err))
+	})
+
+	t.Run("request over TLS", func(t *testing.T) {
+		// The second SSLRequest is sent over TLS, and is never answered.
+		conn, _ := client(nil, sslRequest, sslRequest)
+		_, negotiated, isTLS, err := NegotiateClient(conn, NegotiationOpts{TLSConfig: serverCfg})
+		require.True(t, isTLS)
+		require.Equal(t, codeUnexpectedStartupMessage, getErrorCode(err))
+		require.Regexp(t, "unexpected encryption request over TLS", err)
+		require.NoError(t, negotiated.Close())
+	})
+
+	t.Run("handshake failure", func(t *testing.T) {
+		clientConn, proxyConn := net.Pipe()
+		defer proxyConn.Close()
+		go func() {
+			defer clientConn.Close()
+			if _, err := clientConn.Write(sslRequest); err != nil {
+				return
+			}
+			if _, err := clientConn.Read(make([]byte, 1)); err != nil {
+				return
+			}
+			_, _ = clientConn.Write([]byte("not a ClientHello"))
+			_, _ = io.Copy(io.Discard, clientConn)
+		}()
+		_, _, isTLS, err := NegotiateClient(proxyConn, NegotiationOpts{TLSConfig: serverCfg})
+		require.False(t, isTLS)
+		require.Equal(t, codeClientReadFailed, getErrorCode(err))
+		require.Regexp(t, "TLS handshake with client", err)
+	})
+}
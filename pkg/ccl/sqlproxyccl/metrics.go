@@ -203,12 +203,14 @@ func (metrics *metrics) updateForError(err error) {
 		case codeProxyRefusedConnection:
 			metrics.RefusedConnCount.Inc(1)
 			metrics.BackendDownCount.Inc(1)
+		case codeStartupGateRejected:
+			metrics.RefusedConnCount.Inc(1)
 		case codeParamsRoutingFailed, codeUnavailable:
 			metrics.RoutingErrCount.Inc(1)
 			metrics.BackendDownCount.Inc(1)
 		case codeBackendDown:
 			metrics.BackendDownCount.Inc(1)
-		case codeAuthFailed:
+		case codeAuthFailed, codeUnsupportedChannelBinding:
 			metrics.AuthFailedCount.Inc(1)
 		}
 	}
@@ -16,10 +16,43 @@ import (
 	"github.com/jackc/pgproto3/v2"
 )
 
-const pgAcceptSSLRequest = 'S'
+// SSLRequestCode is the request code of the SSLRequest message, which is sent
+// by a client in place of a StartupMessage to request that the connection be
+// upgraded to TLS. The message consists of its length (8) followed by this
+// code, both as big-endian int32s.
+//
+// See https://www.postgresql.org/docs/current/protocol-flow.html#id-1.10.5.7.11
+// and https://www.postgresql.org/docs/current/protocol-message-formats.html.
+const SSLRequestCode = 80877103
+
+// AcceptSSLRequestByte is the single byte a server responds with to accept an
+// SSLRequest, after which the client initiates the TLS handshake. Any other
+// response (normally 'N') means that the server refused to use TLS, except for
+// an ErrorResponse, which servers may send if they fail to process the
+// SSLRequest.
+const AcceptSSLRequestByte byte = 'S'
+
+// pgAcceptSSLRequest is an alias of AcceptSSLRequestByte.
+const pgAcceptSSLRequest = AcceptSSLRequestByte
+
+// pgRejectSSLRequest is the byte sent in response to an SSLRequest to refuse
+// upgrading the connection to TLS.
+const pgRejectSSLRequest = 'N'
+
+// pgErrorResponse is the type of the ErrorResponse message.
+const pgErrorResponse = 'E'
+
+// pgNegotiateProtocolVersion is the type of the NegotiateProtocolVersion
+// message.
+const pgNegotiateProtocolVersion = 'v'
+
+// pgSSLRequest is the encoded SSLRequest message.
+var pgSSLRequest = []int32{8, SSLRequestCode}
+
+const pgAcceptGSSEncRequest = 'G'
 
-// See https://www.postgresql.org/docs/9.1/protocol-message-formats.html.
-var pgSSLRequest = []int32{8, 80877103}
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html.
+var pgGSSEncRequest = []int32{8, 80877104}
 
 // sendErrToClientAndUpdateMetrics simply combines the update of the metrics and
 // the transmission of the err back to the client.
@@ -41,7 +74,15 @@ func toPgError(err error) *pgproto3.ErrorResponse {
 			codeBackendDisconnected,
 			codeAuthFailed,
 			codeProxyRefusedConnection,
-			codeUnavailable:
+			codeUnavailable,
+			codeUnsupportedChannelBinding,
+			codeClientStartupTooLarge,
+			codeUnsupportedProtocolVersion,
+			codeStartupGateRejected,
+			codeInvalidStartupParams,
+			codeBackendAuthTimeout,
+			codeBackendClosedDuringStartup,
+			codeStartupParamNotAllowed:
 			msg = codeErr.Error()
 		// The rest - the message sent back is sanitized.
 		case codeUnexpectedInsecureStartupMessage:
@@ -0,0 +1,117 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// ErrProxyIdleTimeout is returned by ProxyCopy if no bytes were transferred
+// for the idle timeout.
+var ErrProxyIdleTimeout = errors.New("proxied connection exceeded idle timeout")
+
+// proxyCopyBufSize is the size of the buffer used by ProxyCopy.
+const proxyCopyBufSize = 32 << 10
+
+// ProxyCopy copies from src to dst until src reaches EOF, ctx is done, or an
+// error occurs, and returns the number of bytes written to dst. Reaching EOF
+// on src is not an error. It is meant for the proxying of a connection
+// returned by BackendDial, with one call per direction.
+//
+// If idleTimeout is positive, each read from src, and each write to dst, must
+// complete within idleTimeout, otherwise ErrProxyIdleTimeout is returned. The
+// timeout is enforced through the read deadline of src and the write deadline
+// of dst, so the two directions of a connection can be copied concurrently,
+// but each direction is subject to the timeout separately: a client waiting
+// for the result of a long-running query is idle. If ctx is done first,
+// ctx.Err() is returned. The deadlines are cleared before returning. Neither
+// connection is closed.
+func ProxyCopy(
+	ctx context.Context, dst, src net.Conn, idleTimeout time.Duration,
+) (written int64, err error) {
+	defer func() {
+		_ = src.SetReadDeadline(time.Time{})
+		_ = dst.SetWriteDeadline(time.Time{})
+	}()
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-ctx.Done():
+				// Setting a deadline in the past unblocks pending reads and
+				// writes.
+				_ = src.SetReadDeadline(time.Unix(1, 0))
+				_ = dst.SetWriteDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+		defer func() {
+			close(done)
+			wg.Wait()
+		}()
+	}
+
+	buf := make([]byte, proxyCopyBufSize)
+	for {
+		// The deadlines are set before checking ctx, so that they can't
+		// override the deadlines set once ctx is done.
+		if idleTimeout > 0 {
+			_ = src.SetReadDeadline(timeutil.Now().Add(idleTimeout))
+		}
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if idleTimeout > 0 {
+				_ = dst.SetWriteDeadline(timeutil.Now().Add(idleTimeout))
+			}
+			if err := ctx.Err(); err != nil {
+				return written, err
+			}
+			nw, writeErr := dst.Write(buf[:n])
+			written += int64(nw)
+			if writeErr == nil && nw != n {
+				writeErr = io.ErrShortWrite
+			}
+			if writeErr != nil {
+				return written, proxyCopyError(ctx, writeErr)
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, proxyCopyError(ctx, readErr)
+		}
+	}
+}
+
+// proxyCopyError translates err, which failed a read or write of ProxyCopy,
+// into the error to return.
+func proxyCopyError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrProxyIdleTimeout
+	}
+	return err
+}
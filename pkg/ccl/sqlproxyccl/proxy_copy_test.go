@@ -0,0 +1,105 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyCopy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+
+	t.Run("eof", func(t *testing.T) {
+		srcCli, src := net.Pipe()
+		dst, dstCli := net.Pipe()
+		defer src.Close()
+		defer dst.Close()
+
+		payload := bytes.Repeat([]byte("x"), 3*proxyCopyBufSize+1)
+		go func() {
+			_, _ = srcCli.Write(payload)
+			_ = srcCli.Close()
+		}()
+		received := make(chan []byte, 1)
+		go func() {
+			b, _ := io.ReadAll(dstCli)
+			received <- b
+		}()
+		written, err := ProxyCopy(ctx, dst, src, time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(payload)), written)
+		require.NoError(t, dst.Close())
+		require.Equal(t, payload, <-received)
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		srcCli, src := net.Pipe()
+		dst, dstCli := net.Pipe()
+		defer srcCli.Close()
+		defer dstCli.Close()
+		defer src.Close()
+		defer dst.Close()
+
+		go func() { _, _ = srcCli.Write([]byte("ping")) }()
+		go func() { _, _ = io.ReadFull(dstCli, make([]byte, 4)) }()
+		written, err := ProxyCopy(ctx, dst, src, 50*time.Millisecond)
+		require.Equal(t, ErrProxyIdleTimeout, err)
+		require.Equal(t, int64(4), written)
+
+		// The deadlines were cleared.
+		go func() { _, _ = srcCli.Write([]byte("pong")) }()
+		time.Sleep(100 * time.Millisecond)
+		n, err := src.Read(make([]byte, 4))
+		require.NoError(t, err)
+		require.Equal(t, 4, n)
+	})
+
+	t.Run("write idle timeout", func(t *testing.T) {
+		srcCli, src := net.Pipe()
+		dst, dstCli := net.Pipe()
+		defer srcCli.Close()
+		defer dstCli.Close()
+		defer src.Close()
+		defer dst.Close()
+
+		// Nobody reads from dst.
+		go func() { _, _ = srcCli.Write([]byte("ping")) }()
+		_, err := ProxyCopy(ctx, dst, src, 50*time.Millisecond)
+		require.Equal(t, ErrProxyIdleTimeout, err)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		srcCli, src := net.Pipe()
+		dst, dstCli := net.Pipe()
+		defer srcCli.Close()
+		defer dstCli.Close()
+		defer src.Close()
+		defer dst.Close()
+
+		ctx, cancel := context.WithCancel(ctx)
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := ProxyCopy(ctx, dst, src, 0 /* idleTimeout */)
+			errCh <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		require.Equal(t, context.Canceled, <-errCh)
+	})
+}
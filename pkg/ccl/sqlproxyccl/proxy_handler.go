@@ -155,6 +155,16 @@ var throttledError = errors.WithHint(
 	newErrorf(codeProxyRefusedConnection, "connection attempt throttled"),
 	throttledErrorHint)
 
+// StartupGate, if set, is invoked for every client connection once its startup
+// message was parsed, and before any work is done to connect it to a backend,
+// e.g. to deny connections to suspended tenants. params contains a copy of the
+// startup parameters sent by the client, including the user, the database and
+// any custom parameter. If the gate returns an error, the connection is
+// rejected with a codeStartupGateRejected error, which wraps it (the message
+// of the error, and its hints, are sent to the client), and no backend
+// connection is ever opened.
+var StartupGate func(params map[string]string) error
+
 // newProxyHandler will create a new proxy handler with configuration based on
 // the provided options.
 func newProxyHandler(
@@ -313,6 +323,19 @@ func (handler *proxyHandler) handle(ctx context.Context, incomingConn *proxyConn
 	ctx = logtags.AddTag(ctx, "cluster", clusterName)
 	ctx = logtags.AddTag(ctx, "tenant", tenID)
 
+	if gate := StartupGate; gate != nil {
+		params := make(map[string]string, len(fe.Msg.Parameters))
+		for k, v := range fe.Msg.Parameters {
+			params[k] = v
+		}
+		if err := gate(params); err != nil {
+			log.Errorf(ctx, "startup gate rejected connection: %v", err)
+			err = wrapErrorf(codeStartupGateRejected, err, "connection rejected")
+			updateMetricsAndSendErrToClient(err, fe.Conn, handler.metrics)
+			return err
+		}
+	}
+
 	// Use an empty string as the default port as we only care about the
 	// correctly parsing the IP address here.
 	ipAddr, _, err := addr.SplitHostPort(fe.Conn.RemoteAddr().String(), "")
@@ -583,6 +583,37 @@ func TestProxyRefuseConn(t *testing.T) {
 	require.Equal(t, int64(0), s.metrics.AuthFailedCount.Count())
 }
 
+func TestProxyStartupGate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	te := newTester()
+	defer te.Close()
+
+	defer testutils.TestingHook(&BackendDial, func(
+		msg *pgproto3.StartupMessage, outgoingAddress string, tlsConfig *tls.Config,
+	) (net.Conn, error) {
+		t.Error("unexpected dial")
+		return nil, newErrorf(codeBackendDown, "unexpected dial")
+	})()
+	defer testutils.TestingHook(&StartupGate, func(params map[string]string) error {
+		if params["application_name"] == "suspended" {
+			return errors.WithHint(errors.New("tenant is suspended"), "contact support")
+		}
+		return nil
+	})()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	s, addr := newSecureProxyServer(ctx, t, stopper, &ProxyOptions{})
+
+	url := fmt.Sprintf("postgres://root:admin@%s?sslmode=require&options=--cluster=tenant-cluster-28&application_name=suspended", addr)
+	te.TestConnectErr(ctx, t, url, codeStartupGateRejected, "connection rejected: tenant is suspended")
+	require.Equal(t, int64(1), s.metrics.RefusedConnCount.Count())
+	require.Equal(t, int64(0), s.metrics.BackendDownCount.Count())
+}
+
 func TestDenylistUpdate(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer log.Scope(t).Close(t)
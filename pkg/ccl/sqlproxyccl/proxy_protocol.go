@@ -0,0 +1,102 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// proxyProtocolSignature is the fixed 12-byte signature that starts every
+// PROXY protocol v2 header.
+//
+// See https://www.haproxy.org/download/2.6/doc/proxy-protocol.txt.
+var proxyProtocolSignature = []byte{
+	0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+}
+
+const (
+	// proxyProtocolV2Local is the version and command byte for a v2 header
+	// with the LOCAL command, which tells the receiver to use the real
+	// connection endpoints.
+	proxyProtocolV2Local = 0x20
+	// proxyProtocolV2Proxy is the version and command byte for a v2 header
+	// with the PROXY command, which carries the original connection endpoints.
+	proxyProtocolV2Proxy = 0x21
+
+	// proxyProtocolUnspec is the address family and protocol byte for
+	// unknown or unsupported addresses.
+	proxyProtocolUnspec = 0x00
+	// proxyProtocolTCPv4 is the address family and protocol byte for TCP over
+	// IPv4.
+	proxyProtocolTCPv4 = 0x11
+	// proxyProtocolTCPv6 is the address family and protocol byte for TCP over
+	// IPv6.
+	proxyProtocolTCPv6 = 0x21
+)
+
+// proxyProtocolAddrs contains the endpoints of the client connection that are
+// forwarded to the backend through the PROXY protocol.
+type proxyProtocolAddrs struct {
+	// source is the address of the client.
+	source net.Addr
+	// destination is the address the client connected to, i.e. the address of
+	// the proxy.
+	destination net.Addr
+}
+
+// ProxyProtocol configures the dialer to write a PROXY protocol v2 header
+// carrying the given client endpoints immediately after connecting to the
+// backend, ahead of the SSLRequest (or of the startup message, if TLS is not
+// used), in the same write. This allows a load balancer in front of
+// the backend to preserve the original client address. Typically, source and
+// destination are the RemoteAddr and LocalAddr of the client connection.
+//
+// If the addresses are not TCP addresses of the same IP family, a header with
+// the LOCAL command is written instead, which tells the receiver to use the
+// endpoints of the connection itself.
+func ProxyProtocol(source, destination net.Addr) DialOption {
+	return func(opts *dialOptions) {
+		opts.proxyProtocol = &proxyProtocolAddrs{source: source, destination: destination}
+	}
+}
+
+// encodeProxyProtocolHeader returns the PROXY protocol v2 header for the given
+// addresses.
+func encodeProxyProtocolHeader(addrs *proxyProtocolAddrs) []byte {
+	buf := append([]byte(nil), proxyProtocolSignature...)
+
+	src, srcOK := addrs.source.(*net.TCPAddr)
+	dst, dstOK := addrs.destination.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		return append(buf, proxyProtocolV2Local, proxyProtocolUnspec, 0, 0)
+	}
+
+	var srcIP, dstIP net.IP
+	var family byte
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		srcIP, dstIP, family = src4, dst4, proxyProtocolTCPv4
+	} else if src16, dst16 := src.IP.To16(), dst.IP.To16(); src16 != nil && dst16 != nil {
+		srcIP, dstIP, family = src16, dst16, proxyProtocolTCPv6
+	} else {
+		return append(buf, proxyProtocolV2Local, proxyProtocolUnspec, 0, 0)
+	}
+
+	// The address block consists of the source and destination addresses,
+	// followed by the source and destination ports.
+	length := uint16(2*len(srcIP) + 4)
+	buf = append(buf, proxyProtocolV2Proxy, family)
+	buf = append(buf, byte(length>>8), byte(length))
+	buf = append(buf, srcIP...)
+	buf = append(buf, dstIP...)
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(dst.Port))
+	return append(buf, ports[:]...)
+}
@@ -0,0 +1,248 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeProxyProtocolHeader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	sig := string(proxyProtocolSignature)
+	for _, tc := range []struct {
+		name     string
+		src, dst net.Addr
+		expected string
+	}{
+		{
+			name:     "ipv4",
+			src:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432},
+			dst:      &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 26257},
+			expected: sig + "\x21\x11\x00\x0c" + "\x0a\x00\x00\x01" + "\xc0\xa8\x01\x02" + "\x15\x38\x66\x91",
+		},
+		{
+			name: "ipv6",
+			src:  &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1},
+			dst:  &net.TCPAddr{IP: net.ParseIP("::2"), Port: 2},
+			expected: sig + "\x21\x21\x00\x24" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\x00\x01\x00\x02",
+		},
+		{
+			name: "mixed families",
+			src:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1},
+			dst:  &net.TCPAddr{IP: net.ParseIP("::2"), Port: 2},
+			expected: sig + "\x21\x21\x00\x24" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x0a\x00\x00\x01" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\x00\x01\x00\x02",
+		},
+		{
+			name:     "non-tcp",
+			src:      &net.UnixAddr{Name: "/tmp/foo", Net: "unix"},
+			dst:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1},
+			expected: sig + "\x20\x00\x00\x00",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := encodeProxyProtocolHeader(&proxyProtocolAddrs{source: tc.src, destination: tc.dst})
+			require.Equal(t, []byte(tc.expected), header)
+		})
+	}
+}
+
+func TestBackendDialProxyProtocol(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 26257}
+	expected := encodeProxyProtocolHeader(&proxyProtocolAddrs{source: src, destination: dst})
+
+	headerCh := make(chan []byte, 1)
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		header := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		headerCh <- header
+		if msg, err := receiveStartupMessage(conn); err == nil {
+			msgCh <- msg
+		}
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), addr, nil /* tlsConfig */, ProxyProtocol(src, dst),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, expected, <-headerCh)
+	require.Equal(t, testStartupMessage(), <-msgCh)
+}
+
+func TestBackendDialProxyProtocolTLS(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 26257}
+	expected := encodeProxyProtocolHeader(&proxyProtocolAddrs{source: src, destination: dst})
+
+	serverCfg, err := tlsConfig()
+	require.NoError(t, err)
+	headerCh := make(chan []byte, 1)
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		header := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		headerCh <- header
+		tlsConn, err := acceptSSLRequest(conn, serverCfg)
+		if err != nil {
+			return
+		}
+		if msg, err := receiveStartupMessage(tlsConn); err == nil {
+			msgCh <- msg
+		}
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := BackendDialContext(
+		ctx, testStartupMessage(), addr, &tls.Config{InsecureSkipVerify: true},
+		ProxyProtocol(src, dst),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, expected, <-headerCh)
+	require.Equal(t, testStartupMessage(), <-msgCh)
+}
+
+// writeCountingConn is a net.Conn which records the bytes written to it,
+// rather than writing them to the embedded connection, and counts the writes.
+type writeCountingConn struct {
+	net.Conn
+	writes  int
+	written []byte
+	// limit, if positive, is the maximum number of bytes accepted by a write,
+	// beyond which it fails.
+	limit int
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	c.writes++
+	if c.limit > 0 && len(b) > c.limit {
+		c.written = append(c.written, b[:c.limit]...)
+		return c.limit, errors.New("connection reset")
+	}
+	c.written = append(c.written, b...)
+	return len(b), nil
+}
+
+func TestProxyProtocolHeaderCoalescing(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	opts := newDialOptions(nil)
+	header := encodeProxyProtocolHeader(&proxyProtocolAddrs{})
+	// A single parameter keeps the encoding of the message deterministic.
+	msg := &pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "root"},
+	}
+	startup := msg.Encode(nil)
+	// The pipe is only used to set deadlines.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// The header is sent along with the startup message, in a single write.
+	raw := &writeCountingConn{Conn: client}
+	wire := &countingConn{Conn: raw, pending: header}
+	require.NoError(t, relayStartupMsg(ctx, wire, msg, opts))
+	require.Equal(t, 1, raw.writes)
+	require.Equal(t, append(append([]byte(nil), header...), startup...), raw.written)
+	require.Equal(t, int64(len(header)+len(startup)), wire.BytesOut())
+	// Subsequent writes are not affected.
+	_, err := wire.Write([]byte("Q"))
+	require.NoError(t, err)
+	require.Equal(t, 2, raw.writes)
+
+	// Short writes are reported in terms of the bytes of the message.
+	raw = &writeCountingConn{Conn: client, limit: len(header) + 10}
+	wire = &countingConn{Conn: raw, pending: header}
+	n, err := wire.Write(startup)
+	require.Equal(t, 10, n)
+	require.Regexp(t, "connection reset", err)
+	raw = &writeCountingConn{Conn: client, limit: len(header) - 1}
+	wire = &countingConn{Conn: raw, pending: header}
+	n, err = wire.Write(startup)
+	require.Equal(t, 0, n)
+	require.Error(t, err)
+}
+
+// BenchmarkProxyProtocolStartup compares the number of writes needed to send
+// the PROXY protocol header and the startup message on plaintext connections,
+// when they are written separately, as they used to be, and when they are
+// coalesced.
+func BenchmarkProxyProtocolStartup(b *testing.B) {
+	ctx := context.Background()
+	opts := newDialOptions(nil)
+	msg := testStartupMessage()
+	header := encodeProxyProtocolHeader(&proxyProtocolAddrs{})
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	b.Run("separate", func(b *testing.B) {
+		raw := &writeCountingConn{Conn: client}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			raw.written = raw.written[:0]
+			wire := &countingConn{Conn: raw}
+			if _, err := wire.Write(header); err != nil {
+				b.Fatal(err)
+			}
+			if err := relayStartupMsg(ctx, wire, msg, opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(raw.writes)/float64(b.N), "writes/op")
+	})
+	b.Run("coalesced", func(b *testing.B) {
+		raw := &writeCountingConn{Conn: client}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			raw.written = raw.written[:0]
+			wire := &countingConn{Conn: raw, pending: header}
+			if err := relayStartupMsg(ctx, wire, msg, opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(raw.writes)/float64(b.N), "writes/op")
+	})
+}
@@ -0,0 +1,334 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// protectedStartupParams are the startup parameters that identify the session,
+// and are never modified when relaying a StartupMessage to the backend.
+var protectedStartupParams = []string{"user", "database"}
+
+// StartupParams returns a copy of the parameters of msg, including "user" and
+// "database", as a map which hooks (e.g. StartupParamRewriter or a
+// StartupParamRouter) can freely modify. The map is never nil.
+func StartupParams(msg *pgproto3.StartupMessage) map[string]string {
+	params := make(map[string]string, len(msg.Parameters))
+	for k, v := range msg.Parameters {
+		params[k] = v
+	}
+	return params
+}
+
+// ApplyStartupParams replaces the parameters of msg, including "user" and
+// "database", with a copy of params, so that params can be modified further
+// without affecting msg. It is the reverse of StartupParams.
+func ApplyStartupParams(msg *pgproto3.StartupMessage, params map[string]string) {
+	copied := make(map[string]string, len(params))
+	for k, v := range params {
+		copied[k] = v
+	}
+	msg.Parameters = copied
+}
+
+// StartupParamRewriter, if set, is applied to the parameters of every
+// StartupMessage before it is relayed to the backend. This allows operators to
+// strip parameters (e.g. "options"), inject defaults such as
+// "application_name", or pin "client_encoding".
+//
+// The rewriter is given a copy of the parameters, and may modify and return
+// it. If the rewriter returns nil, the message is relayed unchanged. The
+// "user" and "database" parameters are always relayed as supplied by the
+// client, regardless of the rewriter's output.
+var StartupParamRewriter func(params map[string]string) map[string]string
+
+// rewriteStartupMsg returns the StartupMessage that should be relayed to the
+// backend in place of msg, after applying StartupParamRewriter. msg itself is
+// never modified.
+func rewriteStartupMsg(msg *pgproto3.StartupMessage) *pgproto3.StartupMessage {
+	if StartupParamRewriter == nil {
+		return msg
+	}
+	params := StartupParams(msg)
+	params = StartupParamRewriter(params)
+	if params == nil {
+		return msg
+	}
+	for _, key := range protectedStartupParams {
+		if v, ok := msg.Parameters[key]; ok {
+			params[key] = v
+		} else {
+			delete(params, key)
+		}
+	}
+	return &pgproto3.StartupMessage{
+		ProtocolVersion: msg.ProtocolVersion,
+		Parameters:      params,
+	}
+}
+
+// ClientAddrParam configures the dialer to pass clientAddr, the address of the
+// client on whose behalf the backend is dialed (e.g. the RemoteAddr of the
+// client connection), to the backend through the startup parameter named
+// param, so that the backend can record the address of the client rather than
+// that of the proxy. param defaults to "crdb:remote_addr" if empty, and the
+// value is clientAddr.String().
+//
+// The parameter is set after StartupParamAllowlist and StartupParamRewriter
+// were applied, so it is always relayed, and takes precedence over a parameter
+// of the same name supplied by the client or set by the rewriter. It can't be
+// used to override "user" or "database".
+func ClientAddrParam(param string, clientAddr net.Addr) DialOption {
+	if param == "" {
+		param = remoteAddrStartupParam
+	}
+	p := &startupParam{name: param, value: clientAddr.String()}
+	return func(opts *dialOptions) {
+		opts.clientAddrParam = p
+	}
+}
+
+// startupParam is a startup parameter set by the dialer.
+type startupParam struct {
+	name, value string
+}
+
+// injectStartupParam returns the StartupMessage that should be relayed to the
+// backend in place of msg, with param set. msg itself is never modified. msg is
+// returned as is if param is nil, or is a protected parameter.
+func injectStartupParam(
+	msg *pgproto3.StartupMessage, param *startupParam,
+) *pgproto3.StartupMessage {
+	if param == nil {
+		return msg
+	}
+	for _, key := range protectedStartupParams {
+		if param.name == key {
+			return msg
+		}
+	}
+	params := StartupParams(msg)
+	params[param.name] = param.value
+	return &pgproto3.StartupMessage{
+		ProtocolVersion: msg.ProtocolVersion,
+		Parameters:      params,
+	}
+}
+
+// compressionStartupParams are the startup parameters through which clients
+// negotiate the compression of the wire protocol: the protocol extension
+// proposed for PostgreSQL, through "_pq_." protocol options, and the
+// equivalent plain parameter used by some drivers.
+var compressionStartupParams = []string{
+	"_pq_.compression", "_pq_.libpq_compression", "compression",
+}
+
+// CompressionPolicy controls how the startup parameters which negotiate wire
+// compression between the client and the backend are handled.
+type CompressionPolicy int
+
+const (
+	// CompressionStrip drops the compression parameters, so that the stream
+	// exchanged with the backend is uncompressed, and can be inspected by the
+	// proxy (e.g. by ObserveBackendKeyData or DrainController). The backend
+	// then declines the compression, as if it didn't support it.
+	CompressionStrip CompressionPolicy = iota
+	// CompressionPassthrough relays the compression parameters to the
+	// backend, so that compression is negotiated end-to-end. The proxy must
+	// then forward the stream blindly after the startup, since features which
+	// parse the messages exchanged with the backend can't decode it.
+	CompressionPassthrough
+)
+
+// StartupCompression configures how the dialer handles the startup parameters
+// which negotiate wire compression. The default is CompressionStrip. The
+// policy is applied after StartupParamRewriter.
+func StartupCompression(policy CompressionPolicy) DialOption {
+	return func(opts *dialOptions) {
+		opts.compressionPolicy = policy
+	}
+}
+
+// applyCompressionPolicy returns the StartupMessage that should be relayed to
+// the backend in place of msg, after applying policy. msg itself is never
+// modified.
+func applyCompressionPolicy(
+	msg *pgproto3.StartupMessage, policy CompressionPolicy,
+) *pgproto3.StartupMessage {
+	if policy == CompressionPassthrough || !hasCompressionParams(msg) {
+		return msg
+	}
+	params := StartupParams(msg)
+	for _, key := range compressionStartupParams {
+		delete(params, key)
+	}
+	return &pgproto3.StartupMessage{
+		ProtocolVersion: msg.ProtocolVersion,
+		Parameters:      params,
+	}
+}
+
+// hasCompressionParams returns whether msg has any compression parameter.
+func hasCompressionParams(msg *pgproto3.StartupMessage) bool {
+	for _, key := range compressionStartupParams {
+		if _, ok := msg.Parameters[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// optionsStartupParam is the startup parameter used to pass command-line
+// arguments to the backend, which can be used to set session settings (e.g.
+// "-c search_path=public" or "--search_path=public").
+//
+// See "options" in https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-PARAMKEYWORDS.
+const optionsStartupParam = "options"
+
+// StartupParamPolicy controls how startup parameters that are not on the
+// allowlist configured through StartupParamAllowlist are handled.
+type StartupParamPolicy int
+
+const (
+	// StartupParamDrop drops the parameters which are not allowed, and relays
+	// the remaining ones to the backend.
+	StartupParamDrop StartupParamPolicy = iota
+	// StartupParamReject fails the connection if any parameter is not
+	// allowed.
+	StartupParamReject
+)
+
+// StartupParamAllowlist configures the dialer to only relay the startup
+// parameters in allowed to the backend, so that clients cannot smuggle
+// arbitrary session settings. Settings passed through the "options" parameter
+// (e.g. "-c name=value" and "--name=value") are checked individually against
+// allowed as well, and are relayed if allowed, regardless of whether
+// "options" itself is on the allowlist. Parameters that are not allowed are
+// dropped or cause the dial to fail with a codeStartupParamNotAllowed error,
+// depending on policy. SendErrToClient doesn't sanitize the message of the
+// error, so that clients learn which of their parameters are not allowed.
+//
+// The "user" and "database" parameters, as well as the parameters set by the
+// proxy itself, are always allowed. The allowlist is enforced before
+// StartupParamRewriter is applied.
+func StartupParamAllowlist(allowed []string, policy StartupParamPolicy) DialOption {
+	allowlist := &startupParamAllowlist{
+		allowed: make(map[string]struct{}, len(allowed)),
+		policy:  policy,
+	}
+	for _, name := range allowed {
+		allowlist.allowed[name] = struct{}{}
+	}
+	return func(opts *dialOptions) {
+		opts.paramAllowlist = allowlist
+	}
+}
+
+// startupParamAllowlist is the allowlist configured through
+// StartupParamAllowlist.
+type startupParamAllowlist struct {
+	allowed map[string]struct{}
+	policy  StartupParamPolicy
+}
+
+// isAllowed returns whether the startup parameter or session setting with the
+// given name is allowed.
+func (a *startupParamAllowlist) isAllowed(name string) bool {
+	switch name {
+	case remoteAddrStartupParam, sessionRevivalTokenStartupParam:
+		return true
+	}
+	for _, key := range protectedStartupParams {
+		if name == key {
+			return true
+		}
+	}
+	_, ok := a.allowed[name]
+	return ok
+}
+
+// enforce returns the StartupMessage that should be relayed to the backend in
+// place of msg, after applying the allowlist. msg itself is never modified.
+func (a *startupParamAllowlist) enforce(
+	msg *pgproto3.StartupMessage,
+) (*pgproto3.StartupMessage, error) {
+	params := make(map[string]string, len(msg.Parameters))
+	var disallowed []string
+	for key, value := range msg.Parameters {
+		if key == optionsStartupParam {
+			options, disallowedOpts := a.filterOptions(value)
+			disallowed = append(disallowed, disallowedOpts...)
+			if options != "" {
+				params[key] = options
+			}
+			continue
+		}
+		if !a.isAllowed(key) {
+			disallowed = append(disallowed, key)
+			continue
+		}
+		params[key] = value
+	}
+	if len(disallowed) > 0 && a.policy == StartupParamReject {
+		// Sort for a deterministic error message.
+		sort.Strings(disallowed)
+		return nil, newErrorf(
+			codeStartupParamNotAllowed, "startup parameters not allowed: %s",
+			strings.Join(disallowed, ", "),
+		)
+	}
+	return &pgproto3.StartupMessage{
+		ProtocolVersion: msg.ProtocolVersion,
+		Parameters:      params,
+	}, nil
+}
+
+// filterOptions returns the options parameter with the session settings that
+// are not allowed removed, as well as the names of the removed settings.
+// Arguments which do not set a session setting cannot be checked against the
+// allowlist, and are removed as well.
+//
+// This assumes that whitespaces are used to separate command line args.
+// Unlike the original spec, this does not handle escaping rules.
+func (a *startupParamAllowlist) filterOptions(options string) (string, []string) {
+	var kept, disallowed []string
+	args := strings.Fields(options)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var setting string
+		switch {
+		case arg == "-c" && i+1 < len(args):
+			i++
+			arg = arg + " " + args[i]
+			setting = args[i]
+		case strings.HasPrefix(arg, "-c"):
+			setting = strings.TrimPrefix(arg, "-c")
+		case strings.HasPrefix(arg, "--"):
+			setting = strings.TrimPrefix(arg, "--")
+		}
+		name := setting
+		if idx := strings.IndexByte(setting, '='); idx >= 0 {
+			name = setting[:idx]
+		}
+		if name == "" {
+			name = arg
+		}
+		if setting == "" || !a.isAllowed(name) {
+			disallowed = append(disallowed, name)
+			continue
+		}
+		kept = append(kept, arg)
+	}
+	return strings.Join(kept, " "), disallowed
+}
@@ -0,0 +1,303 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewriteStartupMsg(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	newMsg := func() *pgproto3.StartupMessage {
+		return &pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters: map[string]string{
+				"user":     "root",
+				"database": "defaultdb",
+				"options":  "--cluster=foo",
+			},
+		}
+	}
+
+	t.Run("no rewriter", func(t *testing.T) {
+		msg := newMsg()
+		require.True(t, msg == rewriteStartupMsg(msg))
+	})
+
+	t.Run("nil result", func(t *testing.T) {
+		defer testutils.TestingHook(&StartupParamRewriter,
+			func(params map[string]string) map[string]string {
+				return nil
+			})()
+		msg := newMsg()
+		require.True(t, msg == rewriteStartupMsg(msg))
+	})
+
+	t.Run("rewrite", func(t *testing.T) {
+		defer testutils.TestingHook(&StartupParamRewriter,
+			func(params map[string]string) map[string]string {
+				delete(params, "options")
+				params["application_name"] = "proxy"
+				// Attempts to change user or database are ignored.
+				params["user"] = "admin"
+				delete(params, "database")
+				return params
+			})()
+		msg := newMsg()
+		rewritten := rewriteStartupMsg(msg)
+		require.Equal(t, map[string]string{
+			"user":             "root",
+			"database":         "defaultdb",
+			"application_name": "proxy",
+		}, rewritten.Parameters)
+		require.Equal(t, msg.ProtocolVersion, rewritten.ProtocolVersion)
+		// The original message is left untouched.
+		require.Equal(t, newMsg(), msg)
+	})
+}
+
+func TestStartupParamAllowlist(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	newMsg := func(params map[string]string) *pgproto3.StartupMessage {
+		return &pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      params,
+		}
+	}
+	allowed := []string{"application_name", "search_path"}
+
+	for _, tc := range []struct {
+		name     string
+		params   map[string]string
+		expected map[string]string
+		// disallowed is the error expected with StartupParamReject, if any.
+		disallowed string
+	}{
+		{
+			name: "all allowed",
+			params: map[string]string{
+				"user":                 "root",
+				"database":             "defaultdb",
+				"application_name":     "app",
+				remoteAddrStartupParam: "127.0.0.1:1234",
+			},
+			expected: map[string]string{
+				"user":                 "root",
+				"database":             "defaultdb",
+				"application_name":     "app",
+				remoteAddrStartupParam: "127.0.0.1:1234",
+			},
+		},
+		{
+			name: "disallowed parameter",
+			params: map[string]string{
+				"user":                                   "root",
+				"default_transaction_use_follower_reads": "on",
+			},
+			expected:   map[string]string{"user": "root"},
+			disallowed: "default_transaction_use_follower_reads",
+		},
+		{
+			name: "options",
+			params: map[string]string{
+				"user":    "root",
+				"options": "-c search_path=a --statement_timeout=0 -csearch_path=b --search_path=c -x",
+			},
+			expected: map[string]string{
+				"user":    "root",
+				"options": "-c search_path=a -csearch_path=b --search_path=c",
+			},
+			disallowed: "-x, statement_timeout",
+		},
+		{
+			name: "no allowed options",
+			params: map[string]string{
+				"user":    "root",
+				"options": "-c statement_timeout=0",
+			},
+			expected:   map[string]string{"user": "root"},
+			disallowed: "statement_timeout",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts dialOptions
+			StartupParamAllowlist(allowed, StartupParamDrop)(&opts)
+			msg := newMsg(tc.params)
+			out, err := opts.paramAllowlist.enforce(msg)
+			require.NoError(t, err)
+			require.Equal(t, newMsg(tc.expected), out)
+
+			StartupParamAllowlist(allowed, StartupParamReject)(&opts)
+			out, err = opts.paramAllowlist.enforce(msg)
+			if tc.disallowed == "" {
+				require.NoError(t, err)
+				require.Equal(t, newMsg(tc.expected), out)
+			} else {
+				require.Nil(t, out)
+				require.Equal(t, codeStartupParamNotAllowed, getErrorCode(err))
+				require.EqualError(t, err,
+					"codeStartupParamNotAllowed: startup parameters not allowed: "+tc.disallowed)
+				require.Equal(t, err.Error(), toPgError(err).Message)
+			}
+		})
+	}
+
+	t.Run("dial", func(t *testing.T) {
+		be, err := newTestBackend(nil /* serverTLSConfig */)
+		require.NoError(t, err)
+		defer be.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		msg := newMsg(map[string]string{"user": "root", "timezone": "UTC"})
+		conn, err := BackendDialContext(
+			ctx, msg, be.Addr(), nil /* tlsConfig */, StartupParamAllowlist(nil, StartupParamDrop),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, newMsg(map[string]string{"user": "root"}), <-be.StartupMessages())
+		// The original message is not modified.
+		require.Equal(t, "UTC", msg.Parameters["timezone"])
+	})
+}
+
+func TestClientAddrParam(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		if msg, err := receiveStartupMessage(conn); err == nil {
+			msgCh <- msg
+		}
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5432}
+
+	// The address supplied by the client, or set by the rewriter, is
+	// overridden.
+	defer testutils.TestingHook(&StartupParamRewriter,
+		func(params map[string]string) map[string]string {
+			params["x-client-ip"] = "10.0.0.1"
+			return params
+		})()
+	msg := testStartupMessage()
+	msg.Parameters[remoteAddrStartupParam] = "127.0.0.1:1234"
+	conn, err := BackendDialContext(
+		ctx, msg, addr, nil /* tlsConfig */, ClientAddrParam("", clientAddr),
+		StartupParamAllowlist(nil, StartupParamDrop),
+	)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Equal(t, map[string]string{
+		"user":                 "root",
+		"database":             "defaultdb",
+		"x-client-ip":          "10.0.0.1",
+		remoteAddrStartupParam: "203.0.113.7:5432",
+	}, (<-msgCh).Parameters)
+	// The original message is left untouched.
+	require.Equal(t, "127.0.0.1:1234", msg.Parameters[remoteAddrStartupParam])
+
+	conn, err = BackendDialContext(
+		ctx, testStartupMessage(), addr, nil, /* tlsConfig */
+		ClientAddrParam("x-client-ip", clientAddr),
+	)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Equal(t, "203.0.113.7:5432", (<-msgCh).Parameters["x-client-ip"])
+
+	// The user and database can't be overridden.
+	conn, err = BackendDialContext(
+		ctx, testStartupMessage(), addr, nil, /* tlsConfig */
+		ClientAddrParam("user", clientAddr),
+	)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Equal(t, "root", (<-msgCh).Parameters["user"])
+}
+
+func TestStartupCompression(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	msgCh := make(chan *pgproto3.StartupMessage, 1)
+	addr, stop := startTestBackend(t, func(conn net.Conn) {
+		if msg, err := receiveStartupMessage(conn); err == nil {
+			msgCh <- msg
+		}
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	compressedMsg := func() *pgproto3.StartupMessage {
+		msg := testStartupMessage()
+		msg.Parameters["_pq_.compression"] = "zstd,lz4"
+		msg.Parameters["compression"] = "on"
+		return msg
+	}
+
+	// The compression parameters are stripped by default.
+	msg := compressedMsg()
+	conn, err := BackendDialContext(ctx, msg, addr, nil /* tlsConfig */)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Equal(t, testStartupMessage().Parameters, (<-msgCh).Parameters)
+	// The original message is left untouched.
+	require.Equal(t, compressedMsg().Parameters, msg.Parameters)
+
+	conn, err = BackendDialContext(
+		ctx, compressedMsg(), addr, nil, /* tlsConfig */
+		StartupCompression(CompressionPassthrough),
+	)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Equal(t, compressedMsg().Parameters, (<-msgCh).Parameters)
+
+	// Messages without compression parameters are relayed as is.
+	msg = testStartupMessage()
+	require.Same(t, msg, applyCompressionPolicy(msg, CompressionStrip))
+}
+
+func TestStartupParams(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	msg := testStartupMessage()
+	msg.Parameters["application_name"] = "app"
+	params := StartupParams(msg)
+	require.Equal(t, map[string]string{
+		"user":             "root",
+		"database":         "defaultdb",
+		"application_name": "app",
+	}, params)
+
+	// The parameters are a copy.
+	params["user"] = "admin"
+	delete(params, "application_name")
+	require.Equal(t, "root", msg.Parameters["user"])
+	require.Equal(t, "app", msg.Parameters["application_name"])
+
+	ApplyStartupParams(msg, params)
+	require.Equal(t, map[string]string{"user": "admin", "database": "defaultdb"}, msg.Parameters)
+	params["database"] = "other"
+	require.Equal(t, "defaultdb", msg.Parameters["database"])
+
+	require.NotNil(t, StartupParams(&pgproto3.StartupMessage{}))
+}
@@ -0,0 +1,268 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package sqlproxyccl
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// testBackend is a minimal in-memory PostgreSQL backend listening on a
+// loopback address, which can be used by tests in place of a real SQL server.
+// Its Dial method is compatible with BackendDial, and each StartupMessage
+// relayed through it is published on StartupMessages, which allows tests to
+// assert which startup parameters reached the backend.
+//
+// The backend answers each StartupMessage with AuthenticationOk and
+// ReadyForQuery, and discards everything it receives afterwards.
+type testBackend struct {
+	// serverTLSConfig is used to accept SSLRequests. If nil, SSLRequests are
+	// refused.
+	serverTLSConfig *tls.Config
+	// closeOnAccept, if true, causes the backend to close every connection
+	// right after accepting it.
+	closeOnAccept bool
+
+	ln          net.Listener
+	startupMsgs chan *pgproto3.StartupMessage
+	stopper     chan struct{}
+	wg          sync.WaitGroup
+}
+
+// newTestBackend starts a new testBackend. If serverTLSConfig is nil, the
+// backend refuses SSLRequests, so dials with a non-nil tls.Config fail with a
+// codeBackendRefusedTLS error. Close must be called to release the resources
+// of the backend.
+func newTestBackend(serverTLSConfig *tls.Config) (*testBackend, error) {
+	b := &testBackend{serverTLSConfig: serverTLSConfig}
+	if err := b.start(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// newTLSRefusingTestBackend starts a new testBackend which simulates a backend
+// that refuses TLS connections: it answers SSLRequests with 'N', so dials with
+// a tls.Config fail with a codeBackendRefusedTLS error. Plaintext dials
+// succeed, as they would with such a backend.
+func newTLSRefusingTestBackend() (*testBackend, error) {
+	return newTestBackend(nil /* serverTLSConfig */)
+}
+
+// newClosingTestBackend starts a new testBackend which simulates a backend
+// that goes down as connections are established: it closes every connection
+// right after accepting it. Dials which wait for a response from the backend,
+// i.e. dials with a tls.Config or with AuthTimeout, fail with a codeBackendDown
+// error. Without them, the dial may succeed, since the StartupMessage is
+// buffered by the kernel, or fail with a codeBackendClosedDuringStartup error
+// if the backend reset the connection in time.
+func newClosingTestBackend() (*testBackend, error) {
+	b := &testBackend{closeOnAccept: true}
+	if err := b.start(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// start starts serving b, which only needs its configuration fields to be
+// set.
+func (b *testBackend) start() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	b.ln = ln
+	b.startupMsgs = make(chan *pgproto3.StartupMessage, 16)
+	b.stopper = make(chan struct{})
+	b.wg.Add(1)
+	go b.serve()
+	return nil
+}
+
+// Addr returns the address the backend is listening on.
+func (b *testBackend) Addr() string {
+	return b.ln.Addr().String()
+}
+
+// StartupMessages returns a channel which receives each StartupMessage
+// relayed to the backend. The channel is buffered, and the backend stops
+// accepting new messages once the buffer is full until the channel is
+// drained.
+func (b *testBackend) StartupMessages() <-chan *pgproto3.StartupMessage {
+	return b.startupMsgs
+}
+
+// Dial has the same signature as BackendDial, and dials the backend using the
+// regular BackendDialContext code path. serverAddress is ignored, and the
+// backend's own address is used instead.
+func (b *testBackend) Dial(
+	msg *pgproto3.StartupMessage, serverAddress string, tlsConfig *tls.Config,
+) (net.Conn, error) {
+	return BackendDialContext(context.Background(), msg, b.Addr(), tlsConfig)
+}
+
+// Close stops the backend, and waits for all of its connections to be closed.
+func (b *testBackend) Close() {
+	close(b.stopper)
+	_ = b.ln.Close()
+	b.wg.Wait()
+}
+
+// serve accepts connections until the listener is closed.
+func (b *testBackend) serve() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.handle(conn)
+		}()
+	}
+}
+
+// handle serves a single connection to the backend.
+func (b *testBackend) handle(conn net.Conn) {
+	if b.closeOnAccept {
+		_ = conn.Close()
+		return
+	}
+	// Ensure that the connection is closed when the backend is stopped, so
+	// that blocked reads below return.
+	done := make(chan struct{})
+	defer close(done)
+	rawConn := conn
+	go func() {
+		select {
+		case <-b.stopper:
+		case <-done:
+		}
+		_ = rawConn.Close()
+	}()
+
+	be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	msg, err := be.ReceiveStartupMessage()
+	if err != nil {
+		return
+	}
+	if _, ok := msg.(*pgproto3.SSLRequest); ok {
+		if b.serverTLSConfig == nil {
+			_, _ = conn.Write([]byte{'N'})
+			return
+		}
+		if _, err := conn.Write([]byte{pgAcceptSSLRequest}); err != nil {
+			return
+		}
+		conn = tls.Server(conn, b.serverTLSConfig)
+		be = pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+		if msg, err = be.ReceiveStartupMessage(); err != nil {
+			return
+		}
+	}
+	startup, ok := msg.(*pgproto3.StartupMessage)
+	if !ok {
+		return
+	}
+	select {
+	case b.startupMsgs <- startup:
+	case <-b.stopper:
+		return
+	}
+	if err := be.Send(&pgproto3.AuthenticationOk{}); err != nil {
+		return
+	}
+	if err := be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'}); err != nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+func TestTestBackend(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	t.Run("plaintext", func(t *testing.T) {
+		be, err := newTestBackend(nil /* serverTLSConfig */)
+		require.NoError(t, err)
+		defer be.Close()
+		defer testutils.TestingHook(&BackendDial, be.Dial)()
+
+		conn, err := BackendDial(testStartupMessage(), "ignored:26257", nil /* tlsConfig */)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, testStartupMessage(), <-be.StartupMessages())
+
+		// The backend completes the authentication phase.
+		fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+		msg, err := fe.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.AuthenticationOk{}, msg)
+		msg, err = fe.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ReadyForQuery{}, msg)
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		serverCfg, err := tlsConfig()
+		require.NoError(t, err)
+		be, err := newTestBackend(serverCfg)
+		require.NoError(t, err)
+		defer be.Close()
+
+		conn, err := be.Dial(testStartupMessage(), "", &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, testStartupMessage(), <-be.StartupMessages())
+		_, ok := BackendTLSState(conn)
+		require.True(t, ok)
+	})
+
+	t.Run("refused tls", func(t *testing.T) {
+		be, err := newTLSRefusingTestBackend()
+		require.NoError(t, err)
+		defer be.Close()
+
+		conn, err := be.Dial(testStartupMessage(), "", &tls.Config{})
+		require.Nil(t, conn)
+		require.Equal(t, codeBackendRefusedTLS, getErrorCode(err))
+
+		// Plaintext connections are accepted.
+		conn, err = be.Dial(testStartupMessage(), "", nil /* tlsConfig */)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, testStartupMessage(), <-be.StartupMessages())
+	})
+
+	t.Run("closing", func(t *testing.T) {
+		be, err := newClosingTestBackend()
+		require.NoError(t, err)
+		defer be.Close()
+
+		_, err = BackendDial(testStartupMessage(), be.Addr(), &tls.Config{})
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+
+		_, err = BackendDialContext(
+			context.Background(), testStartupMessage(), be.Addr(), nil, /* tlsConfig */
+			AuthTimeout(10*time.Second),
+		)
+		require.Equal(t, codeBackendDown, getErrorCode(err))
+	})
+}